@@ -2,20 +2,46 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/archive"
 	probeRunner "github.com/akiasmaka/home-network-tracker/go-loader/pkg/bpf"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/config"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/dashboards"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
 	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/notify"
 	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/output"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/resolver"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/series"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/simulate"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/state"
 	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
 	bpf "github.com/aquasecurity/libbpfgo"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// TC classifiers and tracker maps in xdp.bpf.c.
+const (
+	tcIngressProgram = "tc_count_ingress"
+	tcEgressProgram  = "tc_count_egress"
+	ipv4TrackerMap   = "ipv4_connection_tracker"
+	ipv6TrackerMap   = "ipv6_connection_tracker"
+	ipv4Blocklist    = "ipv4_blocklist"
+	ipv6Blocklist    = "ipv6_blocklist"
+	blockRuleDrops   = "block_rule_drops"
+	l3InterfacesMap  = "l3_interfaces"
 )
 
 func checkIfErrorAndExit(err error) {
@@ -25,10 +51,23 @@ func checkIfErrorAndExit(err error) {
 }
 
 func run() int {
-	config := zap.NewDevelopmentConfig()
-	config.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	l, err := config.Build()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	logConfig := zap.NewDevelopmentConfig()
+	level, _ := zapcore.ParseLevel(cfg.LogLevel)
+	logConfig.Level = zap.NewAtomicLevelAt(level)
+	l, err := logConfig.Build()
+	checkIfErrorAndExit(err)
+
+	// The simulated traffic doesn't come from the interfaces of this host.
+	localNetworks, err := network.ParseLocalNetworks(cfg.LocalNetworks, !cfg.Simulate)
 	checkIfErrorAndExit(err)
+	network.SetLocalNetworks(localNetworks)
+	l.Sugar().Infof("Local networks: %v", localNetworks)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -44,45 +83,282 @@ func run() int {
 		cancel()
 	}()
 
-	xpdRunner, err := probeRunner.NewRunner("build/xdp.bpf.o")
-	checkIfErrorAndExit(err)
+	var kernelMaps, blocklistMaps map[int]kernelmap.KernelMap
+	var dropsMap kernelmap.KernelMap
+	var start func(ct *tracker.ConnectionTracker) error
+	// stop detaches the programs, the maps stay readable until run returns.
+	stop := func() error { return nil }
+	// pinned is set when the kernel maps still hold the previous run's
+	// counters, the state file is not loaded then.
+	pinned := false
+	if cfg.Simulate {
+		l.Info("Running in simulated mode, no BPF program is loaded")
+		maps := simulate.NewMaps()
+		kernelMaps, blocklistMaps, dropsMap = maps.Trackers, maps.Blocklist, maps.Drops
+		start = func(ct *tracker.ConnectionTracker) error {
+			events := make(chan []byte, 64)
+			go ct.ListenToEvents(ctx, events)
+			go simulate.Run(ctx, maps, 200*time.Millisecond, events)
+			return nil
+		}
+	} else {
+		var xdpModes []probeRunner.XDPMode
+		for _, name := range cfg.XDPModes {
+			mode, err := probeRunner.ParseXDPMode(name)
+			checkIfErrorAndExit(err)
+			xdpModes = append(xdpModes, mode)
+		}
 
-	err = xpdRunner.LoadProgram("xdp_count_type")
-	checkIfErrorAndExit(err)
+		pins := probeRunner.PinOptions{Dir: cfg.Pin.Path, Links: cfg.Pin.Links}
+		if cfg.Pin.Maps {
+			pins.Maps = []string{ipv4TrackerMap, ipv6TrackerMap}
+		}
+		xpdRunner, err := probeRunner.NewRunner(cfg.ObjectPath, pins, l)
+		checkIfErrorAndExit(err)
+		// Also runs when start fails or on a panic, so nothing is left
+		// attached to the interfaces.
+		defer func() {
+			if err := xpdRunner.Close(); err != nil {
+				l.Sugar().Errorf("Failed to close BPF module cleanly: %v", err)
+			}
+		}()
+
+		err = xpdRunner.LoadProgram(cfg.Program)
+		checkIfErrorAndExit(err)
+		if cfg.IngressHook == "tc" {
+			err = xpdRunner.LoadProgram(tcIngressProgram)
+			checkIfErrorAndExit(err)
+		}
+		if cfg.TCEgress {
+			err = xpdRunner.LoadProgram(tcEgressProgram)
+			checkIfErrorAndExit(err)
+		}
+
+		m4, err := xpdRunner.GetMap(ipv4TrackerMap)
+		checkIfErrorAndExit(err)
+		m6, err := xpdRunner.GetMap(ipv6TrackerMap)
+		checkIfErrorAndExit(err)
+		pinned = xpdRunner.Reused(ipv4TrackerMap) || xpdRunner.Reused(ipv6TrackerMap)
+
+		b4, err := xpdRunner.GetMap(ipv4Blocklist)
+		checkIfErrorAndExit(err)
+		b6, err := xpdRunner.GetMap(ipv6Blocklist)
+		checkIfErrorAndExit(err)
+		blocklistMaps = map[int]kernelmap.KernelMap{network.IPV4: b4, network.IPV6: b6}
+		dropsMap, err = xpdRunner.GetMap(blockRuleDrops)
+		checkIfErrorAndExit(err)
+		kernelMaps = map[int]kernelmap.KernelMap{network.IPV4: m4, network.IPV6: m6}
+		l3Interfaces, err := xpdRunner.GetMap(l3InterfacesMap)
+		checkIfErrorAndExit(err)
+
+		start = func(ct *tracker.ConnectionTracker) error {
+			eventsChannel, rb, err := xpdRunner.AttachRingBuffer("new_flow_events")
+			if err != nil {
+				return err
+			}
+			go listenToEvents(ctx, rb, eventsChannel, ct)
+
+			for _, iface := range cfg.Interfaces {
+				// Marked before attaching so no packet is parsed as ethernet.
+				if err := markL3(l3Interfaces, iface); err != nil {
+					return err
+				}
+				if cfg.IngressHook == "tc" {
+					err = xpdRunner.AttachProbe(tcIngressProgram, iface, probeRunner.TC_INGRESS)
+				} else {
+					_, err = xpdRunner.AttachXDP(cfg.Program, iface, xdpModes...)
+				}
+				if err != nil {
+					return err
+				}
+				if cfg.TCEgress {
+					if err := xpdRunner.AttachProbe(tcEgressProgram, iface, probeRunner.TC_EGRESS); err != nil {
+						return err
+					}
+				}
+			}
+			for _, a := range xpdRunner.List() {
+				if a.Type == probeRunner.XDP {
+					l.Sugar().Infof("Attached %s (%s, %s mode)", a.Name, a.Type, a.XDPMode)
+				} else {
+					l.Sugar().Infof("Attached %s (%s)", a.Name, a.Type)
+				}
+			}
+			return nil
+		}
+		// Pinned links keep counting while the daemon is down.
+		if !cfg.Pin.Links {
+			stop = xpdRunner.DetachAll
+		}
+	}
 
-	m, err := xpdRunner.GetMap("ipv4_connection_tracker")
+	res := resolver.New(resolver.Options{
+		Server:      cfg.Resolver.Server,
+		Timeout:     cfg.Resolver.Timeout,
+		Workers:     cfg.Resolver.Workers,
+		QueueSize:   1024,
+		TTL:         cfg.Resolver.TTL,
+		NegativeTTL: cfg.Resolver.NegativeTTL,
+	}, l)
+	go res.Run(ctx)
+
+	ct := tracker.NewConnectionTracker(ctx, cfg.InactiveTimeout, cfg.ActiveTimeout, cfg.CheckInterval, kernelMaps, res, l)
+	if cfg.Archive.Path != "" {
+		flows, err := archive.Open(archive.Options{
+			Path:     cfg.Archive.Path,
+			MaxSize:  int64(cfg.Archive.MaxSizeMB) << 20,
+			MaxFiles: cfg.Archive.MaxFiles,
+		})
+		if err != nil {
+			l.Sugar().Errorf("Failed to open the flow archive: %v", err)
+			return 1
+		}
+		defer flows.Close()
+		ct.AddExpiryHook(flows)
+	}
+
+	blocklist := rules.NewBlocklist(blocklistMaps, dropsMap, l)
+	ct.SetBlocklist(blocklist)
+
+	storage, err := state.Open(cfg.StateBackend, cfg.StateFile, l)
 	checkIfErrorAndExit(err)
 
-	ct := tracker.NewConnectionTracker(ctx, 72*time.Hour, 24*time.Hour, m, l)
+	if pinned {
+		// Seeding from the state file would overwrite newer counters.
+		l.Sugar().Infof("Reusing the maps pinned in %s, only the rules and devices of %s are loaded", cfg.Pin.Path, cfg.StateFile)
+		err = ct.LoadState(storage, false)
+		checkIfErrorAndExit(err)
+		ct.Harvest()
+	} else {
+		err = ct.LoadState(storage, true)
+		checkIfErrorAndExit(err)
+		if err := ct.DataToKernelMap(); err != nil {
+			l.Sugar().Warnf("Some connections could not be restored into the kernel: %v", err)
+		}
+	}
+
+	// Rules are in place before the first packet is seen. Rules added through
+	// the API are saved right away rather than with the next snapshot.
+	blocklist.OnChange(func() {
+		if err := ct.WriteSnapshot(storage); err != nil {
+			l.Sugar().Errorf("Failed to save the blocklist rules: %v", err)
+		}
+	})
+	go blocklist.Run(ctx)
+	if err := blocklist.Apply(cfg.Blocklist); err != nil {
+		l.Sugar().Errorf("Failed to apply the blocklist: %v", err)
+		return 1
+	}
+
+	// Set after the state is restored so the restored flows are not reported
+	// as new.
+	var notifier *notify.Notifier
+	if len(cfg.Notify.Webhooks) > 0 {
+		endpoints := make([]notify.Endpoint, 0, len(cfg.Notify.Webhooks))
+		for _, w := range cfg.Notify.Webhooks {
+			endpoints = append(endpoints, notify.Endpoint(w))
+		}
+		notifier, err = notify.New(notify.Options{
+			QueueDir:  cfg.Notify.QueueDir,
+			MaxQueue:  cfg.Notify.MaxQueue,
+			Endpoints: endpoints,
+		}, l)
+		if err != nil {
+			l.Sugar().Errorf("Failed to set up the webhooks: %v", err)
+			return 1
+		}
+		notifier.Run(ctx)
+		ct.SetEventHandler(notifier)
+		go notifier.WatchBlocklist(ctx, blocklist, cfg.Notify.BlockedInterval)
+	}
 
-	jsonFile, err := os.Open("data.json")
+	alertOpts := alert.Options{
+		Rules:          cfg.Alerts.Rules,
+		Silences:       cfg.Alerts.Silences,
+		RepeatInterval: cfg.Alerts.RepeatInterval,
+		KeepResolved:   cfg.Alerts.KeepResolved,
+	}
+	for _, sink := range cfg.Alerts.Sinks {
+		switch sink {
+		case "log":
+			alertOpts.Sinks = append(alertOpts.Sinks, alert.LogSink{L: l})
+		case "webhooks":
+			alertOpts.Sinks = append(alertOpts.Sinks, notifier)
+		}
+	}
+	alerts, err := alert.NewEngine(alertOpts)
 	checkIfErrorAndExit(err)
-	b, _ := io.ReadAll(jsonFile)
-	jsonFile.Close()
 
-	ct.JsonFileToTrackerData(b)
-	ct.DataToKernelMap()
+	var history *series.Store
+	if cfg.Series.Path != "" {
+		history, err = series.Open(series.Options{
+			Path:      cfg.Series.Path,
+			Flows:     cfg.Series.Flows,
+			Interval:  cfg.HarvestInterval,
+			Retention: series.Retention(cfg.Series.Retention),
+		}, l)
+		if err != nil {
+			l.Sugar().Errorf("Failed to open the history: %v", err)
+			return 1
+		}
+		defer history.Close()
+		go history.Run(ctx)
+	}
+
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go reloadBlocklist(ctx, hups, blocklist, l)
 
 	// Start the XDP program only after the map is "reconstructed"
-	xpdRunner.AttachProbe("xdp_count_type", "enp3s0", probeRunner.XDP)
-	checkIfErrorAndExit(err)
-	defer xpdRunner.Close()
+	if err := start(ct); err != nil {
+		l.Sugar().Errorf("Failed to start: %v", err)
+		return 1
+	}
 
-	innerRun(ctx, m, ct, done, l)
+	go ct.RunSnapshots(ctx, storage, cfg.SnapshotInterval)
+
+	innerRun(ctx, ct, blocklist, alerts, history, cfg.HTTP, cfg.Metrics, cfg.Grafana, cfg.HarvestInterval, done, l)
+
+	// Detach first so the counters stop moving, then read them one last time
+	// for the final snapshot. The module is closed when run returns. With
+	// pinned links nothing is detached and the snapshot is only a fallback.
+	if err := stop(); err != nil {
+		l.Sugar().Errorf("Failed to detach: %v", err)
+	}
+	ct.Harvest()
+	if err := ct.WriteSnapshot(storage); err != nil {
+		l.Sugar().Errorf("Failed to write snapshot on shutdown: %v", err)
+	}
 
 	return 0
 }
 
 func innerRun(ctx context.Context,
-	m *bpf.BPFMap,
 	ct *tracker.ConnectionTracker,
+	blocklist *rules.Blocklist,
+	alerts *alert.Engine,
+	history *series.Store,
+	httpCfg config.HTTPConfig,
+	metricsCfg config.MetricsConfig,
+	grafanaCfg config.GrafanaConfig,
+	harvestInterval time.Duration,
 	done chan bool,
 	l *zap.Logger) {
 
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(harvestInterval)
 	defer ticker.Stop()
 
-	server := output.Server{Addr: "", Port: 5000, Tracker: ct}
+	server := output.Server{
+		Addr:      httpCfg.Addr,
+		Port:      httpCfg.Port,
+		Tracker:   ct,
+		Metrics:   output.MetricsOptions(metricsCfg),
+		History:   output.NewHistory(grafanaCfg.Resolution, grafanaCfg.Retention, history == nil),
+		Blocklist: blocklist,
+		Alerts:    alerts,
+		Series:    history,
+		APIToken:  httpCfg.APIToken,
+	}
 	go server.Serve()
 
 	for {
@@ -90,60 +366,207 @@ func innerRun(ctx context.Context,
 		case <-done:
 			l.Debug("Exiting printMapData")
 			return
-		case <-ticker.C:
-			i := m.Iterator()
-			for i.Next() {
-				if i.Next() == false {
-					break
-				}
-				k := i.Key()
-				kPtr := unsafe.Pointer(&k[0])
-				kData, err := network.ParseIPv4Key(k)
-
-				if err != nil {
-					l.Sugar().Info("Error parsing key ", err)
-					continue
-				}
-				l.Debug(network.IntToIPv4(kData.Saddr).String())
-				v, err := m.GetValue(kPtr)
-				if err != nil {
-					l.Sugar().Error("Error GetValue key ", err)
-					continue
-				}
-
-				s, err := tracker.ParseConnectionStats(v)
-				if err != nil {
-					l.Sugar().Error("Error parseConnectionStats key ", err)
-					continue
+		case now := <-ticker.C:
+			ct.Harvest()
+			conns := ct.Data.ToSilce()
+			server.History.Record(now, conns)
+			alerts.Evaluate(now, conns)
+			if history != nil {
+				if err := history.Record(now, conns); err != nil {
+					l.Sugar().Errorf("Failed to record the history: %v", err)
 				}
+			}
+		}
+	}
+}
 
-				var kernelKey [64]byte
-				copy(kernelKey[:], k)
-				ct.Store(kernelKey, tracker.Connection{
-					ConnectionStats: s,
-					Saddr:           network.IntToIPv4(kData.Saddr).String(),
-					Daddr:           network.IntToIPv4(kData.Daddr).String(),
-					Type:            network.IPV4,
-				})
+// reloadBlocklist applies the blocklist of the config file again on SIGHUP,
+// the other settings need a restart.
+func reloadBlocklist(ctx context.Context, hups <-chan os.Signal, blocklist *rules.Blocklist, l *zap.Logger) {
+	for {
+		select {
+		case <-hups:
+			cfg, err := config.Load(os.Args[1:])
+			if err != nil {
+				l.Sugar().Errorf("Not reloading the blocklist: %v", err)
+				continue
 			}
+			if err := blocklist.Apply(cfg.Blocklist); err != nil {
+				l.Sugar().Errorf("Failed to reload the blocklist: %v", err)
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func listenToEvents(rb *bpf.RingBuffer, eventsChannel chan []byte, done chan bool) int {
+// markL3 tells the programs when iface has no ethernet header.
+func markL3(m kernelmap.KernelMap, iface string) error {
+	l3, err := network.IsL3(iface)
+	if err != nil || !l3 {
+		return err
+	}
+	ifindex, ok := network.InterfaceIndex(iface)
+	if !ok {
+		return fmt.Errorf("no interface %s", iface)
+	}
+	mark := uint8(1)
+	if err := m.Update(unsafe.Pointer(&ifindex), unsafe.Pointer(&mark)); err != nil {
+		return fmt.Errorf("failed to mark %s as an L3 interface: %w", iface, err)
+	}
+	return nil
+}
+
+func listenToEvents(ctx context.Context, rb *bpf.RingBuffer, eventsChannel chan []byte, ct *tracker.ConnectionTracker) {
 	rb.Poll(300)
 	defer rb.Stop()
-	for {
-		select {
-		case eventBytes := <-eventsChannel:
-			fmt.Println(eventBytes)
-		case <-done:
-			fmt.Println("Exit received")
-			return 0
+	ct.ListenToEvents(ctx, eventsChannel)
+}
+
+func runDashboards(args []string) int {
+	fs := flag.NewFlagSet("go-loader dashboards", flag.ExitOnError)
+	out := fs.String("out", "grafana", "directory the dashboards and provisioning files are written to")
+	url := fs.String("url", "http://localhost:5000", "URL Grafana uses to reach the go-loader HTTP server")
+	fs.Parse(args)
+
+	if err := dashboards.Write(*out, *url); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("Wrote Grafana provisioning to", *out)
+	return 0
+}
+
+// runWebhookEcho serves a webhook receiver printing what it gets, to try the
+// notify settings without a real service.
+func runWebhookEcho(args []string) int {
+	fs := flag.NewFlagSet("go-loader webhook-echo", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:5001", "address to listen on")
+	fail := fs.Float64("fail", 0, "share of requests answered with a 503, between 0 and 1")
+	fs.Parse(args)
+
+	fmt.Printf("Printing webhook requests sent to http://%s\n", *addr)
+	if err := http.ListenAndServe(*addr, notify.EchoHandler(os.Stdout, *fail)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runMigrate copies the state from one backend to another, the daemon
+// should be stopped so nothing is saved in between.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("go-loader migrate", flag.ExitOnError)
+	from := fs.String("from", "data.json", "state file to read")
+	fromBackend := fs.String("from-backend", state.BackendJSON, "backend of -from: json or bolt")
+	to := fs.String("to", "state.db", "state file to write")
+	toBackend := fs.String("to-backend", state.BackendBolt, "backend of -to: json or bolt")
+	force := fs.Bool("force", false, "overwrite -to when it exists")
+	fs.Parse(args)
+
+	l, err := zap.NewDevelopment()
+	checkIfErrorAndExit(err)
+	src, err := state.Open(*fromBackend, *from, l)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dst, err := state.Open(*toBackend, *to, l)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err := os.Stat(*to); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, pass -force to overwrite it\n", *to)
+		return 1
+	}
+
+	// Read fails on a corrupt source, where Load would move it aside.
+	if _, err := os.Stat(*from); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := src.Read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", *from, err)
+		return 1
+	}
+	if len(s.Connections) == 0 && len(s.Devices) == 0 && len(s.Rules) == 0 {
+		fmt.Fprintf(os.Stderr, "Nothing to migrate in %s\n", *from)
+		return 1
+	}
+	if err := dst.Save(s); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Migrated %d connections, %d devices and %d rules from %s to %s\n", len(s.Connections), len(s.Devices), len(s.Rules), *from, *to)
+	return 0
+}
+
+// runLookup prints the stored connections of an address or host name, and
+// the device of an address.
+func runLookup(args []string) int {
+	fs := flag.NewFlagSet("go-loader lookup", flag.ExitOnError)
+	path := fs.String("state-file", "data.json", "state file to read")
+	backend := fs.String("state-backend", state.BackendJSON, "backend of -state-file: json or bolt")
+	addr := fs.String("addr", "", "address to look up")
+	host := fs.String("host", "", "resolved host name to look up")
+	fs.Parse(args)
+
+	if (*addr == "") == (*host == "") {
+		fmt.Fprintln(os.Stderr, "pass one of -addr or -host")
+		return 1
+	}
+	l, err := zap.NewDevelopment()
+	checkIfErrorAndExit(err)
+	storage, err := state.Open(*backend, *path, l)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var out struct {
+		Device      *tracker.Device      `json:"device,omitempty"`
+		Connections []tracker.Connection `json:"connections"`
+	}
+	if *addr != "" {
+		d, ok, err := storage.Device(*addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
 		}
+		if ok {
+			out.Device = &d
+		}
+		out.Connections, err = storage.ByAddr(*addr)
+	} else {
+		out.Connections, err = storage.ByHost(*host)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if out.Connections == nil {
+		out.Connections = []tracker.Connection{}
 	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+	return 0
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dashboards":
+			os.Exit(runDashboards(os.Args[2:]))
+		case "webhook-echo":
+			os.Exit(runWebhookEcho(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "lookup":
+			os.Exit(runLookup(os.Args[2:]))
+		}
+	}
 	os.Exit(run())
 }
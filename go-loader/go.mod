@@ -4,7 +4,12 @@ go 1.23
 
 require (
 	github.com/aquasecurity/libbpfgo v0.7.0-libbpf-1.4
+	go.etcd.io/bbolt v1.3.11
 	go.uber.org/zap v1.27.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require go.uber.org/multierr v1.11.0 // indirect
+require (
+	go.uber.org/multierr v1.11.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -0,0 +1,409 @@
+package alert
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	"go.uber.org/zap"
+)
+
+// States of an alert.
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Alert is a rule firing for a host, or for a host and a peer with
+// new_peer. There is at most one alert per rule, host and peer at a time.
+type Alert struct {
+	Rule     string `json:"rule"`
+	Kind     string `json:"kind"`
+	Severity string `json:"severity,omitempty"`
+	Host     string `json:"host"`
+	Peer     string `json:"peer,omitempty"`
+	State    string `json:"state"`
+	// Value is what the rule measured last and Threshold what it is
+	// compared to.
+	Value     uint64     `json:"value,omitempty"`
+	Threshold uint64     `json:"threshold,omitempty"`
+	Summary   string     `json:"summary"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	Silenced  bool       `json:"silenced"`
+
+	// notified is when the sinks were last told the alert is firing.
+	notified time.Time
+}
+
+// Sink is told about alerts when they fire, are repeated and resolve. It is
+// called from the goroutine evaluating the rules and must not block.
+type Sink interface {
+	SendAlert(a Alert)
+}
+
+// LogSink logs alerts, it is the default sink.
+type LogSink struct {
+	L *zap.Logger
+}
+
+func (s LogSink) SendAlert(a Alert) {
+	if a.State == StateFiring {
+		s.L.Sugar().Warnf("Alert %s: %s", a.Rule, a.Summary)
+		return
+	}
+	s.L.Sugar().Infof("Alert %s resolved: %s", a.Rule, a.Summary)
+}
+
+type Options struct {
+	Rules    []Rule
+	Silences []Silence
+	// RepeatInterval sends alerts still firing to the sinks again after it,
+	// 0 sends them once.
+	RepeatInterval time.Duration
+	// KeepResolved is how long resolved alerts are still listed.
+	KeepResolved time.Duration
+	Sinks        []Sink
+}
+
+// Engine evaluates the rules on every sample of the tracker's flows, see
+// Evaluate.
+type Engine struct {
+	mu       sync.Mutex
+	opts     Options
+	rules    []*ruleState
+	silences []compiledSilence
+	// deltas are what the flows moved since the previous evaluation, what
+	// the rules work on.
+	deltas  tracker.Deltas
+	primed  bool
+	started time.Time
+	alerts  map[string]*Alert
+}
+
+type ruleState struct {
+	compiledRule
+	// Recent amounts per host, for rate.
+	samples map[string][]amountSample
+	// Start of the current period and the amounts per host, for quota.
+	period time.Time
+	used   map[string]uint64
+	// Peers seen per host, for new_peer.
+	peers map[string]map[string]struct{}
+}
+
+type amountSample struct {
+	time   time.Time
+	amount uint64
+}
+
+// flowDelta is what a flow moved between two evaluations, from src to dst.
+type flowDelta struct {
+	src, dst netip.Addr
+	stats    tracker.ConnectionStats
+}
+
+func NewEngine(opts Options) (*Engine, error) {
+	compiled, silences, err := compileAll(opts.Rules, opts.Silences)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		opts:     opts,
+		silences: silences,
+		started:  time.Now(),
+		alerts:   make(map[string]*Alert),
+	}
+	for _, c := range compiled {
+		e.rules = append(e.rules, &ruleState{
+			compiledRule: c,
+			samples:      make(map[string][]amountSample),
+			used:         make(map[string]uint64),
+			peers:        make(map[string]map[string]struct{}),
+		})
+	}
+	return e, nil
+}
+
+// Evaluate runs the rules on conns, the flows at now, and tells the sinks
+// about the alerts that changed. The first call only takes the counters
+// as a baseline.
+func (e *Engine) Evaluate(now time.Time, conns []tracker.Connection) {
+	e.mu.Lock()
+	if len(e.rules) == 0 {
+		e.mu.Unlock()
+		return
+	}
+
+	moved := e.deltas.Next(conns)
+	deltas := make([]flowDelta, 0, len(moved))
+	for _, d := range moved {
+		src, err1 := netip.ParseAddr(d.Saddr)
+		dst, err2 := netip.ParseAddr(d.Daddr)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		// A connection holds both directions, each is its own delta.
+		if d.Moved.TxPackets > 0 {
+			deltas = append(deltas, flowDelta{src: src, dst: dst, stats: d.Moved.Sent()})
+		}
+		if d.Moved.RxPackets > 0 {
+			deltas = append(deltas, flowDelta{src: dst, dst: src, stats: d.Moved.Received()})
+		}
+	}
+
+	if e.primed {
+		for _, r := range e.rules {
+			switch r.Kind {
+			case KindRate:
+				e.evaluateRate(now, r, deltas)
+			case KindQuota:
+				e.evaluateQuota(now, r, deltas)
+			}
+		}
+	}
+	for _, r := range e.rules {
+		if r.Kind == KindNewPeer {
+			e.evaluateNewPeer(now, r, deltas)
+		}
+	}
+	e.primed = true
+
+	notifications := e.notifications(now)
+	e.mu.Unlock()
+
+	for _, a := range notifications {
+		for _, s := range e.opts.Sinks {
+			s.SendAlert(a)
+		}
+	}
+}
+
+// amounts adds up what every host matched by r moved with the peers it
+// matches.
+func (r *ruleState) amounts(deltas []flowDelta) map[string]uint64 {
+	out := make(map[string]uint64)
+	for _, d := range deltas {
+		amount := d.stats.Bytes()
+		if r.Metric == "packets" {
+			amount = d.stats.Packets()
+		}
+		if amount == 0 {
+			continue
+		}
+		if r.Direction != DirectionReceived && r.matchHost(d.src) && r.matchPeer(d.dst) {
+			out[d.src.String()] += amount
+		}
+		if r.Direction != DirectionSent && r.matchHost(d.dst) && r.matchPeer(d.src) {
+			out[d.dst.String()] += amount
+		}
+	}
+	return out
+}
+
+func (e *Engine) evaluateRate(now time.Time, r *ruleState, deltas []flowDelta) {
+	for host, amount := range r.amounts(deltas) {
+		r.samples[host] = append(r.samples[host], amountSample{time: now, amount: amount})
+	}
+
+	cutoff := now.Add(-r.Window)
+	over := make(map[string]uint64)
+	for host, samples := range r.samples {
+		i := 0
+		for i < len(samples) && !samples[i].time.After(cutoff) {
+			i++
+		}
+		if samples = samples[i:]; len(samples) == 0 {
+			delete(r.samples, host)
+			continue
+		}
+		r.samples[host] = samples
+
+		var total uint64
+		for _, s := range samples {
+			total += s.amount
+		}
+		if total > uint64(r.Threshold) {
+			over[host] = total
+		}
+	}
+
+	for host, total := range over {
+		summary := fmt.Sprintf("%s %s %s in %s, over %s", host, r.verb(), r.format(total), r.Window, r.format(uint64(r.Threshold)))
+		e.fire(now, r, host, "", total, summary)
+	}
+	e.resolveRest(now, r, over)
+}
+
+func (e *Engine) evaluateQuota(now time.Time, r *ruleState, deltas []flowDelta) {
+	if start := r.periodStart(now); !start.Equal(r.period) {
+		r.period = start
+		clear(r.used)
+	}
+	for host, amount := range r.amounts(deltas) {
+		r.used[host] += amount
+	}
+
+	over := make(map[string]uint64)
+	for host, used := range r.used {
+		if used > uint64(r.Threshold) {
+			over[host] = used
+			summary := fmt.Sprintf("%s %s %s this %s, over its quota of %s", host, r.verb(), r.format(used), r.Period, r.format(uint64(r.Threshold)))
+			e.fire(now, r, host, "", used, summary)
+		}
+	}
+	e.resolveRest(now, r, over)
+}
+
+func (e *Engine) evaluateNewPeer(now time.Time, r *ruleState, deltas []flowDelta) {
+	learning := !e.primed || now.Before(e.started.Add(r.Learn))
+	see := func(host, peer netip.Addr) {
+		if !r.matchHost(host) || !r.matchPeer(peer) {
+			return
+		}
+		h, key := host.String(), r.peerKey(peer)
+		if r.peers[h] == nil {
+			r.peers[h] = make(map[string]struct{})
+		}
+		if _, ok := r.peers[h][key]; ok {
+			return
+		}
+		r.peers[h][key] = struct{}{}
+		if !learning {
+			e.fire(now, r, h, key, 0, fmt.Sprintf("%s talked to a new peer, %s", h, key))
+		}
+	}
+	for _, d := range deltas {
+		if r.Direction != DirectionReceived {
+			see(d.src, d.dst)
+		}
+		if r.Direction != DirectionSent {
+			see(d.dst, d.src)
+		}
+	}
+
+	for _, a := range e.alerts {
+		if a.Rule == r.Name && a.State == StateFiring && !now.Before(a.StartsAt.Add(r.Window)) {
+			e.resolve(now, a)
+		}
+	}
+}
+
+func (r *ruleState) verb() string {
+	switch r.Direction {
+	case DirectionSent:
+		return "sent"
+	case DirectionReceived:
+		return "received"
+	default:
+		return "moved"
+	}
+}
+
+func (r *ruleState) format(v uint64) string {
+	if r.Metric == "packets" {
+		return Amount(v).String() + " packets"
+	}
+	return Amount(v).String() + "B"
+}
+
+func fingerprint(rule, host, peer string) string {
+	return rule + "|" + host + "|" + peer
+}
+
+// fire creates the alert of r for host and peer, or updates it when it is
+// already firing.
+func (e *Engine) fire(now time.Time, r *ruleState, host, peer string, value uint64, summary string) {
+	key := fingerprint(r.Name, host, peer)
+	a, ok := e.alerts[key]
+	if !ok || a.State == StateResolved {
+		a = &Alert{
+			Rule:      r.Name,
+			Kind:      r.Kind,
+			Severity:  r.Severity,
+			Host:      host,
+			Peer:      peer,
+			State:     StateFiring,
+			Threshold: uint64(r.Threshold),
+			StartsAt:  now,
+		}
+		e.alerts[key] = a
+	}
+	a.Value = value
+	a.Summary = summary
+}
+
+// resolveRest resolves the alerts of r whose host is not in firing.
+func (e *Engine) resolveRest(now time.Time, r *ruleState, firing map[string]uint64) {
+	for _, a := range e.alerts {
+		if a.Rule != r.Name || a.State != StateFiring {
+			continue
+		}
+		if _, ok := firing[a.Host]; !ok {
+			e.resolve(now, a)
+		}
+	}
+}
+
+func (e *Engine) resolve(now time.Time, a *Alert) {
+	a.State = StateResolved
+	a.EndsAt = &now
+}
+
+// notifications updates the silences of the alerts and returns those the
+// sinks have to hear about. Resolved alerts are only sent when their firing
+// was.
+func (e *Engine) notifications(now time.Time) []Alert {
+	var out []Alert
+	for key, a := range e.alerts {
+		a.Silenced = slices.ContainsFunc(e.silences, func(s compiledSilence) bool { return s.matches(a, now) })
+
+		switch a.State {
+		case StateFiring:
+			if a.Silenced {
+				continue
+			}
+			repeat := e.opts.RepeatInterval > 0 && now.Sub(a.notified) >= e.opts.RepeatInterval
+			if a.notified.IsZero() || repeat {
+				a.notified = now
+				out = append(out, *a)
+			}
+		case StateResolved:
+			if !a.notified.IsZero() && !a.Silenced {
+				out = append(out, *a)
+			}
+			// Only sent once.
+			a.notified = time.Time{}
+			if now.Sub(*a.EndsAt) >= e.opts.KeepResolved {
+				delete(e.alerts, key)
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b Alert) int { return a.StartsAt.Compare(b.StartsAt) })
+	return out
+}
+
+// Alerts returns the firing alerts and the recently resolved ones, the
+// newest first. state filters them when it is not empty.
+func (e *Engine) Alerts(state string) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		if state == "" || a.State == state {
+			out = append(out, *a)
+		}
+	}
+	slices.SortFunc(out, func(a, b Alert) int {
+		if c := b.StartsAt.Compare(a.StartsAt); c != 0 {
+			return c
+		}
+		return strings.Compare(fingerprint(a.Rule, a.Host, a.Peer), fingerprint(b.Rule, b.Host, b.Peer))
+	})
+	return out
+}
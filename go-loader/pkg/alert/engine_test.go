@@ -0,0 +1,194 @@
+package alert
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+type recordingSink struct {
+	alerts []Alert
+}
+
+func (s *recordingSink) SendAlert(a Alert) {
+	s.alerts = append(s.alerts, a)
+}
+
+// take returns the states sent since the last call, as host:state.
+func (s *recordingSink) take() []string {
+	var out []string
+	for _, a := range s.alerts {
+		out = append(out, a.Host+":"+a.State)
+	}
+	s.alerts = nil
+	return out
+}
+
+func newTestEngine(t *testing.T, opts Options) (*Engine, *recordingSink) {
+	t.Helper()
+	sink := &recordingSink{}
+	opts.Sinks = []Sink{sink}
+	e, err := NewEngine(opts)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	return e, sink
+}
+
+// flow is a connection of the local host 192.168.1.10 with 1.1.1.1, with
+// the bytes it sent and got back so far.
+func flow(tx, rx uint64) []tracker.Connection {
+	return []tracker.Connection{{
+		Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4,
+		ConnectionStats: tracker.ConnectionStats{TxPackets: tx / 100, TxBytes: tx, RxPackets: rx / 100, RxBytes: rx},
+	}}
+}
+
+// A rate rule fires once what a host moved in its direction within the
+// window goes over the threshold, and resolves when it falls back under.
+func TestRate(t *testing.T) {
+	tests := []struct {
+		direction string
+		// tx and rx are the counters at each evaluation, a minute apart.
+		tx, rx []uint64
+		want   [][]string
+	}{
+		{DirectionSent, []uint64{0, 600, 1200, 1200}, []uint64{0, 0, 0, 0},
+			[][]string{nil, nil, {"192.168.1.10:firing"}, {"192.168.1.10:resolved"}}},
+		{DirectionSent, []uint64{0, 0, 0}, []uint64{0, 5000, 10000}, [][]string{nil, nil, nil}},
+		{DirectionReceived, []uint64{0, 5000, 10000}, []uint64{0, 600, 700}, [][]string{nil, nil, nil}},
+		{DirectionReceived, []uint64{0, 0, 0}, []uint64{0, 2000, 2000}, [][]string{nil, {"192.168.1.10:firing"}, nil}},
+		{DirectionBoth, []uint64{0, 600, 600}, []uint64{0, 600, 600}, [][]string{nil, {"192.168.1.10:firing"}, nil}},
+	}
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	for _, tt := range tests {
+		e, sink := newTestEngine(t, Options{Rules: []Rule{{
+			Name: "upload", Kind: KindRate, Direction: tt.direction, Threshold: 1000, Window: 90 * time.Second,
+		}}})
+		for i := range tt.tx {
+			e.Evaluate(start.Add(time.Duration(i)*time.Minute), flow(tt.tx[i], tt.rx[i]))
+			if got := sink.take(); !slices.Equal(got, tt.want[i]) {
+				t.Errorf("%s tx %v rx %v: evaluation %d sent %v, want %v", tt.direction, tt.tx, tt.rx, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// Firing alerts are sent again every repeat interval, or once without one.
+func TestRepeatInterval(t *testing.T) {
+	for _, tt := range []struct {
+		repeat time.Duration
+		want   int
+	}{{0, 1}, {10 * time.Minute, 3}} {
+		e, sink := newTestEngine(t, Options{
+			Rules:          []Rule{{Name: "quota", Kind: KindQuota, Threshold: 1000, Period: PeriodDay}},
+			RepeatInterval: tt.repeat,
+		})
+		start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+		e.Evaluate(start, flow(0, 0))
+		// Over the quota from the first minute, until 12:25.
+		for m := 1; m <= 25; m++ {
+			e.Evaluate(start.Add(time.Duration(m)*time.Minute), flow(2000, 0))
+		}
+		if got := len(sink.take()); got != tt.want {
+			t.Errorf("repeat interval %s: %d notifications, want %d", tt.repeat, got, tt.want)
+		}
+	}
+}
+
+// A quota adds up a whole period and resolves when the next one starts.
+func TestQuota(t *testing.T) {
+	e, sink := newTestEngine(t, Options{Rules: []Rule{{Name: "daily", Kind: KindQuota, Threshold: 1000, Period: PeriodDay}}})
+	day := time.Date(2026, 10, 18, 20, 0, 0, 0, time.Local)
+	steps := []struct {
+		at   time.Time
+		tx   uint64
+		want []string
+	}{
+		{day, 0, nil},
+		{day.Add(time.Hour), 600, nil},
+		{day.Add(2 * time.Hour), 1200, []string{"192.168.1.10:firing"}},
+		{day.Add(3 * time.Hour), 1300, nil},
+		{day.Add(5 * time.Hour), 1300, []string{"192.168.1.10:resolved"}},
+	}
+	for i, s := range steps {
+		e.Evaluate(s.at, flow(s.tx, 0))
+		if got := sink.take(); !slices.Equal(got, s.want) {
+			t.Errorf("step %d: sent %v, want %v", i, got, s.want)
+		}
+	}
+}
+
+func TestNewPeer(t *testing.T) {
+	e, sink := newTestEngine(t, Options{Rules: []Rule{{Name: "peers", Kind: KindNewPeer, Window: time.Minute}}})
+	now := time.Now()
+	e.Evaluate(now, flow(100, 100))
+	peer := flow(200, 200)
+	peer = append(peer, flow(100, 100)[0])
+	peer[1].Daddr = "8.8.8.8"
+	e.Evaluate(now.Add(time.Second), peer)
+	got := sink.alerts
+	if len(got) != 1 || got[0].Peer != "8.8.8.8" || got[0].State != StateFiring {
+		t.Fatalf("alerts = %+v, want one for peer 8.8.8.8", got)
+	}
+	sink.take()
+	e.Evaluate(now.Add(2*time.Minute), peer)
+	if got := sink.take(); !slices.Equal(got, []string{"192.168.1.10:resolved"}) {
+		t.Errorf("after the window sent %v, want it resolved", got)
+	}
+}
+
+// Silenced alerts are listed but not sent.
+func TestSilence(t *testing.T) {
+	e, sink := newTestEngine(t, Options{
+		Rules:    []Rule{{Name: "daily", Kind: KindQuota, Threshold: 1000, Period: PeriodDay}},
+		Silences: []Silence{{Rule: "daily", Hosts: []string{"192.168.1.0/24"}, Daily: "22:00-07:00"}},
+	})
+	night := time.Date(2026, 10, 18, 23, 0, 0, 0, time.Local)
+	e.Evaluate(night, flow(0, 0))
+	e.Evaluate(night.Add(time.Minute), flow(2000, 0))
+	if got := sink.take(); got != nil {
+		t.Errorf("silenced alert sent: %v", got)
+	}
+	if alerts := e.Alerts(StateFiring); len(alerts) != 1 || !alerts[0].Silenced {
+		t.Errorf("alerts = %+v, want one silenced", alerts)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := map[string]Amount{"1000": 1000, "10k": 10000, "5GB": 5e9, "1.5MiB": 1.5 * (1 << 20), "2 TiB": 2 << 40}
+	for v, want := range tests {
+		if got, err := ParseAmount(v); err != nil || got != want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "-1", "5X", "GB"} {
+		if _, err := ParseAmount(v); err == nil {
+			t.Errorf("ParseAmount(%q) accepted", v)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]Rule{
+		"no name":          {Kind: KindRate, Threshold: 1, Window: time.Minute},
+		"unknown kind":     {Name: "r", Kind: "spike"},
+		"rate no window":   {Name: "r", Kind: KindRate, Threshold: 1},
+		"quota no period":  {Name: "r", Kind: KindQuota, Threshold: 1},
+		"bad direction":    {Name: "r", Kind: KindRate, Threshold: 1, Window: time.Minute, Direction: "up"},
+		"bad metric":       {Name: "r", Kind: KindRate, Threshold: 1, Window: time.Minute, Metric: "flows"},
+		"bad hosts":        {Name: "r", Kind: KindNewPeer, Hosts: []string{"lan"}},
+		"peer prefix wide": {Name: "r", Kind: KindNewPeer, PeerPrefixV4: 33},
+	}
+	for name, r := range tests {
+		if err := Validate([]Rule{r}, nil); err == nil {
+			t.Errorf("%s: rule accepted", name)
+		}
+	}
+	if err := Validate(nil, []Silence{{Daily: "22:00"}}); err == nil {
+		t.Error("silence without an end of its daily window accepted")
+	}
+}
@@ -0,0 +1,407 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+// Kinds of rules.
+const (
+	// KindRate fires while a host moves more than Threshold within Window.
+	KindRate = "rate"
+	// KindQuota fires once a host moved more than Threshold in the current
+	// Period, and resolves when the next one starts.
+	KindQuota = "quota"
+	// KindNewPeer fires when a host talks to a peer it was not seen talking
+	// to before, once Learn is over. It stays firing for Window.
+	KindNewPeer = "new_peer"
+)
+
+// Directions of the traffic a rule counts, seen from the host.
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+	DirectionBoth     = "both"
+)
+
+// Peer classes, allowed in Rule.Peers next to CIDRs.
+const (
+	PeersInternet = "internet"
+	PeersLocal    = "local"
+)
+
+// Quota periods, they start at midnight local time.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// Rule is a declarative alert rule, evaluated per host.
+type Rule struct {
+	Name     string `yaml:"name" json:"name"`
+	Kind     string `yaml:"kind" json:"kind"`
+	Severity string `yaml:"severity" json:"severity,omitempty"`
+	// Metric is bytes or packets, bytes when empty.
+	Metric    string `yaml:"metric" json:"metric,omitempty"`
+	Direction string `yaml:"direction" json:"direction,omitempty"`
+	// Threshold accepts units, e.g. 5GB, 200MiB or 10k.
+	Threshold Amount        `yaml:"threshold" json:"threshold,omitempty"`
+	Window    time.Duration `yaml:"window" json:"window,omitempty"`
+	Period    string        `yaml:"period" json:"period,omitempty"`
+	// Hosts are the networks of the hosts evaluated, every local address
+	// when empty.
+	Hosts []string `yaml:"hosts" json:"hosts,omitempty"`
+	// Peers only counts the traffic with these networks, internet or local
+	// peers, every peer when empty.
+	Peers []string `yaml:"peers" json:"peers,omitempty"`
+	// Learn is how long new_peer only records peers, from startup.
+	Learn time.Duration `yaml:"learn" json:"learn,omitempty"`
+	// PeerPrefixV4 and PeerPrefixV6 group the peers of new_peer, e.g. 24
+	// only fires for the first address of every /24.
+	PeerPrefixV4 int `yaml:"peer_prefix_v4" json:"peer_prefix_v4,omitempty"`
+	PeerPrefixV6 int `yaml:"peer_prefix_v6" json:"peer_prefix_v6,omitempty"`
+}
+
+// Silence mutes the notifications of the alerts it matches, they are still
+// listed. Start and End bound it, Daily ("22:00-07:00") repeats it every day
+// within those bounds.
+type Silence struct {
+	// Rule is the rule silenced, every rule when empty.
+	Rule string `yaml:"rule" json:"rule,omitempty"`
+	// Hosts are networks or addresses, every host when empty.
+	Hosts []string   `yaml:"hosts" json:"hosts,omitempty"`
+	Start *time.Time `yaml:"start" json:"start,omitempty"`
+	End   *time.Time `yaml:"end" json:"end,omitempty"`
+	Daily string     `yaml:"daily" json:"daily,omitempty"`
+}
+
+// Defaults of the optional fields.
+const (
+	defaultNewPeerWindow = time.Hour
+	defaultPeerPrefixV4  = 32
+	defaultPeerPrefixV6  = 128
+)
+
+type compiledRule struct {
+	Rule
+	hosts   []netip.Prefix
+	peers   []netip.Prefix
+	classes []string
+}
+
+func (r Rule) compile() (compiledRule, error) {
+	c := compiledRule{Rule: r}
+	if r.Name == "" {
+		return c, errors.New("rule has no name")
+	}
+	fail := func(format string, args ...any) (compiledRule, error) {
+		return c, fmt.Errorf("rule %s: %s", r.Name, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Metric {
+	case "":
+		c.Metric = "bytes"
+	case "bytes", "packets":
+	default:
+		return fail("metric must be bytes or packets, got %q", r.Metric)
+	}
+	switch c.Direction {
+	case "":
+		c.Direction = DirectionBoth
+	case DirectionSent, DirectionReceived, DirectionBoth:
+	default:
+		return fail("direction must be sent, received or both, got %q", r.Direction)
+	}
+
+	switch r.Kind {
+	case KindRate:
+		if r.Threshold == 0 || r.Window <= 0 {
+			return fail("rate needs a threshold and a positive window")
+		}
+	case KindQuota:
+		if r.Threshold == 0 {
+			return fail("quota needs a threshold")
+		}
+		if r.Period != PeriodDay && r.Period != PeriodWeek && r.Period != PeriodMonth {
+			return fail("period must be day, week or month, got %q", r.Period)
+		}
+	case KindNewPeer:
+		if r.Window < 0 || r.Learn < 0 {
+			return fail("window and learn must not be negative")
+		}
+		if c.Window == 0 {
+			c.Window = defaultNewPeerWindow
+		}
+		if c.PeerPrefixV4 == 0 {
+			c.PeerPrefixV4 = defaultPeerPrefixV4
+		}
+		if c.PeerPrefixV6 == 0 {
+			c.PeerPrefixV6 = defaultPeerPrefixV6
+		}
+		if c.PeerPrefixV4 < 0 || c.PeerPrefixV4 > 32 || c.PeerPrefixV6 < 0 || c.PeerPrefixV6 > 128 {
+			return fail("peer_prefix_v4 must be within 0-32 and peer_prefix_v6 within 0-128")
+		}
+	default:
+		return fail("kind must be rate, quota or new_peer, got %q", r.Kind)
+	}
+
+	var err error
+	if c.hosts, err = parsePrefixes(r.Hosts); err != nil {
+		return fail("hosts: %v", err)
+	}
+	for _, p := range r.Peers {
+		if p == PeersInternet || p == PeersLocal {
+			c.classes = append(c.classes, p)
+			continue
+		}
+		prefixes, err := parsePrefixes([]string{p})
+		if err != nil {
+			return fail("peers: %v", err)
+		}
+		c.peers = append(c.peers, prefixes...)
+	}
+	return c, nil
+}
+
+// parsePrefixes takes networks and single addresses.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compiledRule) matchHost(addr netip.Addr) bool {
+	if len(c.hosts) == 0 {
+		return network.IsLocal(addr.String())
+	}
+	return containsAddr(c.hosts, addr)
+}
+
+func (c *compiledRule) matchPeer(addr netip.Addr) bool {
+	if len(c.peers) == 0 && len(c.classes) == 0 {
+		return true
+	}
+	if containsAddr(c.peers, addr) {
+		return true
+	}
+	local := network.IsLocal(addr.String())
+	for _, class := range c.classes {
+		if (class == PeersLocal) == local {
+			return true
+		}
+	}
+	return false
+}
+
+// peerKey groups peer with the other addresses of its peer prefix.
+func (c *compiledRule) peerKey(peer netip.Addr) string {
+	bits := c.PeerPrefixV6
+	if peer.Is4() {
+		bits = c.PeerPrefixV4
+	}
+	p, _ := peer.Prefix(bits)
+	if bits == peer.BitLen() {
+		return peer.String()
+	}
+	return p.String()
+}
+
+// periodStart returns the start of the quota period now is in.
+func (c *compiledRule) periodStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	switch c.Period {
+	case PeriodWeek:
+		// Weeks start on Monday.
+		offset := (int(now.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, now.Location())
+	case PeriodMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, now.Location())
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+}
+
+// Validate checks rules and silences the way NewEngine does.
+func Validate(rules []Rule, silences []Silence) error {
+	_, _, err := compileAll(rules, silences)
+	return err
+}
+
+func compileAll(rules []Rule, silences []Silence) ([]compiledRule, []compiledSilence, error) {
+	var errs []error
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, r := range rules {
+		c, err := r.compile()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, o := range rules[:i] {
+			if o.Name == r.Name {
+				errs = append(errs, fmt.Errorf("rule %s: name is used twice", r.Name))
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	var cs []compiledSilence
+	for i, s := range silences {
+		c, err := s.compile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("silence %d: %w", i, err))
+			continue
+		}
+		cs = append(cs, c)
+	}
+	return compiled, cs, errors.Join(errs...)
+}
+
+type compiledSilence struct {
+	Silence
+	hosts []netip.Prefix
+	// from and to are minutes after midnight of the daily window, to can be
+	// before from when it spans midnight.
+	daily    bool
+	from, to int
+}
+
+func (s Silence) compile() (compiledSilence, error) {
+	c := compiledSilence{Silence: s}
+	var err error
+	if c.hosts, err = parsePrefixes(s.Hosts); err != nil {
+		return c, fmt.Errorf("hosts: %w", err)
+	}
+	if s.Start != nil && s.End != nil && !s.End.After(*s.Start) {
+		return c, errors.New("end must be after start")
+	}
+	if s.Daily != "" {
+		from, to, ok := strings.Cut(s.Daily, "-")
+		if !ok {
+			return c, fmt.Errorf("daily must look like 22:00-07:00, got %q", s.Daily)
+		}
+		if c.from, err = parseClock(from); err != nil {
+			return c, fmt.Errorf("daily: %w", err)
+		}
+		if c.to, err = parseClock(to); err != nil {
+			return c, fmt.Errorf("daily: %w", err)
+		}
+		c.daily = true
+	}
+	return c, nil
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (s *compiledSilence) matches(a *Alert, now time.Time) bool {
+	if s.Rule != "" && s.Rule != a.Rule {
+		return false
+	}
+	if len(s.hosts) > 0 {
+		addr, err := netip.ParseAddr(a.Host)
+		if err != nil || !containsAddr(s.hosts, addr) {
+			return false
+		}
+	}
+	if s.Start != nil && now.Before(*s.Start) {
+		return false
+	}
+	if s.End != nil && !now.Before(*s.End) {
+		return false
+	}
+	if !s.daily {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if s.from <= s.to {
+		return minute >= s.from && minute < s.to
+	}
+	return minute >= s.from || minute < s.to
+}
+
+// Amount is a count of bytes or packets. In config files it takes SI (k, M,
+// G, T) and binary (Ki, Mi, Gi, Ti) prefixes, optionally followed by B.
+type Amount uint64
+
+// ParseAmount parses values like 5GB, 1.5MiB, 10k or 1000.
+func ParseAmount(v string) (Amount, error) {
+	v = strings.TrimSpace(v)
+	i := strings.IndexFunc(v, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if i < 0 {
+		i = len(v)
+	}
+	n, err := strconv.ParseFloat(v[:i], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	unit := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v[i:])), "b")
+	multipliers := map[string]float64{
+		"": 1, "k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12,
+		"ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30, "ti": 1 << 40,
+	}
+	mult, ok := multipliers[unit]
+	if !ok || n*mult > math.MaxUint64 {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	return Amount(n * mult), nil
+}
+
+func (a *Amount) UnmarshalText(text []byte) error {
+	v, err := ParseAmount(string(text))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// String formats a with an SI prefix, e.g. 5.0G.
+func (a Amount) String() string {
+	v := float64(a)
+	for _, prefix := range []string{"", "k", "M", "G", "T"} {
+		if v < 1000 || prefix == "T" {
+			if prefix == "" {
+				return strconv.FormatUint(uint64(a), 10)
+			}
+			return strconv.FormatFloat(v, 'f', 1, 64) + prefix
+		}
+		v /= 1000
+	}
+	return ""
+}
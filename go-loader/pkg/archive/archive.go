@@ -0,0 +1,128 @@
+// Package archive keeps the final records of the expired flows as JSON
+// lines, one flow per line.
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+// rotatedTime sorts the rotated files by when they were rotated.
+const rotatedTime = "20060102T150405.000"
+
+type Options struct {
+	// Path is the file records are appended to. Rotated files are named
+	// after it with the time they were rotated at, flows.jsonl becomes
+	// flows-20261018T101500.000.jsonl.
+	Path string
+	// MaxSize rotates the file before it grows past that many bytes.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept, 0 keeps them all.
+	MaxFiles int
+}
+
+// Archive is a tracker.ExpiryHook appending every expired flow to a
+// rotating file.
+type Archive struct {
+	mu   sync.Mutex
+	opts Options
+	f    *os.File
+	size int64
+}
+
+func Open(opts Options) (*Archive, error) {
+	a := &Archive{opts: opts}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archive) open() error {
+	f, err := os.OpenFile(a.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+func (a *Archive) OnExpire(flow tracker.ExpiredFlow) error {
+	line, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return os.ErrClosed
+	}
+	if a.opts.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.opts.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside, starts a new one and deletes the
+// rotated files past MaxFiles.
+func (a *Archive) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	a.f = nil
+	ext := filepath.Ext(a.opts.Path)
+	base := strings.TrimSuffix(a.opts.Path, ext)
+	rotated := base + "-" + time.Now().Format(rotatedTime) + ext
+	if err := os.Rename(a.opts.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate the flow archive: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if a.opts.MaxFiles <= 0 {
+		return nil
+	}
+
+	old, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	sort.Strings(old)
+	for len(old) > a.opts.MaxFiles {
+		if err := os.Remove(old[0]); err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+func expired(sport uint16) tracker.ExpiredFlow {
+	return tracker.ExpiredFlow{
+		Connection: tracker.Connection{
+			Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: sport, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4,
+			ConnectionStats: tracker.ConnectionStats{TxPackets: 3, TxBytes: 180, RxPackets: 2, RxBytes: 3000},
+		},
+		Reason:    tracker.ExpiredInactive,
+		ExpiredAt: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// readPorts returns the source ports of the flows archived in path.
+func readPorts(t *testing.T, path string) []uint16 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ports []uint16
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var flow tracker.ExpiredFlow
+		if err := json.Unmarshal(lines.Bytes(), &flow); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		ports = append(ports, flow.Sport)
+	}
+	return ports
+}
+
+func lineSize(t *testing.T) int64 {
+	t.Helper()
+	line, err := json.Marshal(expired(40000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line)) + 1
+}
+
+// Records go to the current file until the next one would push it past
+// MaxSize, and only the newest MaxFiles rotated files are kept.
+func TestRotate(t *testing.T) {
+	for _, tt := range []struct {
+		maxFiles  int
+		wantFiles int
+	}{{0, 4}, {2, 2}} {
+		path := filepath.Join(t.TempDir(), "flows.jsonl")
+		a, err := Open(Options{Path: path, MaxSize: 2 * lineSize(t), MaxFiles: tt.maxFiles})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		for port := uint16(40000); port < 40009; port++ {
+			// Rotated files are named after the millisecond they were
+			// rotated at.
+			time.Sleep(2 * time.Millisecond)
+			if err := a.OnExpire(expired(port)); err != nil {
+				t.Fatalf("OnExpire: %v", err)
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		if got := readPorts(t, path); !slices.Equal(got, []uint16{40008}) {
+			t.Errorf("max files %d: current file has %v, want the last flow", tt.maxFiles, got)
+		}
+		rotated, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "flows-*.jsonl"))
+		if len(rotated) != tt.wantFiles {
+			t.Fatalf("max files %d: %d rotated files, want %d", tt.maxFiles, len(rotated), tt.wantFiles)
+		}
+		// The files kept are the newest ones, two records each.
+		next := uint16(40008 - 2*tt.wantFiles)
+		for _, name := range rotated {
+			if got, want := readPorts(t, name), []uint16{next, next + 1}; !slices.Equal(got, want) {
+				t.Errorf("max files %d: %s has %v, want %v", tt.maxFiles, filepath.Base(name), got, want)
+			}
+			next += 2
+		}
+	}
+}
+
+// A reopened archive appends to the current file and counts what is
+// already there towards MaxSize.
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	opts := Options{Path: path, MaxSize: 2 * lineSize(t)}
+	for _, port := range []uint16{40000, 40001, 40002} {
+		a, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		if err := a.OnExpire(expired(port)); err != nil {
+			t.Fatalf("OnExpire: %v", err)
+		}
+		a.Close()
+	}
+	if got := readPorts(t, path); !slices.Equal(got, []uint16{40002}) {
+		t.Errorf("current file has %v, want the flow after the rotation", got)
+	}
+	if err := (&Archive{opts: opts}).OnExpire(expired(40003)); err != os.ErrClosed {
+		t.Errorf("writing to a closed archive returned %v", err)
+	}
+}
+
+// A record bigger than MaxSize still goes to a file of its own.
+func TestOversizedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.jsonl")
+	a, err := Open(Options{Path: path, MaxSize: 10})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer a.Close()
+	for _, port := range []uint16{40000, 40001} {
+		time.Sleep(2 * time.Millisecond)
+		if err := a.OnExpire(expired(port)); err != nil {
+			t.Fatalf("OnExpire: %v", err)
+		}
+	}
+	if got := readPorts(t, path); !slices.Equal(got, []uint16{40001}) {
+		t.Errorf("current file has %v, want only the last flow", got)
+	}
+}
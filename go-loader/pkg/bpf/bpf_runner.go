@@ -1,37 +1,150 @@
 package probeRunnerdo_unlinkat
 
 import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
 	bpf "github.com/aquasecurity/libbpfgo"
+	"go.uber.org/zap"
 )
 
+var _ kernelmap.KernelMap = (*bpf.BPFMap)(nil)
+
 type probeType int
 
-const  (
+const (
 	KPROBE probeType = iota
 	XDP
+	TC_INGRESS
+	TC_EGRESS
 )
 
+func (t probeType) String() string {
+	switch t {
+	case KPROBE:
+		return "kprobe"
+	case XDP:
+		return "xdp"
+	case TC_INGRESS:
+		return "tc-ingress"
+	case TC_EGRESS:
+		return "tc-egress"
+	default:
+		return fmt.Sprintf("probeType(%d)", int(t))
+	}
+}
+
+func (t probeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Attachment is a program attached by the runner. Name identifies it for
+// Detach.
+type Attachment struct {
+	Name    string    `json:"name"`
+	Program string    `json:"program"`
+	Target  string    `json:"target"`
+	Type    probeType `json:"type"`
+	// XDPMode is the mode the kernel reports for XDP attachments.
+	XDPMode XDPMode `json:"xdp_mode,omitempty"`
+	// PinPath is where the link is pinned, see PinOptions.Links.
+	PinPath string `json:"pin_path,omitempty"`
+}
+
+type attachment struct {
+	Attachment
+	// link is set for kprobes, destroying it detaches the program.
+	link *bpf.BPFLink
+	// xdpLinkFd is the XDP link, closing it detaches the program.
+	xdpLinkFd int
+	// TC filters live in the interface's clsact qdisc, not in a link owned
+	// by the process, so they have to be detached explicitly.
+	tcHook *bpf.TcHook
+	tcOpts bpf.TcOpts
+	// keep leaves the program attached on Close, for the next run to take
+	// over.
+	keep bool
+}
+
+func (a *attachment) detach() error {
+	if a.PinPath != "" {
+		if err := unpin(a.PinPath); err != nil {
+			return err
+		}
+	}
+	if a.tcHook != nil {
+		// Detach wants the filter identified by handle and priority only.
+		opts := bpf.TcOpts{Handle: a.tcOpts.Handle, Priority: a.tcOpts.Priority}
+		return a.tcHook.Detach(&opts)
+	}
+	if a.Type == XDP {
+		return syscall.Close(a.xdpLinkFd)
+	}
+	return a.link.Destroy()
+}
+
+// release lets go of a kept attachment without detaching it.
+func (a *attachment) release() error {
+	if a.Type == XDP {
+		return syscall.Close(a.xdpLinkFd)
+	}
+	return nil
+}
+
 type bpfModuleRunner struct {
 	module *bpf.Module
 	probes map[string]*bpf.BPFProg
+	pins   PinOptions
+	// reused are the pinned maps found from a previous run.
+	reused map[string]bool
+
+	mu sync.Mutex
+	// attachments is kept in attach order, DetachAll walks it backwards.
+	attachments []*attachment
+
+	l *zap.Logger
+}
+
+func attachmentName(programName, target string) string {
+	return programName + "@" + target
 }
 
-func NewRunner(bpfElfPath string) (*bpfModuleRunner, error) {
+func NewRunner(bpfElfPath string, pins PinOptions, l *zap.Logger) (*bpfModuleRunner, error) {
 	bpfModule, err := bpf.NewModuleFromFile(bpfElfPath)
 	if err != nil {
 		return nil, err
 	}
+	reused, err := pinMaps(bpfModule, pins)
+	if err != nil {
+		return nil, err
+	}
 	err = bpfModule.BPFLoadObject()
 	if err != nil {
+		if len(reused) > 0 {
+			return nil, fmt.Errorf("%w, the maps pinned in %s may be from an incompatible version", err, pins.Dir)
+		}
 		return nil, err
 	}
 
 	return &bpfModuleRunner{
 		module: bpfModule,
 		probes: make(map[string]*bpf.BPFProg),
+		pins:   pins,
+		reused: reused,
+		l:      l,
 	}, nil
 }
 
+// Reused reports whether mapName was pinned by a previous run and still holds
+// its counters.
+func (b *bpfModuleRunner) Reused(mapName string) bool {
+	return b.reused[mapName]
+}
+
 func (b *bpfModuleRunner) LoadProgram(programName string) error {
 	prog, err := b.module.GetProgram(programName)
 	if err != nil {
@@ -41,23 +154,154 @@ func (b *bpfModuleRunner) LoadProgram(programName string) error {
 	return nil
 }
 
-func (b *bpfModuleRunner) AttachProbe(programName, attachment string, probeType probeType) error {
+// AttachProbe attaches a loaded program to a kernel function (KPROBE) or an
+// interface. The same program can be attached to several targets, each one
+// is tracked until Detach. XDP programs are attached in the kernel's default
+// mode, see AttachXDP to pick one.
+func (b *bpfModuleRunner) AttachProbe(programName, target string, probeType probeType) error {
+	_, err := b.attach(programName, target, probeType, nil)
+	return err
+}
+
+// AttachXDP attaches an XDP program to iface in the first of modes the
+// interface accepts, and returns the mode the kernel reports.
+func (b *bpfModuleRunner) AttachXDP(programName, iface string, modes ...XDPMode) (XDPMode, error) {
+	a, err := b.attach(programName, iface, XDP, modes)
+	if err != nil {
+		return 0, err
+	}
+	return a.XDPMode, nil
+}
+
+func (b *bpfModuleRunner) attach(programName, target string, probeType probeType, xdpModes []XDPMode) (*attachment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := attachmentName(programName, target)
+	if b.find(name) >= 0 {
+		return nil, fmt.Errorf("%s is already attached", name)
+	}
+	prog, ok := b.probes[programName]
+	if !ok {
+		return nil, fmt.Errorf("program %s is not loaded", programName)
+	}
+
+	a := &attachment{Attachment: Attachment{Name: name, Program: programName, Target: target, Type: probeType}}
+	var err error
 	switch probeType {
 	case KPROBE:
-		_, err := b.probes[programName].AttachKprobe(attachment)
-		if err != nil {
-			return err
-		}
+		a.link, err = prog.AttachKprobe(target)
 	case XDP:
-		_, err := b.probes[programName].AttachXDP(attachment)
-		if err != nil {
-			return err
+		a.PinPath = b.linkPinPath(programName, target)
+		a.keep = a.PinPath != ""
+		a.xdpLinkFd, a.XDPMode, err = b.attachXDP(prog, target, xdpModes, a.PinPath)
+	case TC_INGRESS:
+		a.keep = b.pins.Links
+		a.tcHook, a.tcOpts, err = b.attachTc(prog, target, bpf.BPFTcIngress)
+	case TC_EGRESS:
+		a.keep = b.pins.Links
+		a.tcHook, a.tcOpts, err = b.attachTc(prog, target, bpf.BPFTcEgress)
+	default:
+		err = fmt.Errorf("unknown probe type %s", probeType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach %s as %s: %w", name, probeType, err)
+	}
+
+	b.attachments = append(b.attachments, a)
+	return a, nil
+}
+
+func (b *bpfModuleRunner) attachTc(prog *bpf.BPFProg, iface string, point bpf.TcAttachPoint) (*bpf.TcHook, bpf.TcOpts, error) {
+	hook := b.module.TcHookInit()
+	if err := hook.SetInterfaceByName(iface); err != nil {
+		return nil, bpf.TcOpts{}, err
+	}
+	hook.SetAttachPoint(point)
+	// The clsact qdisc is shared by ingress and egress and may have been
+	// created by someone else.
+	if err := hook.Create(); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return nil, bpf.TcOpts{}, err
+	}
+
+	opts := bpf.TcOpts{ProgFd: prog.FileDescriptor(), Handle: 1, Priority: 1}
+	if b.pins.Links {
+		// The filter left by the previous run is swapped in place.
+		opts.Flags = bpf.BpfTcFReplace
+	}
+	if err := hook.Attach(&opts); err != nil {
+		return nil, bpf.TcOpts{}, err
+	}
+	return hook, opts, nil
+}
+
+func (b *bpfModuleRunner) find(name string) int {
+	for i, a := range b.attachments {
+		if a.Name == name {
+			return i
 		}
 	}
+	return -1
+}
 
+// Detach detaches the attachment called name, as returned by List.
+func (b *bpfModuleRunner) Detach(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := b.find(name)
+	if i < 0 {
+		return fmt.Errorf("%s is not attached", name)
+	}
+	if err := b.attachments[i].detach(); err != nil {
+		return fmt.Errorf("failed to detach %s: %w", name, err)
+	}
+	b.attachments = slices.Delete(b.attachments, i, i+1)
 	return nil
 }
 
+// DetachAll detaches everything in the reverse order it was attached. It
+// keeps going past failures so one bad target doesn't leave the others
+// attached, the attachments that failed stay listed.
+func (b *bpfModuleRunner) DetachAll() error {
+	return b.detachAll(false)
+}
+
+// detachAll releases the kept attachments instead of detaching them when
+// keep is set.
+func (b *bpfModuleRunner) detachAll(keep bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var errs []error
+	var failed []*attachment
+	for i := len(b.attachments) - 1; i >= 0; i-- {
+		a := b.attachments[i]
+		detach := a.detach
+		if keep && a.keep {
+			detach = a.release
+		}
+		if err := detach(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to detach %s: %w", a.Name, err))
+			failed = append([]*attachment{a}, failed...)
+		}
+	}
+	b.attachments = failed
+	return errors.Join(errs...)
+}
+
+// List returns the current attachments in attach order.
+func (b *bpfModuleRunner) List() []Attachment {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]Attachment, len(b.attachments))
+	for i, a := range b.attachments {
+		out[i] = a.Attachment
+	}
+	return out
+}
+
 func (b *bpfModuleRunner) AttachRingBuffer(ringBufferName string) (chan []byte, *bpf.RingBuffer, error) {
 	eventsChannel := make(chan []byte)
 	rb, err := b.module.InitRingBuf(ringBufferName, eventsChannel)
@@ -76,6 +320,11 @@ func (b *bpfModuleRunner) GetMap(mapName string) (*bpf.BPFMap, error) {
 	return bpfMap, nil
 }
 
-func (b *bpfModuleRunner) Close() {
+// Close detaches everything before closing the module, which also closes the
+// ring buffers and maps. Pinned links, and the TC filters that go with them,
+// are left attached for the next run.
+func (b *bpfModuleRunner) Close() error {
+	err := b.detachAll(true)
 	b.module.Close()
-}
\ No newline at end of file
+	return err
+}
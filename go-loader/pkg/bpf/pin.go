@@ -0,0 +1,118 @@
+package probeRunnerdo_unlinkat
+
+/*
+#include <stdlib.h>
+#include <bpf/bpf.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// BPF_FS_MAGIC from linux/magic.h.
+const bpfFsMagic = 0xcafe4a11
+
+// PinOptions pins objects to bpffs under Dir so they outlive the process.
+// Maps already pinned there by a previous run are reused as they are. Links
+// pins the XDP links, a pinned link is kept attached by Close and handed the
+// new program on the next run, and the TC filters are kept and replaced with
+// it.
+type PinOptions struct {
+	Dir   string
+	Maps  []string
+	Links bool
+}
+
+// pinMaps points the maps at their pin paths before the object is loaded,
+// libbpf then reuses the existing pins and pins the maps it creates. It
+// returns the maps that were already pinned.
+func pinMaps(module *bpf.Module, pins PinOptions) (map[string]bool, error) {
+	reused := make(map[string]bool)
+	if len(pins.Maps) == 0 {
+		return reused, nil
+	}
+	if err := checkBpfFs(pins.Dir); err != nil {
+		return nil, err
+	}
+
+	for _, name := range pins.Maps {
+		m, err := module.GetMap(name)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(pins.Dir, name)
+		if _, err := os.Stat(path); err == nil {
+			reused[name] = true
+		}
+		if err := m.SetPinPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return reused, nil
+}
+
+// checkBpfFs creates dir if needed and makes sure it is on bpffs, pinning
+// anywhere else fails with an unhelpful EPERM.
+func checkBpfFs(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create pin directory: %w", err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if st.Type != bpfFsMagic {
+		return fmt.Errorf("%s is not on a bpffs mount, is /sys/fs/bpf mounted?", dir)
+	}
+	return nil
+}
+
+func (b *bpfModuleRunner) linkPinPath(programName, iface string) string {
+	if !b.pins.Links {
+		return ""
+	}
+	return filepath.Join(b.pins.Dir, "link_"+programName+"_"+iface)
+}
+
+func pinFd(fd int, path string) error {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	if ret := C.bpf_obj_pin(C.int(fd), pathC); ret < 0 {
+		return fmt.Errorf("failed to pin to %s: %w", path, syscall.Errno(-ret))
+	}
+	return nil
+}
+
+// updatePinnedLink opens the link pinned at path and swaps its program for
+// progFd, the link stays attached throughout so no packet goes uncounted.
+func updatePinnedLink(path string, progFd int) (int, error) {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	fd := C.bpf_obj_get(pathC)
+	if fd < 0 {
+		return -1, syscall.Errno(-fd)
+	}
+	if ret := C.bpf_link_update(fd, C.int(progFd), nil); ret < 0 {
+		syscall.Close(int(fd))
+		return -1, syscall.Errno(-ret)
+	}
+	return int(fd), nil
+}
+
+// unpin removes a pin, a missing one is not an error.
+func unpin(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
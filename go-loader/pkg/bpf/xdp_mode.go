@@ -0,0 +1,176 @@
+package probeRunnerdo_unlinkat
+
+/*
+#include <errno.h>
+#include <bpf/bpf.h>
+#include <bpf/libbpf.h>
+#include <linux/if_link.h>
+
+// The vendored libbpfgo only attaches XDP with the kernel's default mode and
+// has no link info API, so go through libbpf directly.
+static int hnt_xdp_link_create(int prog_fd, int ifindex, __u32 flags) {
+    LIBBPF_OPTS(bpf_link_create_opts, opts, .flags = flags);
+    return bpf_link_create(prog_fd, ifindex, BPF_XDP, &opts);
+}
+
+static int hnt_xdp_attach_mode(int ifindex) {
+    LIBBPF_OPTS(bpf_xdp_query_opts, opts);
+    int err = bpf_xdp_query(ifindex, 0, &opts);
+    if (err < 0) {
+        return err;
+    }
+    return opts.attach_mode;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+type XDPMode int
+
+const (
+	// XDPModeDefault lets the kernel pick, native when the driver supports
+	// it and generic otherwise.
+	XDPModeDefault XDPMode = iota
+	XDPModeNative
+	XDPModeGeneric
+	XDPModeOffload
+)
+
+func (m XDPMode) String() string {
+	switch m {
+	case XDPModeDefault:
+		return "default"
+	case XDPModeNative:
+		return "native"
+	case XDPModeGeneric:
+		return "generic"
+	case XDPModeOffload:
+		return "offload"
+	default:
+		return fmt.Sprintf("XDPMode(%d)", int(m))
+	}
+}
+
+func (m XDPMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m XDPMode) flags() C.__u32 {
+	switch m {
+	case XDPModeNative:
+		return C.XDP_FLAGS_DRV_MODE
+	case XDPModeGeneric:
+		return C.XDP_FLAGS_SKB_MODE
+	case XDPModeOffload:
+		return C.XDP_FLAGS_HW_MODE
+	default:
+		return 0
+	}
+}
+
+// ParseXDPMode accepts the mode names and the kernel's aliases (driver, skb,
+// hw).
+func ParseXDPMode(s string) (XDPMode, error) {
+	switch strings.ToLower(s) {
+	case "default", "":
+		return XDPModeDefault, nil
+	case "native", "driver", "drv":
+		return XDPModeNative, nil
+	case "generic", "skb":
+		return XDPModeGeneric, nil
+	case "offload", "hw":
+		return XDPModeOffload, nil
+	default:
+		return 0, fmt.Errorf("unknown XDP mode %q", s)
+	}
+}
+
+// attachedXDPMode asks the kernel which mode the program on ifindex runs in.
+func attachedXDPMode(ifindex int) (XDPMode, error) {
+	ret := C.hnt_xdp_attach_mode(C.int(ifindex))
+	if ret < 0 {
+		return 0, syscall.Errno(-ret)
+	}
+	switch ret {
+	case C.XDP_ATTACHED_DRV:
+		return XDPModeNative, nil
+	case C.XDP_ATTACHED_SKB:
+		return XDPModeGeneric, nil
+	case C.XDP_ATTACHED_HW:
+		return XDPModeOffload, nil
+	case C.XDP_ATTACHED_NONE:
+		return 0, errors.New("no XDP program attached")
+	default:
+		// XDP_ATTACHED_MULTI, several programs in different modes.
+		return 0, fmt.Errorf("ambiguous XDP attach mode %d", int(ret))
+	}
+}
+
+// attachXDP tries modes in order and returns the link fd of the first that
+// works along with the mode the kernel reports. Every rejected mode is logged
+// with its reason. With a pinPath the link pinned there by a previous run is
+// reused, and a new link is pinned there.
+func (b *bpfModuleRunner) attachXDP(prog *bpf.BPFProg, iface string, modes []XDPMode, pinPath string) (int, XDPMode, error) {
+	netIface, err := net.InterfaceByName(iface)
+	if err != nil {
+		return -1, 0, err
+	}
+	if len(modes) == 0 {
+		modes = []XDPMode{XDPModeDefault}
+	}
+
+	if pinPath != "" {
+		fd, err := updatePinnedLink(pinPath, prog.FileDescriptor())
+		switch {
+		case err == nil:
+			b.l.Sugar().Infof("Reusing the XDP link pinned at %s", pinPath)
+			return fd, b.attachedMode(netIface, modes[0]), nil
+		case !errors.Is(err, os.ErrNotExist):
+			b.l.Sugar().Warnf("Could not reuse the XDP link pinned at %s, attaching again: %v", pinPath, err)
+			if err := unpin(pinPath); err != nil {
+				return -1, 0, err
+			}
+		}
+	}
+
+	var errs []error
+	for _, mode := range modes {
+		fd := C.hnt_xdp_link_create(C.int(prog.FileDescriptor()), C.int(netIface.Index), mode.flags())
+		if fd < 0 {
+			err := syscall.Errno(-fd)
+			b.l.Sugar().Warnf("Attaching %s to %s in %s mode failed: %v", prog.Name(), iface, mode, err)
+			errs = append(errs, fmt.Errorf("%s mode: %w", mode, err))
+			continue
+		}
+
+		if pinPath != "" {
+			if err := pinFd(int(fd), pinPath); err != nil {
+				syscall.Close(int(fd))
+				return -1, 0, err
+			}
+		}
+		return int(fd), b.attachedMode(netIface, mode), nil
+	}
+	return -1, 0, fmt.Errorf("no XDP mode worked: %w", errors.Join(errs...))
+}
+
+// attachedMode is the mode the kernel reports for iface, or requested when it
+// can't tell.
+func (b *bpfModuleRunner) attachedMode(iface *net.Interface, requested XDPMode) XDPMode {
+	actual, err := attachedXDPMode(iface.Index)
+	if err != nil {
+		b.l.Sugar().Warnf("Could not query the XDP mode of %s, assuming %s: %v", iface.Name, requested, err)
+		return requested
+	}
+	return actual
+}
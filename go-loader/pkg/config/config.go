@@ -0,0 +1,779 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "HNT_"
+
+// XDP modes, they mirror probeRunner.ParseXDPMode.
+var xdpModes = []string{"default", "native", "driver", "drv", "generic", "skb", "offload", "hw"}
+
+// Labels /metrics can export, they mirror output.FlowLabels and
+// output.HostLabels.
+var (
+	metricsFlowLabels = []string{"saddr", "daddr", "sport", "dport", "proto", "shost", "dhost", "family", "interface", "direction"}
+	metricsHostLabels = []string{"addr", "host", "family", "interface", "direction"}
+)
+
+// Webhook events, they mirror the notify.Event* types.
+var notifyEvents = []string{"new_flow", "new_host", "flow_expired", "blocked", "alert"}
+
+// Alert sinks.
+var alertSinks = []string{"log", "webhooks"}
+
+// stateBackends mirror the backends of state.Open.
+var stateBackends = []string{"json", "bolt"}
+
+// webhookName keeps webhook names usable as directory names.
+var webhookName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type HTTPConfig struct {
+	Addr string `yaml:"addr"`
+	Port int    `yaml:"port"`
+	// APIToken is the bearer token /api/v1/rules requires, it is disabled
+	// when it is empty. The read-only /api/v1 endpoints are open.
+	APIToken string `yaml:"api_token"`
+}
+
+type MetricsConfig struct {
+	TopN            int      `yaml:"top_n"`
+	AggregateByHost bool     `yaml:"aggregate_by_host"`
+	Labels          []string `yaml:"labels"`
+}
+
+// GrafanaConfig sizes the in-memory history behind the JSON datasource API.
+type GrafanaConfig struct {
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
+
+// ResolverConfig controls the reverse DNS lookups of the tracked addresses.
+type ResolverConfig struct {
+	// Server is a host:port, empty uses the system resolver.
+	Server      string        `yaml:"server"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Workers     int           `yaml:"workers"`
+	TTL         time.Duration `yaml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+// PinConfig pins BPF objects to bpffs so the kernel keeps counting while the
+// daemon restarts.
+type PinConfig struct {
+	// Maps pins the connection tracker maps, they are reused on startup
+	// instead of seeding them from the state file.
+	Maps bool `yaml:"maps"`
+	// Links also pins the XDP links and leaves them, and the TC filters,
+	// attached on shutdown.
+	Links bool   `yaml:"links"`
+	Path  string `yaml:"path"`
+}
+
+// NotifyConfig sends tracker events to webhooks.
+type NotifyConfig struct {
+	// QueueDir keeps the events not delivered yet, so they survive a
+	// restart.
+	QueueDir string `yaml:"queue_dir"`
+	// MaxQueue bounds the events queued per webhook, the oldest are dropped.
+	MaxQueue int `yaml:"max_queue"`
+	// BlockedInterval is how often the drop counters are checked for blocked
+	// events.
+	BlockedInterval time.Duration   `yaml:"blocked_interval"`
+	Webhooks        []WebhookConfig `yaml:"webhooks"`
+}
+
+// WebhookConfig mirrors notify.Endpoint, the optional fields get their
+// defaults there.
+type WebhookConfig struct {
+	Name        string            `yaml:"name"`
+	URL         string            `yaml:"url"`
+	Method      string            `yaml:"method"`
+	Headers     map[string]string `yaml:"headers"`
+	ContentType string            `yaml:"content_type"`
+	// Template is a text/template rendering the body from the event, the
+	// event is sent as JSON when it is empty.
+	Template string `yaml:"template"`
+	// Events, Networks and Interfaces filter what is sent, empty sends
+	// everything.
+	Events      []string      `yaml:"events"`
+	Networks    []string      `yaml:"networks"`
+	Interfaces  []string      `yaml:"interfaces"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+// AlertsConfig is the alert engine, its rules are evaluated on every
+// harvest.
+type AlertsConfig struct {
+	// RepeatInterval sends alerts still firing again after it, 0 sends them
+	// once.
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	// KeepResolved is how long resolved alerts are listed on /api/v1/alerts.
+	KeepResolved time.Duration `yaml:"keep_resolved"`
+	// Sinks are where alerts are sent: log and webhooks (the notify ones).
+	Sinks    []string        `yaml:"sinks"`
+	Rules    []alert.Rule    `yaml:"rules"`
+	Silences []alert.Silence `yaml:"silences"`
+}
+
+// SeriesConfig is the on-disk history served on /api/v1/series, it is fed
+// on every harvest.
+type SeriesConfig struct {
+	// Path is the bbolt file, empty disables the history.
+	Path string `yaml:"path"`
+	// Flows keeps a series per flow next to the per host ones.
+	Flows     bool            `yaml:"flows"`
+	Retention SeriesRetention `yaml:"retention"`
+}
+
+// SeriesRetention is how long the points of every resolution are kept.
+type SeriesRetention struct {
+	Raw    time.Duration `yaml:"raw"`
+	Minute time.Duration `yaml:"minute"`
+	Hour   time.Duration `yaml:"hour"`
+	Day    time.Duration `yaml:"day"`
+}
+
+// ArchiveConfig keeps the final records of the expired flows.
+type ArchiveConfig struct {
+	// Path is a JSON lines file, empty disables the archive.
+	Path string `yaml:"path"`
+	// MaxSizeMB rotates the file before it grows past it.
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxFiles is how many rotated files are kept, 0 keeps them all.
+	MaxFiles int `yaml:"max_files"`
+}
+
+type Config struct {
+	ObjectPath string   `yaml:"object_path"`
+	Program    string   `yaml:"program"`
+	Interfaces []string `yaml:"interfaces"`
+	// Interface is the single interface of older config files, it replaces
+	// Interfaces when set.
+	Interface string `yaml:"interface"`
+	// LocalNetworks decide which addresses are on the LAN: CIDRs, addresses,
+	// "auto" for the subnets of the interfaces and "private" for the private
+	// ranges.
+	LocalNetworks []string `yaml:"local_networks"`
+	// IngressHook is "xdp" or "tc", TC is slower but works on drivers and
+	// virtual interfaces without XDP support.
+	IngressHook string `yaml:"ingress_hook"`
+	// XDPModes are tried in order until one attaches, native is fastest but
+	// needs driver support, generic works everywhere.
+	XDPModes []string `yaml:"xdp_modes"`
+	// TCEgress attaches the TC egress classifier so sent traffic is counted.
+	TCEgress         bool           `yaml:"tc_egress"`
+	Pin              PinConfig      `yaml:"pin"`
+	StateFile        string         `yaml:"state_file"`
+	StateBackend     string         `yaml:"state_backend"`
+	SnapshotInterval time.Duration  `yaml:"snapshot_interval"`
+	HTTP             HTTPConfig     `yaml:"http"`
+	Metrics          MetricsConfig  `yaml:"metrics"`
+	Grafana          GrafanaConfig  `yaml:"grafana"`
+	Resolver         ResolverConfig `yaml:"resolver"`
+	HarvestInterval  time.Duration  `yaml:"harvest_interval"`
+	// InactiveTimeout expires the flows that did not move for it and
+	// ActiveTimeout, 0 for none, those tracked for it, like NetFlow.
+	InactiveTimeout time.Duration `yaml:"inactive_timeout"`
+	ActiveTimeout   time.Duration `yaml:"active_timeout"`
+	// Expiration is the inactive timeout of older config files, it replaces
+	// InactiveTimeout when set.
+	Expiration    time.Duration `yaml:"expiration"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	LogLevel      string        `yaml:"log_level"`
+	// Simulate replaces the BPF program with generated traffic in memory,
+	// which needs neither root nor a network interface.
+	Simulate bool `yaml:"simulate"`
+	// Blocklist is only read from the config file, SIGHUP reloads it.
+	Blocklist []rules.Rule  `yaml:"blocklist"`
+	Notify    NotifyConfig  `yaml:"notify"`
+	Alerts    AlertsConfig  `yaml:"alerts"`
+	Series    SeriesConfig  `yaml:"series"`
+	Archive   ArchiveConfig `yaml:"archive"`
+}
+
+// option ties a config field to its flag and environment variable so both
+// sources go through the same parsing.
+type option struct {
+	name    string
+	usage   string
+	set     func(c *Config, v string) error
+	boolean bool
+}
+
+// boolFlag lets boolean options be passed as a bare -name.
+type boolFlag struct {
+	value string
+}
+
+func (b *boolFlag) String() string {
+	return b.value
+}
+
+func (b *boolFlag) Set(v string) error {
+	b.value = v
+	return nil
+}
+
+func (b *boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+var options = []option{
+	{name: "object", usage: "path to the compiled BPF object", set: func(c *Config, v string) error {
+		c.ObjectPath = v
+		return nil
+	}},
+	{name: "program", usage: "name of the XDP program inside the object", set: func(c *Config, v string) error {
+		c.Program = v
+		return nil
+	}},
+	{name: "interfaces", usage: "comma separated network interfaces to attach to", set: func(c *Config, v string) error {
+		c.Interfaces = splitList(v)
+		return nil
+	}},
+	{name: "interface", usage: "single network interface to attach to, same as -interfaces", set: func(c *Config, v string) error {
+		c.Interfaces = splitList(v)
+		return nil
+	}},
+	{name: "local-networks", usage: "comma separated networks on the LAN, CIDRs, addresses, auto or private", set: func(c *Config, v string) error {
+		c.LocalNetworks = splitList(v)
+		return nil
+	}},
+	{name: "ingress-hook", usage: "hook counting received traffic, xdp or tc", set: func(c *Config, v string) error {
+		c.IngressHook = v
+		return nil
+	}},
+	{name: "xdp-modes", usage: "comma separated XDP modes to try in order: native, generic, offload or default", set: func(c *Config, v string) error {
+		c.XDPModes = splitList(v)
+		return nil
+	}},
+	{name: "tc-egress", usage: "count sent traffic with a TC egress classifier (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.TCEgress = b
+		return err
+	}, boolean: true},
+	{name: "pin-maps", usage: "pin the tracker maps to bpffs and reuse them on startup (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Pin.Maps = b
+		return err
+	}, boolean: true},
+	{name: "pin-links", usage: "pin the XDP links and keep the programs attached across restarts (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Pin.Links = b
+		return err
+	}, boolean: true},
+	{name: "pin-path", usage: "bpffs directory the maps and links are pinned in", set: func(c *Config, v string) error {
+		c.Pin.Path = v
+		return nil
+	}},
+	{name: "state-file", usage: "file the tracker state is loaded from and saved to", set: func(c *Config, v string) error {
+		c.StateFile = v
+		return nil
+	}},
+	{name: "state-backend", usage: "how the state file is stored: json or bolt", set: func(c *Config, v string) error {
+		c.StateBackend = v
+		return nil
+	}},
+	{name: "snapshot-interval", usage: "how often the tracker state is saved", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.SnapshotInterval = d
+		return err
+	}},
+	{name: "http-addr", usage: "address the HTTP server listens on", set: func(c *Config, v string) error {
+		c.HTTP.Addr = v
+		return nil
+	}},
+	{name: "http-port", usage: "port the HTTP server listens on", set: func(c *Config, v string) error {
+		p, err := strconv.Atoi(v)
+		c.HTTP.Port = p
+		return err
+	}},
+	{name: "http-api-token", usage: "bearer token of /api/v1/rules, empty disables it", set: func(c *Config, v string) error {
+		c.HTTP.APIToken = v
+		return nil
+	}},
+	{name: "metrics-top-n", usage: "only export the N biggest flows or hosts on /metrics, 0 for all", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Metrics.TopN = n
+		return err
+	}},
+	{name: "metrics-aggregate-by-host", usage: "export per host instead of per flow series on /metrics (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Metrics.AggregateByHost = b
+		return err
+	}, boolean: true},
+	{name: "metrics-labels", usage: "comma separated allowlist of labels kept on /metrics", set: func(c *Config, v string) error {
+		c.Metrics.Labels = splitList(v)
+		return nil
+	}},
+	{name: "grafana-resolution", usage: "interval between the samples served to Grafana", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Grafana.Resolution = d
+		return err
+	}},
+	{name: "grafana-retention", usage: "how long samples are kept for Grafana", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Grafana.Retention = d
+		return err
+	}},
+	{name: "resolver-server", usage: "host:port of the DNS server used for reverse lookups, empty for the system resolver", set: func(c *Config, v string) error {
+		c.Resolver.Server = v
+		return nil
+	}},
+	{name: "resolver-timeout", usage: "timeout of a single reverse lookup", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Resolver.Timeout = d
+		return err
+	}},
+	{name: "resolver-workers", usage: "number of concurrent reverse lookups", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Resolver.Workers = n
+		return err
+	}},
+	{name: "resolver-ttl", usage: "how long a resolved host name is cached", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Resolver.TTL = d
+		return err
+	}},
+	{name: "resolver-negative-ttl", usage: "how long a failed reverse lookup is cached", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Resolver.NegativeTTL = d
+		return err
+	}},
+	{name: "harvest-interval", usage: "how often the kernel counters are read, new flows are reported as they happen", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.HarvestInterval = d
+		return err
+	}},
+	{name: "inactive-timeout", usage: "how long a flow may stay idle before it is expired", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.InactiveTimeout = d
+		return err
+	}},
+	{name: "active-timeout", usage: "how long a flow is tracked before it is expired and starts over, 0 for no limit", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.ActiveTimeout = d
+		return err
+	}},
+	{name: "expiration", usage: "same as -inactive-timeout", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.InactiveTimeout = d
+		return err
+	}},
+	{name: "check-interval", usage: "how often flows are checked for the timeouts", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.CheckInterval = d
+		return err
+	}},
+	{name: "notify-queue-dir", usage: "directory keeping the webhook events not delivered yet", set: func(c *Config, v string) error {
+		c.Notify.QueueDir = v
+		return nil
+	}},
+	{name: "notify-max-queue", usage: "events queued per webhook before the oldest are dropped, 0 for no limit", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Notify.MaxQueue = n
+		return err
+	}},
+	{name: "notify-blocked-interval", usage: "how often the blocklist drop counters are checked for blocked events", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Notify.BlockedInterval = d
+		return err
+	}},
+	{name: "alerts-repeat-interval", usage: "how often alerts still firing are sent again, 0 sends them once", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Alerts.RepeatInterval = d
+		return err
+	}},
+	{name: "alerts-sinks", usage: "comma separated sinks alerts are sent to: log, webhooks", set: func(c *Config, v string) error {
+		c.Alerts.Sinks = splitList(v)
+		return nil
+	}},
+	{name: "series-path", usage: "bbolt file keeping the traffic history, empty disables it", set: func(c *Config, v string) error {
+		c.Series.Path = v
+		return nil
+	}},
+	{name: "series-flows", usage: "keep a history per flow next to the per host one (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Series.Flows = b
+		return err
+	}, boolean: true},
+	{name: "series-retention-raw", usage: "how long the per harvest history is kept", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Series.Retention.Raw = d
+		return err
+	}},
+	{name: "series-retention-minute", usage: "how long the per minute history is kept", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Series.Retention.Minute = d
+		return err
+	}},
+	{name: "series-retention-hour", usage: "how long the per hour history is kept", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Series.Retention.Hour = d
+		return err
+	}},
+	{name: "series-retention-day", usage: "how long the per day history is kept", set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		c.Series.Retention.Day = d
+		return err
+	}},
+	{name: "archive-path", usage: "JSON lines file the expired flows are written to, empty disables it", set: func(c *Config, v string) error {
+		c.Archive.Path = v
+		return nil
+	}},
+	{name: "archive-max-size-mb", usage: "size the flow archive is rotated at, in MB", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Archive.MaxSizeMB = n
+		return err
+	}},
+	{name: "archive-max-files", usage: "rotated flow archives kept, 0 keeps them all", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Archive.MaxFiles = n
+		return err
+	}},
+	{name: "log-level", usage: "debug, info, warn or error", set: func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{name: "simulate", usage: "run on generated traffic without loading BPF (true/false)", set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Simulate = b
+		return err
+	}, boolean: true},
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func Default() *Config {
+	return &Config{
+		ObjectPath:       "build/xdp.bpf.o",
+		Program:          "xdp_count_type",
+		Interfaces:       []string{"enp3s0"},
+		LocalNetworks:    []string{"auto", "private"},
+		IngressHook:      "xdp",
+		XDPModes:         []string{"native", "generic"},
+		Pin:              PinConfig{Path: "/sys/fs/bpf/home-network-tracker"},
+		StateFile:        "data.json",
+		StateBackend:     "json",
+		SnapshotInterval: 5 * time.Minute,
+		HTTP:             HTTPConfig{Addr: "", Port: 5000},
+		Grafana:          GrafanaConfig{Resolution: 10 * time.Second, Retention: 24 * time.Hour},
+		Resolver:         ResolverConfig{Timeout: 2 * time.Second, Workers: 4, TTL: time.Hour, NegativeTTL: 5 * time.Minute},
+		HarvestInterval:  time.Second,
+		InactiveTimeout:  72 * time.Hour,
+		CheckInterval:    24 * time.Hour,
+		LogLevel:         "info",
+		Notify:           NotifyConfig{QueueDir: "notify-queue", MaxQueue: 1000, BlockedInterval: time.Minute},
+		Alerts:           AlertsConfig{KeepResolved: 24 * time.Hour, Sinks: []string{"log"}},
+		Series: SeriesConfig{Flows: true, Retention: SeriesRetention{
+			Raw:    24 * time.Hour,
+			Minute: 7 * 24 * time.Hour,
+			Hour:   90 * 24 * time.Hour,
+			Day:    5 * 365 * 24 * time.Hour,
+		}},
+		Archive: ArchiveConfig{MaxSizeMB: 100, MaxFiles: 10},
+	}
+}
+
+// envName turns a flag name like "http-port" into "HNT_HTTP_PORT".
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load builds the configuration from, in increasing priority: the defaults,
+// the config file, HNT_* environment variables and command line flags.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("go-loader", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file (env "+envPrefix+"CONFIG)")
+	for _, o := range options {
+		usage := fmt.Sprintf("%s (env %s)", o.usage, envName(o.name))
+		if o.boolean {
+			fs.Var(&boolFlag{}, o.name, usage)
+		} else {
+			fs.String(o.name, "", usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := os.LookupEnv(envName(o.name)); ok {
+			if err := o.set(c, v); err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %w", v, envName(o.name), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.name != f.Name {
+				continue
+			}
+			if err := o.set(c, f.Value.String()); err != nil {
+				flagErr = errors.Join(flagErr, fmt.Errorf("invalid value %q for -%s: %w", f.Value, f.Name, err))
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if c.Interface != "" {
+		c.Interfaces = []string{c.Interface}
+		c.Interface = ""
+	}
+	if c.Expiration != 0 {
+		c.InactiveTimeout = c.Expiration
+		c.Expiration = 0
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration at once so a broken
+// deployment can be fixed in a single pass.
+func (c *Config) Validate() error {
+	var errs []error
+	if !c.Simulate {
+		if _, err := os.Stat(c.ObjectPath); err != nil {
+			errs = append(errs, fmt.Errorf("object_path: %w", err))
+		}
+		if c.Program == "" {
+			errs = append(errs, errors.New("program: must not be empty"))
+		}
+		if len(c.Interfaces) == 0 {
+			errs = append(errs, errors.New("interfaces: must not be empty"))
+		}
+		for i, name := range c.Interfaces {
+			if _, err := net.InterfaceByName(name); err != nil {
+				errs = append(errs, fmt.Errorf("interfaces: %s: %w", name, err))
+			}
+			if slices.Contains(c.Interfaces[:i], name) {
+				errs = append(errs, fmt.Errorf("interfaces: %s is listed twice", name))
+			}
+		}
+		if c.IngressHook != "xdp" && c.IngressHook != "tc" {
+			errs = append(errs, fmt.Errorf("ingress_hook: must be xdp or tc, got %q", c.IngressHook))
+		}
+		if c.IngressHook == "xdp" && len(c.XDPModes) == 0 {
+			errs = append(errs, errors.New("xdp_modes: must not be empty"))
+		}
+		for _, mode := range c.XDPModes {
+			if !slices.Contains(xdpModes, strings.ToLower(mode)) {
+				errs = append(errs, fmt.Errorf("xdp_modes: unknown mode %q, expected native, generic, offload or default", mode))
+			}
+		}
+		if c.Pin.Links && !c.Pin.Maps {
+			// The programs left attached would count into maps nobody reads.
+			errs = append(errs, errors.New("pin.links: requires pin.maps"))
+		}
+		if (c.Pin.Maps || c.Pin.Links) && !filepath.IsAbs(c.Pin.Path) {
+			errs = append(errs, fmt.Errorf("pin.path: must be an absolute path, got %q", c.Pin.Path))
+		}
+	}
+	if len(c.LocalNetworks) == 0 {
+		errs = append(errs, errors.New("local_networks: must not be empty"))
+	}
+	if _, err := network.ParseLocalNetworks(c.LocalNetworks, false); err != nil {
+		errs = append(errs, fmt.Errorf("local_networks: %w", err))
+	}
+	if c.StateFile == "" {
+		errs = append(errs, errors.New("state_file: must not be empty"))
+	}
+	if !slices.Contains(stateBackends, c.StateBackend) {
+		errs = append(errs, fmt.Errorf("state_backend: unknown backend %q, expected json or bolt", c.StateBackend))
+	}
+	if c.SnapshotInterval <= 0 {
+		errs = append(errs, fmt.Errorf("snapshot_interval: must be positive, got %s", c.SnapshotInterval))
+	}
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		errs = append(errs, fmt.Errorf("http.port: %d is not a valid port", c.HTTP.Port))
+	}
+	if c.Metrics.TopN < 0 {
+		errs = append(errs, fmt.Errorf("metrics.top_n: must not be negative, got %d", c.Metrics.TopN))
+	}
+	known := metricsFlowLabels
+	if c.Metrics.AggregateByHost {
+		known = metricsHostLabels
+	}
+	for _, label := range c.Metrics.Labels {
+		if !slices.Contains(known, label) {
+			errs = append(errs, fmt.Errorf("metrics.labels: unknown label %q, expected one of %s", label, strings.Join(known, ", ")))
+		}
+	}
+	if c.Grafana.Resolution <= 0 {
+		errs = append(errs, fmt.Errorf("grafana.resolution: must be positive, got %s", c.Grafana.Resolution))
+	}
+	if c.Grafana.Retention < c.Grafana.Resolution {
+		errs = append(errs, fmt.Errorf("grafana.retention: must be at least grafana.resolution, got %s", c.Grafana.Retention))
+	}
+	if c.Resolver.Server != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver.Server); err != nil {
+			errs = append(errs, fmt.Errorf("resolver.server: %w", err))
+		}
+	}
+	if c.Resolver.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("resolver.timeout: must be positive, got %s", c.Resolver.Timeout))
+	}
+	if c.Resolver.Workers < 1 {
+		errs = append(errs, fmt.Errorf("resolver.workers: must be at least 1, got %d", c.Resolver.Workers))
+	}
+	if c.Resolver.TTL <= 0 {
+		errs = append(errs, fmt.Errorf("resolver.ttl: must be positive, got %s", c.Resolver.TTL))
+	}
+	if c.Resolver.NegativeTTL <= 0 {
+		errs = append(errs, fmt.Errorf("resolver.negative_ttl: must be positive, got %s", c.Resolver.NegativeTTL))
+	}
+	if err := rules.Validate(c.Blocklist); err != nil {
+		errs = append(errs, fmt.Errorf("blocklist: %w", err))
+	}
+	errs = append(errs, c.Notify.validate()...)
+	if c.Alerts.RepeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("alerts.repeat_interval: must not be negative, got %s", c.Alerts.RepeatInterval))
+	}
+	if c.Alerts.KeepResolved < 0 {
+		errs = append(errs, fmt.Errorf("alerts.keep_resolved: must not be negative, got %s", c.Alerts.KeepResolved))
+	}
+	for _, sink := range c.Alerts.Sinks {
+		if !slices.Contains(alertSinks, sink) {
+			errs = append(errs, fmt.Errorf("alerts.sinks: unknown sink %q, expected log or webhooks", sink))
+		}
+		if sink == "webhooks" && len(c.Notify.Webhooks) == 0 {
+			errs = append(errs, errors.New("alerts.sinks: webhooks needs notify.webhooks"))
+		}
+	}
+	if err := alert.Validate(c.Alerts.Rules, c.Alerts.Silences); err != nil {
+		errs = append(errs, fmt.Errorf("alerts: %w", err))
+	}
+	if c.Archive.Path != "" {
+		if c.Archive.MaxSizeMB < 1 {
+			errs = append(errs, fmt.Errorf("archive.max_size_mb: must be at least 1, got %d", c.Archive.MaxSizeMB))
+		}
+		if c.Archive.MaxFiles < 0 {
+			errs = append(errs, fmt.Errorf("archive.max_files: must not be negative, got %d", c.Archive.MaxFiles))
+		}
+	}
+	if c.Series.Path != "" {
+		r := c.Series.Retention
+		for i, d := range []time.Duration{r.Raw, r.Minute, r.Hour, r.Day} {
+			if d <= 0 {
+				errs = append(errs, fmt.Errorf("series.retention.%s: must be positive, got %s", []string{"raw", "minute", "hour", "day"}[i], d))
+			}
+		}
+	}
+	if c.HarvestInterval <= 0 {
+		errs = append(errs, fmt.Errorf("harvest_interval: must be positive, got %s", c.HarvestInterval))
+	}
+	if c.InactiveTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("inactive_timeout: must be positive, got %s", c.InactiveTimeout))
+	}
+	if c.ActiveTimeout < 0 {
+		errs = append(errs, fmt.Errorf("active_timeout: must not be negative, got %s", c.ActiveTimeout))
+	}
+	if c.CheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("check_interval: must be positive, got %s", c.CheckInterval))
+	}
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (n *NotifyConfig) validate() []error {
+	var errs []error
+	if len(n.Webhooks) > 0 && n.QueueDir == "" {
+		errs = append(errs, errors.New("notify.queue_dir: must not be empty"))
+	}
+	if n.MaxQueue < 0 {
+		errs = append(errs, fmt.Errorf("notify.max_queue: must not be negative, got %d", n.MaxQueue))
+	}
+	if n.BlockedInterval <= 0 {
+		errs = append(errs, fmt.Errorf("notify.blocked_interval: must be positive, got %s", n.BlockedInterval))
+	}
+	for i, w := range n.Webhooks {
+		prefix := fmt.Sprintf("notify.webhooks[%d]", i)
+		if !webhookName.MatchString(w.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: must be letters, digits, - or _, got %q", prefix, w.Name))
+		}
+		if slices.ContainsFunc(n.Webhooks[:i], func(o WebhookConfig) bool { return o.Name == w.Name }) {
+			errs = append(errs, fmt.Errorf("%s.name: %s is used twice", prefix, w.Name))
+		}
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s.url: must be an http or https URL, got %q", prefix, w.URL))
+		}
+		for _, event := range w.Events {
+			if !slices.Contains(notifyEvents, event) {
+				errs = append(errs, fmt.Errorf("%s.events: unknown event %q, expected one of %s", prefix, event, strings.Join(notifyEvents, ", ")))
+			}
+		}
+		for _, network := range w.Networks {
+			if _, err := netip.ParsePrefix(network); err != nil {
+				errs = append(errs, fmt.Errorf("%s.networks: %w", prefix, err))
+			}
+		}
+		if w.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s.timeout: must not be negative, got %s", prefix, w.Timeout))
+		}
+		if w.MaxAttempts < 0 {
+			errs = append(errs, fmt.Errorf("%s.max_attempts: must not be negative, got %d", prefix, w.MaxAttempts))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testObject returns the path of an empty file standing in for the BPF
+// object, Validate only checks it exists.
+func testObject(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "xdp.bpf.o")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	object := testObject(t)
+	file := writeConfig(t, "object_path: "+object+"\ninterface: lo\nhttp:\n  port: 6000\nlog_level: warn\n")
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		wantPort int
+		wantLog  string
+	}{
+		{"default", nil, []string{"-object", object, "-interface", "lo"}, 5000, "info"},
+		{"file over default", nil, []string{"-config", file}, 6000, "warn"},
+		{"env over file", map[string]string{"HNT_HTTP_PORT": "7000"}, []string{"-config", file}, 7000, "warn"},
+		{"flag over env", map[string]string{"HNT_HTTP_PORT": "7000"}, []string{"-config", file, "-http-port", "8000"}, 8000, "warn"},
+		{"config path from env", map[string]string{"HNT_CONFIG": file, "HNT_LOG_LEVEL": "debug"}, nil, 6000, "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if c.HTTP.Port != tt.wantPort {
+				t.Errorf("http.port = %d, want %d", c.HTTP.Port, tt.wantPort)
+			}
+			if c.LogLevel != tt.wantLog {
+				t.Errorf("log_level = %s, want %s", c.LogLevel, tt.wantLog)
+			}
+		})
+	}
+}
+
+// Without a config the daemon reads the counters every second like it always
+// did, and only writes the state file.
+func TestDefault(t *testing.T) {
+	c := Default()
+	if c.HarvestInterval != time.Second {
+		t.Errorf("harvest_interval = %s, want 1s", c.HarvestInterval)
+	}
+	if c.TCEgress || c.Series.Path != "" || c.Archive.Path != "" {
+		t.Errorf("tc_egress %v, series.path %q and archive.path %q, want them off", c.TCEgress, c.Series.Path, c.Archive.Path)
+	}
+}
+
+// The single interface of older config files and flags still works.
+func TestLoadLegacyInterface(t *testing.T) {
+	object := testObject(t)
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"interface in file", []string{"-config", writeConfig(t, "object_path: "+object+"\ninterface: lo\n")}, []string{"lo"}},
+		{"interfaces in file", []string{"-config", writeConfig(t, "object_path: "+object+"\ninterfaces: [lo]\n")}, []string{"lo"}},
+		{"interface flag", []string{"-object", object, "-interface", "lo"}, []string{"lo"}},
+		{"interfaces flag", []string{"-object", object, "-interfaces", " lo,"}, []string{"lo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !slices.Equal(c.Interfaces, tt.want) {
+				t.Errorf("interfaces = %v, want %v", c.Interfaces, tt.want)
+			}
+		})
+	}
+}
+
+// The expiration of older configs is the inactive timeout.
+func TestLoadLegacyExpiration(t *testing.T) {
+	object := testObject(t)
+	tests := []struct {
+		name string
+		args []string
+		want time.Duration
+	}{
+		{"expiration in file", []string{"-config", writeConfig(t, "object_path: "+object+"\ninterface: lo\nexpiration: 2h\n")}, 2 * time.Hour},
+		{"inactive timeout in file", []string{"-config", writeConfig(t, "object_path: "+object+"\ninterface: lo\ninactive_timeout: 3h\n")}, 3 * time.Hour},
+		{"expiration flag", []string{"-object", object, "-interface", "lo", "-expiration", "4h"}, 4 * time.Hour},
+		{"inactive timeout flag", []string{"-object", object, "-interface", "lo", "-inactive-timeout", "5h"}, 5 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if c.InactiveTimeout != tt.want || c.Expiration != 0 {
+				t.Errorf("inactive timeout = %s (expiration %s), want %s", c.InactiveTimeout, c.Expiration, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	object := testObject(t)
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		file string
+		want string
+	}{
+		{"unknown field", nil, nil, "object_path: " + object + "\nintreface: lo\n", "field intreface not found"},
+		{"bad env value", map[string]string{"HNT_HTTP_PORT": "http"}, []string{"-object", object, "-interface", "lo"}, "", "HNT_HTTP_PORT"},
+		{"bad flag value", nil, []string{"-object", object, "-interface", "lo", "-expiration", "3 days"}, "", "-expiration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", writeConfig(t, tt.file))
+			}
+			_, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	object := testObject(t)
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		// want are the fields reported, none when the config is valid.
+		want []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"missing object", func(c *Config) { c.ObjectPath = object + ".missing" }, []string{"object_path"}},
+		{"empty program", func(c *Config) { c.Program = "" }, []string{"program"}},
+		{"unknown interface", func(c *Config) { c.Interfaces = []string{"lo", "nosuchif0"} }, []string{"interfaces: nosuchif0"}},
+		{"no interface", func(c *Config) { c.Interfaces = nil }, []string{"interfaces"}},
+		{"interface twice", func(c *Config) { c.Interfaces = []string{"lo", "lo"} }, []string{"interfaces"}},
+		{"port out of range", func(c *Config) { c.HTTP.Port = 70000 }, []string{"http.port"}},
+		{"non positive durations", func(c *Config) {
+			c.InactiveTimeout = 0
+			c.ActiveTimeout = -time.Second
+			c.CheckInterval = -time.Second
+		}, []string{"inactive_timeout", "active_timeout", "check_interval"}},
+		{"bad log level", func(c *Config) { c.LogLevel = "loud" }, []string{"log_level"}},
+		{"all reported at once", func(c *Config) {
+			c.Program = ""
+			c.StateFile = ""
+			c.HTTP.Port = 0
+		}, []string{"program", "state_file", "http.port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.ObjectPath, c.Interfaces = object, []string{"lo"}
+			tt.modify(c)
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate accepted an invalid configuration")
+			}
+			for _, field := range tt.want {
+				if !strings.Contains(err.Error(), field+":") {
+					t.Errorf("error does not report %s:\n%v", field, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package dashboards
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//go:embed json/*.json
+var files embed.FS
+
+const datasource = `apiVersion: 1
+datasources:
+  - name: Home network tracker
+    type: simpod-json-datasource
+    uid: hnt-json
+    access: proxy
+    url: %s
+`
+
+const provider = `apiVersion: 1
+providers:
+  - name: Home network tracker
+    type: file
+    folder: Home network
+    options:
+      path: %s
+`
+
+// Write lays out a Grafana provisioning tree under dir: the dashboards, a
+// JSON datasource pointing at url and the provider loading the dashboards.
+// The JSON datasource plugin (simpod-json-datasource) must be installed.
+func Write(dir, url string) error {
+	dashboardDir, err := filepath.Abs(filepath.Join(dir, "dashboards"))
+	if err != nil {
+		return err
+	}
+	for _, d := range []string{
+		dashboardDir,
+		filepath.Join(dir, "provisioning", "datasources"),
+		filepath.Join(dir, "provisioning", "dashboards"),
+	} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return err
+		}
+	}
+
+	entries, err := files.ReadDir("json")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := files.ReadFile("json/" + e.Name())
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dashboardDir, e.Name()), data, 0o644); err != nil {
+			return err
+		}
+	}
+
+	ds := fmt.Sprintf(datasource, url)
+	if err := os.WriteFile(filepath.Join(dir, "provisioning", "datasources", "home-network-tracker.yaml"), []byte(ds), 0o644); err != nil {
+		return err
+	}
+	p := fmt.Sprintf(provider, dashboardDir)
+	return os.WriteFile(filepath.Join(dir, "provisioning", "dashboards", "home-network-tracker.yaml"), []byte(p), 0o644)
+}
@@ -0,0 +1,48 @@
+package kernelmap
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// KernelMap is the subset of *libbpfgo.BPFMap the tracker relies on. Keys and
+// values are passed as pointers to their first byte, exactly like libbpfgo
+// expects them.
+type KernelMap interface {
+	KeySize() int
+	ValueSize() int
+
+	GetValue(key unsafe.Pointer) ([]byte, error)
+	Update(key, value unsafe.Pointer) error
+	DeleteKey(key unsafe.Pointer) error
+	// GetNextKey writes the key following key into nextKey. A nil key
+	// returns the first key and syscall.ENOENT marks the end of the map.
+	GetNextKey(key, nextKey unsafe.Pointer) error
+
+	GetValueBatch(keys, startKey, nextKey unsafe.Pointer, count uint32) ([][]byte, uint32, error)
+	GetValueAndDeleteBatch(keys, startKey, nextKey unsafe.Pointer, count uint32) ([][]byte, uint32, error)
+	UpdateBatch(keys, values unsafe.Pointer, count uint32) (uint32, error)
+	DeleteKeyBatch(keys unsafe.Pointer, count uint32) (uint32, error)
+}
+
+// Iterate calls fn with every key of m until fn returns false. The key slice
+// is only valid during the call.
+func Iterate(m KernelMap, fn func(key []byte) bool) error {
+	var prev unsafe.Pointer
+	cur := make([]byte, m.KeySize())
+	next := make([]byte, m.KeySize())
+	for {
+		if err := m.GetNextKey(prev, unsafe.Pointer(&next[0])); err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				return nil
+			}
+			return err
+		}
+		if !fn(next) {
+			return nil
+		}
+		cur, next = next, cur
+		prev = unsafe.Pointer(&cur[0])
+	}
+}
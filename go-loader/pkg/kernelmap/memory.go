@@ -0,0 +1,193 @@
+package kernelmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MemoryMap is an in-memory KernelMap with the semantics of a
+// BPF_MAP_TYPE_HASH, used to run the tracker without loading any BPF program.
+// Batch cursors are 4 byte positions, like the bucket index the kernel uses
+// for hash maps.
+type MemoryMap struct {
+	mu         sync.Mutex
+	keySize    int
+	valueSize  int
+	maxEntries int
+	// BatchLimit, when set, caps the entries a batch call returns, like the
+	// kernel returning a batch short when the next hash bucket doesn't fit.
+	BatchLimit int
+	keys       []string
+	pos        map[string]int
+	values     map[string][]byte
+}
+
+func NewMemoryMap(keySize, valueSize, maxEntries int) *MemoryMap {
+	return &MemoryMap{
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+		pos:        make(map[string]int),
+		values:     make(map[string][]byte),
+	}
+}
+
+func (m *MemoryMap) KeySize() int {
+	return m.keySize
+}
+
+func (m *MemoryMap) ValueSize() int {
+	return m.valueSize
+}
+
+func (m *MemoryMap) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.keys)
+}
+
+func (m *MemoryMap) key(p unsafe.Pointer) string {
+	return string(unsafe.Slice((*byte)(p), m.keySize))
+}
+
+func (m *MemoryMap) GetValue(key unsafe.Pointer) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[m.key(key)]
+	if !ok {
+		return nil, fmt.Errorf("failed to lookup value: %w", syscall.ENOENT)
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (m *MemoryMap) Update(key, value unsafe.Pointer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.update(m.key(key), unsafe.Slice((*byte)(value), m.valueSize))
+}
+
+func (m *MemoryMap) update(k string, v []byte) error {
+	if _, ok := m.values[k]; !ok {
+		if len(m.keys) >= m.maxEntries {
+			return fmt.Errorf("failed to update map: %w", syscall.E2BIG)
+		}
+		m.pos[k] = len(m.keys)
+		m.keys = append(m.keys, k)
+	}
+	m.values[k] = append([]byte(nil), v...)
+	return nil
+}
+
+func (m *MemoryMap) DeleteKey(key unsafe.Pointer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.delete(m.key(key))
+}
+
+func (m *MemoryMap) delete(k string) error {
+	i, ok := m.pos[k]
+	if !ok {
+		return fmt.Errorf("failed to delete key: %w", syscall.ENOENT)
+	}
+	last := len(m.keys) - 1
+	m.keys[i] = m.keys[last]
+	m.pos[m.keys[i]] = i
+	m.keys = m.keys[:last]
+	delete(m.pos, k)
+	delete(m.values, k)
+	return nil
+}
+
+func (m *MemoryMap) GetNextKey(key, nextKey unsafe.Pointer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := 0
+	if key != nil {
+		// Like the kernel, a key that is not in the map restarts from the
+		// first key.
+		if i, ok := m.pos[m.key(key)]; ok {
+			next = i + 1
+		}
+	}
+	if next >= len(m.keys) {
+		return fmt.Errorf("failed to get next key: %w", syscall.ENOENT)
+	}
+	copy(unsafe.Slice((*byte)(nextKey), m.keySize), m.keys[next])
+	return nil
+}
+
+func (m *MemoryMap) batch(keys, startKey, nextKey unsafe.Pointer, count uint32, remove bool) ([][]byte, uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := 0
+	if startKey != nil {
+		start = int(binary.NativeEndian.Uint32(unsafe.Slice((*byte)(startKey), 4)))
+	}
+	if start >= len(m.keys) {
+		return nil, 0, fmt.Errorf("failed to batch get values: %w", syscall.ENOENT)
+	}
+
+	end := min(start+int(count), len(m.keys))
+	if m.BatchLimit > 0 {
+		end = min(end, start+m.BatchLimit)
+	}
+	out := unsafe.Slice((*byte)(keys), int(count)*m.keySize)
+	var values [][]byte
+	for i, k := range m.keys[start:end] {
+		copy(out[i*m.keySize:], k)
+		values = append(values, m.values[k])
+	}
+	n := end - start
+	if remove {
+		for _, k := range append([]string(nil), m.keys[start:end]...) {
+			m.delete(k)
+		}
+		// Deleting shifts the remaining keys into the freed positions.
+		end = start
+	}
+	binary.NativeEndian.PutUint32(unsafe.Slice((*byte)(nextKey), 4), uint32(end))
+	return values, uint32(n), nil
+}
+
+func (m *MemoryMap) GetValueBatch(keys, startKey, nextKey unsafe.Pointer, count uint32) ([][]byte, uint32, error) {
+	return m.batch(keys, startKey, nextKey, count, false)
+}
+
+func (m *MemoryMap) GetValueAndDeleteBatch(keys, startKey, nextKey unsafe.Pointer, count uint32) ([][]byte, uint32, error) {
+	return m.batch(keys, startKey, nextKey, count, true)
+}
+
+func (m *MemoryMap) UpdateBatch(keys, values unsafe.Pointer, count uint32) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ks := unsafe.Slice((*byte)(keys), int(count)*m.keySize)
+	vs := unsafe.Slice((*byte)(values), int(count)*m.valueSize)
+	for i := 0; i < int(count); i++ {
+		k := string(ks[i*m.keySize : (i+1)*m.keySize])
+		if err := m.update(k, vs[i*m.valueSize:(i+1)*m.valueSize]); err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			return uint32(i), nil
+		}
+	}
+	return count, nil
+}
+
+func (m *MemoryMap) DeleteKeyBatch(keys unsafe.Pointer, count uint32) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ks := unsafe.Slice((*byte)(keys), int(count)*m.keySize)
+	for i := 0; i < int(count); i++ {
+		if err := m.delete(string(ks[i*m.keySize : (i+1)*m.keySize])); err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			return uint32(i), nil
+		}
+	}
+	return count, nil
+}
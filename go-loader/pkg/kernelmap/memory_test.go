@@ -0,0 +1,127 @@
+package kernelmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+const testKeySize, testValueSize = 8, 16
+
+func testKey(i int) []byte {
+	k := make([]byte, testKeySize)
+	binary.BigEndian.PutUint64(k, uint64(i))
+	return k
+}
+
+func fill(t *testing.T, m *MemoryMap, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		v := make([]byte, testValueSize)
+		binary.NativeEndian.PutUint64(v, uint64(i))
+		if err := m.Update(unsafe.Pointer(&testKey(i)[0]), unsafe.Pointer(&v[0])); err != nil {
+			t.Fatalf("Update %d: %v", i, err)
+		}
+	}
+}
+
+func TestMemoryMap(t *testing.T) {
+	m := NewMemoryMap(testKeySize, testValueSize, 2)
+	fill(t, m, 2)
+
+	v := make([]byte, testValueSize)
+	binary.NativeEndian.PutUint64(v, 42)
+	if err := m.Update(unsafe.Pointer(&testKey(1)[0]), unsafe.Pointer(&v[0])); err != nil {
+		t.Fatalf("updating an existing key of a full map: %v", err)
+	}
+	if err := m.Update(unsafe.Pointer(&testKey(2)[0]), unsafe.Pointer(&v[0])); !errors.Is(err, syscall.E2BIG) {
+		t.Errorf("adding to a full map returned %v, want E2BIG", err)
+	}
+
+	got, err := m.GetValue(unsafe.Pointer(&testKey(1)[0]))
+	if err != nil {
+		t.Fatalf("GetValue: %v", err)
+	}
+	if binary.NativeEndian.Uint64(got) != 42 {
+		t.Errorf("GetValue = %d, want 42", binary.NativeEndian.Uint64(got))
+	}
+
+	if err := m.DeleteKey(unsafe.Pointer(&testKey(0)[0])); err != nil {
+		t.Fatalf("DeleteKey: %v", err)
+	}
+	if _, err := m.GetValue(unsafe.Pointer(&testKey(0)[0])); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("GetValue of a deleted key returned %v, want ENOENT", err)
+	}
+	if err := m.DeleteKey(unsafe.Pointer(&testKey(0)[0])); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("deleting a missing key returned %v, want ENOENT", err)
+	}
+	if m.Len() != 1 {
+		t.Errorf("Len = %d, want 1", m.Len())
+	}
+}
+
+func TestIterate(t *testing.T) {
+	for _, n := range []int{0, 1, 10} {
+		m := NewMemoryMap(testKeySize, testValueSize, 16)
+		fill(t, m, n)
+		seen := make(map[uint64]bool)
+		if err := Iterate(m, func(key []byte) bool {
+			seen[binary.BigEndian.Uint64(key)] = true
+			return true
+		}); err != nil {
+			t.Fatalf("Iterate: %v", err)
+		}
+		if len(seen) != n {
+			t.Errorf("iterated over %d of %d keys", len(seen), n)
+		}
+	}
+}
+
+// Reading in batches visits every key once, deleting them as it goes
+// empties the map.
+func TestBatch(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		m := NewMemoryMap(testKeySize, testValueSize, 64)
+		fill(t, m, 25)
+
+		const count = 10
+		keys := make([]byte, count*testKeySize)
+		var start, next [4]byte
+		startPtr := unsafe.Pointer(nil)
+		seen := make(map[uint64]uint64)
+		for {
+			var values [][]byte
+			var n uint32
+			var err error
+			if remove {
+				values, n, err = m.GetValueAndDeleteBatch(unsafe.Pointer(&keys[0]), startPtr, unsafe.Pointer(&next[0]), count)
+			} else {
+				values, n, err = m.GetValueBatch(unsafe.Pointer(&keys[0]), startPtr, unsafe.Pointer(&next[0]), count)
+			}
+			if errors.Is(err, syscall.ENOENT) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("batch: %v", err)
+			}
+			for i := 0; i < int(n); i++ {
+				seen[binary.BigEndian.Uint64(keys[i*testKeySize:])] = binary.NativeEndian.Uint64(values[i])
+			}
+			start = next
+			startPtr = unsafe.Pointer(&start[0])
+		}
+		if len(seen) != 25 {
+			t.Errorf("remove %v: read %d of 25 keys", remove, len(seen))
+		}
+		for k, v := range seen {
+			if k != v {
+				t.Errorf("remove %v: key %d read value %d", remove, k, v)
+			}
+		}
+		if want := map[bool]int{false: 25, true: 0}[remove]; m.Len() != want {
+			t.Errorf("remove %v: %d keys left, want %d", remove, m.Len(), want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package network
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Interface names are looked up once per ifindex, the harvest asks for them
+// on every flow.
+var ifaceNames sync.Map
+
+// RegisterInterface names an ifindex that doesn't exist on this host, like
+// the interfaces of the simulated traffic.
+func RegisterInterface(ifindex uint32, name string) {
+	ifaceNames.Store(ifindex, name)
+}
+
+// InterfaceName returns the name of ifindex, or "if<index>" if it doesn't
+// exist (anymore).
+func InterfaceName(ifindex uint32) string {
+	if ifindex == 0 {
+		return ""
+	}
+	if name, ok := ifaceNames.Load(ifindex); ok {
+		return name.(string)
+	}
+	iface, err := net.InterfaceByIndex(int(ifindex))
+	if err != nil {
+		// Not cached, the interface may show up later.
+		return "if" + strconv.Itoa(int(ifindex))
+	}
+	ifaceNames.Store(ifindex, iface.Name)
+	return iface.Name
+}
+
+// InterfaceIndex is the reverse of InterfaceName.
+func InterfaceIndex(name string) (uint32, bool) {
+	var found uint32
+	ifaceNames.Range(func(k, v any) bool {
+		if v.(string) == name {
+			found = k.(uint32)
+			return false
+		}
+		return true
+	})
+	if found != 0 {
+		return found, true
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, false
+	}
+	ifaceNames.Store(uint32(iface.Index), iface.Name)
+	return uint32(iface.Index), true
+}
+
+// IsL3 reports whether the interface name carries bare IP packets with no
+// ethernet header, like WireGuard and tun devices. Those have no hardware
+// address, loopback has an all zero one.
+func IsL3(name string) (bool, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, err
+	}
+	return len(iface.HardwareAddr) == 0 && iface.Flags&net.FlagLoopback == 0, nil
+}
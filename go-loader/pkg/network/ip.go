@@ -3,7 +3,10 @@ package network
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -11,15 +14,108 @@ const (
 	IPV6 = 6
 )
 
+// Sizes of struct ipv4_key and struct ipv6_key in xdp.bpf.c.
+const (
+	IPv4KeySize = 20
+	IPv6KeySize = 44
+)
+
+// L4 protocols the XDP program reads ports from. For ICMP the type and code
+// are stored in place of the source and destination ports.
+const (
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+func ProtoName(proto uint8) string {
+	switch proto {
+	case ProtoICMP:
+		return "icmp"
+	case ProtoTCP:
+		return "tcp"
+	case ProtoUDP:
+		return "udp"
+	case ProtoICMPv6:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// ParseProto is the reverse of ProtoName, it also takes protocol numbers.
+func ParseProto(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case "icmp":
+		return ProtoICMP, nil
+	case "tcp":
+		return ProtoTCP, nil
+	case "udp":
+		return ProtoUDP, nil
+	case "icmpv6":
+		return ProtoICMPv6, nil
+	}
+	n, err := strconv.ParseUint(name, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown protocol %q", name)
+	}
+	return uint8(n), nil
+}
+
+// The kernel only reads the first key_size bytes of a key, the last byte is
+// used to tag the family so IPv4 and IPv6 keys never collide in user space.
+const familyTagOffset = 63
+
 type IPKey struct {
 	Saddr string `json:"saddr"`
 	Daddr string `json:"daddr"`
-	Type  int    `json:"type"`
+	Sport uint16 `json:"sport"`
+	Dport uint16 `json:"dport"`
+	Proto uint8  `json:"proto"`
+	// Ifindex is the interface the packet was counted on.
+	Ifindex uint32 `json:"ifindex"`
+	Type    int    `json:"type"`
+}
+
+// Reverse returns the key of the packets going the other way, the way the
+// ingress hooks key received packets: the addresses and, unless they hold an
+// ICMP type and code, the ports are swapped.
+func (k IPKey) Reverse() IPKey {
+	k.Saddr, k.Daddr = k.Daddr, k.Saddr
+	if !IsICMP(k.Proto) {
+		k.Sport, k.Dport = k.Dport, k.Sport
+	}
+	return k
+}
+
+// ICMP and ICMPv6 echo types, a request opens a flow and a reply answers it.
+const (
+	ICMPEchoReply     = 0
+	ICMPEchoRequest   = 8
+	ICMPv6EchoRequest = 128
+	ICMPv6EchoReply   = 129
+)
+
+// IsICMPRequest reports whether an ICMP message of type typ opens a flow
+// rather than answering one, replies and errors answer.
+func IsICMPRequest(proto uint8, typ uint16) bool {
+	return (proto == ProtoICMP && typ == ICMPEchoRequest) || (proto == ProtoICMPv6 && typ == ICMPv6EchoRequest)
+}
+
+// IsICMP reports whether the ports of a proto flow are an ICMP type and code.
+func IsICMP(proto uint8) bool {
+	return proto == ProtoICMP || proto == ProtoICMPv6
 }
 
 type IPv4 struct {
-	Saddr uint32 `json:"saddr"`
-	Daddr uint32 `json:"daddr"`
+	Saddr   uint32   `json:"saddr"`
+	Daddr   uint32   `json:"daddr"`
+	Sport   uint16   `json:"sport"`
+	Dport   uint16   `json:"dport"`
+	Proto   uint8    `json:"proto"`
+	Pad     [3]uint8 `json:"-"`
+	Ifindex uint32   `json:"ifindex"`
 }
 
 type In6Addr struct {
@@ -27,16 +123,27 @@ type In6Addr struct {
 }
 
 type IPv6 struct {
-	Saddr In6Addr `json:"saddr"`
-	Daddr In6Addr `json:"daddr"`
+	Saddr   In6Addr  `json:"saddr"`
+	Daddr   In6Addr  `json:"daddr"`
+	Sport   uint16   `json:"sport"`
+	Dport   uint16   `json:"dport"`
+	Proto   uint8    `json:"proto"`
+	Pad     [3]uint8 `json:"-"`
+	Ifindex uint32   `json:"ifindex"`
+}
+
+func flowString(saddr, daddr net.IP, sport, dport uint16, proto uint8, ifindex uint32) string {
+	src := net.JoinHostPort(saddr.String(), strconv.Itoa(int(sport)))
+	dst := net.JoinHostPort(daddr.String(), strconv.Itoa(int(dport)))
+	return InterfaceName(ifindex) + " " + ProtoName(proto) + " " + src + " -> " + dst
 }
 
 func (k IPv4) String() string {
-	return IntToIPv4(k.Saddr).String() + " -> " + IntToIPv4(k.Daddr).String()
+	return flowString(IntToIPv4(k.Saddr), IntToIPv4(k.Daddr), k.Sport, k.Dport, k.Proto, k.Ifindex)
 }
 
 func (k IPv6) String() string {
-	return net.IP(k.Saddr.Addr[:]).String() + " -> " + net.IP(k.Daddr.Addr[:]).String()
+	return flowString(net.IP(k.Saddr.Addr[:]), net.IP(k.Daddr.Addr[:]), k.Sport, k.Dport, k.Proto, k.Ifindex)
 }
 
 func IntToIPv4(ipaddr uint32) net.IP {
@@ -52,6 +159,25 @@ func ParseIPv4Key(key []byte) (IPv4, error) {
 	return d, err
 }
 
+func ParseIPv6Key(key []byte) (IPv6, error) {
+	var d IPv6
+	r := bytes.NewReader(key)
+	err := binary.Read(r, binary.BigEndian, &d)
+	return d, err
+}
+
+// ParseKey parses a raw kernel key of the given family into IPv4 or IPv6.
+func ParseKey(family int, key []byte) (any, error) {
+	switch family {
+	case IPV4:
+		return ParseIPv4Key(key)
+	case IPV6:
+		return ParseIPv6Key(key)
+	default:
+		return nil, fmt.Errorf("unknown ip family %d", family)
+	}
+}
+
 func AnyIpToString(ip any) string {
 	switch ip := ip.(type) {
 	case IPv4:
@@ -63,24 +189,53 @@ func AnyIpToString(ip any) string {
 	}
 }
 
-func GenericToIp(ipKey IPKey) any {
-	switch ipKey.Type {
-	case IPV4:
-		return IPv4{
-			Saddr: binary.BigEndian.Uint32(net.ParseIP(ipKey.Saddr).To4()),
-			Daddr: binary.BigEndian.Uint32(net.ParseIP(ipKey.Daddr).To4()),
-		}
-	case IPV6:
-		var saddr, daddr In6Addr
-		copy(saddr.Addr[:], net.ParseIP(ipKey.Saddr).To16())
-		copy(daddr.Addr[:], net.ParseIP(ipKey.Daddr).To16())
-		return IPv6{
-			Saddr: saddr,
-			Daddr: daddr,
+func parseAddr(addr string, family int) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %q", addr)
+	}
+	if family == IPV4 {
+		if ip = ip.To4(); ip == nil {
+			return nil, fmt.Errorf("%q is not an IPv4 address", addr)
 		}
-	default:
-		return nil
 	}
+	return ip.To16(), nil
+}
+
+func GenericToIp(ipKey IPKey) (any, error) {
+	if ipKey.Type != IPV4 && ipKey.Type != IPV6 {
+		return nil, fmt.Errorf("unknown ip family %d", ipKey.Type)
+	}
+	saddr, err := parseAddr(ipKey.Saddr, ipKey.Type)
+	if err != nil {
+		return nil, err
+	}
+	daddr, err := parseAddr(ipKey.Daddr, ipKey.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if ipKey.Type == IPV4 {
+		return IPv4{
+			Saddr:   binary.BigEndian.Uint32(saddr.To4()),
+			Daddr:   binary.BigEndian.Uint32(daddr.To4()),
+			Sport:   ipKey.Sport,
+			Dport:   ipKey.Dport,
+			Proto:   ipKey.Proto,
+			Ifindex: ipKey.Ifindex,
+		}, nil
+	}
+	var s, d In6Addr
+	copy(s.Addr[:], saddr)
+	copy(d.Addr[:], daddr)
+	return IPv6{
+		Saddr:   s,
+		Daddr:   d,
+		Sport:   ipKey.Sport,
+		Dport:   ipKey.Dport,
+		Proto:   ipKey.Proto,
+		Ifindex: ipKey.Ifindex,
+	}, nil
 }
 
 func IpToKernelKey(ip any) [64]byte {
@@ -89,9 +244,26 @@ func IpToKernelKey(ip any) [64]byte {
 	case IPv4:
 		binary.BigEndian.PutUint32(key[0:4], ip.Saddr)
 		binary.BigEndian.PutUint32(key[4:8], ip.Daddr)
+		binary.BigEndian.PutUint16(key[8:10], ip.Sport)
+		binary.BigEndian.PutUint16(key[10:12], ip.Dport)
+		key[12] = ip.Proto
+		binary.BigEndian.PutUint32(key[16:20], ip.Ifindex)
+		key[familyTagOffset] = IPV4
 	case IPv6:
 		copy(key[0:16], ip.Saddr.Addr[:])
 		copy(key[16:32], ip.Daddr.Addr[:])
+		binary.BigEndian.PutUint16(key[32:34], ip.Sport)
+		binary.BigEndian.PutUint16(key[34:36], ip.Dport)
+		key[36] = ip.Proto
+		binary.BigEndian.PutUint32(key[40:44], ip.Ifindex)
+		key[familyTagOffset] = IPV6
 	}
 	return key
-}
\ No newline at end of file
+}
+
+func KernelKeyFamily(key [64]byte) int {
+	if key[familyTagOffset] == IPV6 {
+		return IPV6
+	}
+	return IPV4
+}
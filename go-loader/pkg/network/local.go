@@ -0,0 +1,181 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Keywords of ParseLocalNetworks besides CIDRs and addresses.
+const (
+	// LocalAuto is the subnets of the addresses of the interfaces.
+	LocalAuto = "auto"
+	// LocalPrivate is PrivateNetworks.
+	LocalPrivate = "private"
+)
+
+// PrivateNetworks are the RFC 1918 and unique local ranges, never routed on
+// the internet.
+var PrivateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// localNetworks are the networks IsLocal checks, PrivateNetworks until
+// SetLocalNetworks is called.
+var localNetworks atomic.Pointer[[]*net.IPNet]
+
+func SetLocalNetworks(nets []*net.IPNet) {
+	localNetworks.Store(&nets)
+}
+
+func LocalNetworks() []*net.IPNet {
+	if nets := localNetworks.Load(); nets != nil {
+		return *nets
+	}
+	return PrivateNetworks
+}
+
+// IsLocal reports whether addr is on the LAN: a loopback or link-local
+// address, or one in LocalNetworks.
+func IsLocal(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, n := range LocalNetworks() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectLocalNetworks returns the subnets of the addresses of the interfaces
+// that are up, loopback and link-local ones left out as IsLocal always
+// counts them.
+func DetectLocalNetworks() ([]*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the addresses of %s: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			nets = append(nets, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+		}
+	}
+	return nets, nil
+}
+
+// ParseLocalNetworks turns specs, CIDRs, addresses or the keywords LocalAuto
+// and LocalPrivate, into the networks for SetLocalNetworks. LocalAuto is
+// skipped unless detect is set. Duplicates are dropped.
+func ParseLocalNetworks(specs []string, detect bool) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		switch spec {
+		case LocalAuto:
+			if !detect {
+				continue
+			}
+			detected, err := DetectLocalNetworks()
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, detected...)
+		case LocalPrivate:
+			nets = append(nets, PrivateNetworks...)
+		default:
+			n, err := ParseNetwork(spec)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+		}
+	}
+
+	seen := make(map[string]bool, len(nets))
+	out := nets[:0]
+	for _, n := range nets {
+		if !seen[n.String()] {
+			seen[n.String()] = true
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
+
+// ParseNetwork parses a CIDR, or an address as a network of its own.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Scopes of a flow, see Scope.
+const (
+	// ScopeLAN is a flow between two local addresses.
+	ScopeLAN = "lan"
+	// ScopeOutbound is a flow a local address opened to the internet.
+	ScopeOutbound = "outbound"
+	// ScopeInbound is a flow opened from the internet to a local address,
+	// through a port forward for instance.
+	ScopeInbound = "inbound"
+	// ScopeTransit is a flow between two remote addresses, seen when
+	// routing for another network.
+	ScopeTransit = "transit"
+)
+
+// Scope classifies with IsLocal a flow that initiator opened to peer. Both
+// directions of the flow share its scope.
+func Scope(initiator, peer string) string {
+	switch src, dst := IsLocal(initiator), IsLocal(peer); {
+	case src && dst:
+		return ScopeLAN
+	case src:
+		return ScopeOutbound
+	case dst:
+		return ScopeInbound
+	default:
+		return ScopeTransit
+	}
+}
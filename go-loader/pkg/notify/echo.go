@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EchoHandler is a stand-in webhook receiver that prints every request to w,
+// to try a webhook configuration without a real service. failRate is the
+// share of requests answered with a 503, to see the retries at work.
+func EchoHandler(w io.Writer, failRate float64) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		status := http.StatusNoContent
+		if rand.Float64() < failRate {
+			status = http.StatusServiceUnavailable
+		}
+
+		mu.Lock()
+		fmt.Fprintf(w, "%s %s %s (%s) -> %d\n%s\n\n", time.Now().Format(time.TimeOnly), r.Method, r.URL, r.Header.Get("Content-Type"), status, body)
+		mu.Unlock()
+		rw.WriteHeader(status)
+	})
+}
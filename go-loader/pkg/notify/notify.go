@@ -0,0 +1,448 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	"go.uber.org/zap"
+)
+
+// Event types, webhooks can subscribe to a subset of them.
+const (
+	EventNewFlow     = "new_flow"
+	EventNewHost     = "new_host"
+	EventFlowExpired = "flow_expired"
+	EventBlocked     = "blocked"
+	EventAlert       = "alert"
+)
+
+// Event is what the webhooks receive, as JSON or rendered by their template.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Summary is a one line description, enough for chat messages.
+	Summary    string              `json:"summary"`
+	Connection *tracker.Connection `json:"connection,omitempty"`
+	// Host is the address of new_host events.
+	Host string `json:"host,omitempty"`
+	// Rule is the rule of blocked events and Dropped what it dropped since
+	// the previous blocked event.
+	Rule    *rules.Rule      `json:"rule,omitempty"`
+	Dropped *rules.DropStats `json:"dropped,omitempty"`
+	// Alert is the alert of alert events, when it fires, is repeated or
+	// resolves.
+	Alert *alert.Alert `json:"alert,omitempty"`
+}
+
+// Endpoint is a webhook. Only the events passing all of its filters are sent.
+type Endpoint struct {
+	// Name identifies the webhook in logs and names its queue directory.
+	Name        string
+	URL         string
+	Method      string
+	Headers     map[string]string
+	ContentType string
+	// Template renders the body with text/template from an Event, the event
+	// is sent as JSON when it is empty. The json function quotes a value,
+	// e.g. {"content": {{json .Summary}}}.
+	Template string
+	// Events, Networks (CIDRs matched against the addresses of the event)
+	// and Interfaces filter the events, empty lets everything through.
+	Events      []string
+	Networks    []string
+	Interfaces  []string
+	Timeout     time.Duration
+	MaxAttempts int
+}
+
+type Options struct {
+	// QueueDir holds a directory per endpoint with the events not delivered
+	// yet, they are sent after a restart.
+	QueueDir string
+	// MaxQueue bounds the events queued per endpoint, the oldest are dropped
+	// first.
+	MaxQueue  int
+	Endpoints []Endpoint
+}
+
+// Defaults of the optional Endpoint fields.
+const (
+	defaultMethod      = http.MethodPost
+	defaultContentType = "application/json"
+	defaultTimeout     = 10 * time.Second
+	defaultMaxAttempts = 10
+)
+
+// Delivery is retried with an exponential backoff between these bounds.
+const (
+	retryMin = time.Second
+	retryMax = 5 * time.Minute
+)
+
+// Notifier delivers events to webhooks. Every endpoint has its own queue and
+// goroutine, a slow or failing one doesn't hold the others back. It
+// implements tracker.EventHandler and alert.Sink.
+type Notifier struct {
+	endpoints []*endpoint
+	l         *zap.Logger
+}
+
+var (
+	_ tracker.EventHandler = (*Notifier)(nil)
+	_ alert.Sink           = (*Notifier)(nil)
+)
+
+type endpoint struct {
+	Endpoint
+	tmpl     *template.Template
+	networks []netip.Prefix
+	queue    *diskQueue
+	in       chan Event
+	client   *http.Client
+	attempts int
+	l        *zap.Logger
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := marshal(v)
+		return string(b), err
+	},
+}
+
+// marshal is json.Marshal without the HTML escaping, which would turn the
+// arrows of the summaries into \u003e.
+func marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func New(opts Options, l *zap.Logger) (*Notifier, error) {
+	n := &Notifier{l: l}
+	for _, ep := range opts.Endpoints {
+		e := &endpoint{
+			Endpoint: ep,
+			in:       make(chan Event, 1024),
+			l:        l,
+		}
+		if e.Method == "" {
+			e.Method = defaultMethod
+		}
+		if e.ContentType == "" {
+			e.ContentType = defaultContentType
+		}
+		if e.Timeout <= 0 {
+			e.Timeout = defaultTimeout
+		}
+		if e.MaxAttempts <= 0 {
+			e.MaxAttempts = defaultMaxAttempts
+		}
+		e.client = &http.Client{Timeout: e.Timeout}
+
+		if ep.Template != "" {
+			tmpl, err := template.New(ep.Name).Funcs(templateFuncs).Parse(ep.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", ep.Name, err)
+			}
+			e.tmpl = tmpl
+		}
+		for _, cidr := range ep.Networks {
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", ep.Name, err)
+			}
+			e.networks = append(e.networks, p.Masked())
+		}
+		q, err := newDiskQueue(filepath.Join(opts.QueueDir, ep.Name), opts.MaxQueue)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", ep.Name, err)
+		}
+		e.queue = q
+		n.endpoints = append(n.endpoints, e)
+	}
+	return n, nil
+}
+
+// Run delivers the queued events, those left by a previous run first, until
+// ctx is done.
+func (n *Notifier) Run(ctx context.Context) {
+	for _, e := range n.endpoints {
+		go e.run(ctx)
+	}
+}
+
+// Notify queues ev for every endpoint whose filters it passes. It doesn't
+// wait for the disk or the network.
+func (n *Notifier) Notify(ev Event) {
+	for _, e := range n.endpoints {
+		if !e.wants(ev) {
+			continue
+		}
+		select {
+		case e.in <- ev:
+		default:
+			n.l.Sugar().Warnf("Webhook %s is falling behind, dropped a %s event", e.Name, ev.Type)
+		}
+	}
+}
+
+func (n *Notifier) NewFlow(c tracker.Connection) {
+	n.Notify(Event{Type: EventNewFlow, Time: time.Now(), Summary: "New flow " + flowText(c), Connection: &c})
+}
+
+func (n *Notifier) NewHost(addr string, c tracker.Connection) {
+	summary := fmt.Sprintf("New host %s on %s", addr, c.Interface)
+	n.Notify(Event{Type: EventNewHost, Time: time.Now(), Summary: summary, Connection: &c, Host: addr})
+}
+
+func (n *Notifier) FlowExpired(c tracker.Connection) {
+	summary := fmt.Sprintf("Flow expired %s after %d bytes received and %d sent", flowText(c), c.RxBytes, c.TxBytes)
+	n.Notify(Event{Type: EventFlowExpired, Time: time.Now(), Summary: summary, Connection: &c})
+}
+
+func (n *Notifier) SendAlert(a alert.Alert) {
+	summary := a.Summary
+	if a.State == alert.StateResolved {
+		summary = "Resolved: " + summary
+	}
+	n.Notify(Event{Type: EventAlert, Time: time.Now(), Summary: summary, Alert: &a})
+}
+
+// WatchBlocklist sends a blocked event for every rule that dropped packets
+// in the last interval until ctx is done. The kernel counts drops without
+// telling user space, so they are found by polling the counters.
+func (n *Notifier) WatchBlocklist(ctx context.Context, b *rules.Blocklist, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := make(map[string]rules.DropStats)
+
+	for {
+		select {
+		case <-ticker.C:
+			seen := make(map[string]rules.DropStats)
+			for _, s := range b.Stats() {
+				seen[s.Name] = s.DropStats
+				prev := last[s.Name]
+				if s.Packets < prev.Packets {
+					// The rule was removed and added again.
+					prev = rules.DropStats{}
+				}
+				if s.Packets == prev.Packets {
+					continue
+				}
+				rule := s.Rule
+				dropped := rules.DropStats{Packets: s.Packets - prev.Packets, Bytes: s.Bytes - prev.Bytes}
+				summary := fmt.Sprintf("Rule %s (%s) dropped %d packets, %d bytes", rule.Name, rule.CIDR, dropped.Packets, dropped.Bytes)
+				n.Notify(Event{Type: EventBlocked, Time: time.Now(), Summary: summary, Rule: &rule, Dropped: &dropped})
+			}
+			last = seen
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func flowText(c tracker.Connection) string {
+	src := net.JoinHostPort(c.Saddr, strconv.Itoa(int(c.Sport)))
+	dst := net.JoinHostPort(c.Daddr, strconv.Itoa(int(c.Dport)))
+	if len(c.SHost) > 0 {
+		src += " (" + c.SHost[0] + ")"
+	}
+	if len(c.DHost) > 0 {
+		dst += " (" + c.DHost[0] + ")"
+	}
+	return network.ProtoName(c.Proto) + " " + src + " -> " + dst + " on " + c.Interface
+}
+
+func (e *endpoint) wants(ev Event) bool {
+	if len(e.Events) > 0 && !slices.Contains(e.Events, ev.Type) {
+		return false
+	}
+	if len(e.Interfaces) > 0 && (ev.Connection == nil || !slices.Contains(e.Interfaces, ev.Connection.Interface)) {
+		return false
+	}
+	if len(e.networks) == 0 {
+		return true
+	}
+
+	if ev.Rule != nil {
+		// Blocked events match the networks their rule overlaps.
+		p, err := netip.ParsePrefix(ev.Rule.CIDR)
+		if err != nil {
+			addr, err := netip.ParseAddr(ev.Rule.CIDR)
+			if err != nil {
+				return false
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		return slices.ContainsFunc(e.networks, p.Overlaps)
+	}
+	var addrs []string
+	if ev.Connection != nil {
+		addrs = append(addrs, ev.Connection.Saddr, ev.Connection.Daddr)
+	}
+	if ev.Alert != nil {
+		addrs = append(addrs, ev.Alert.Host)
+	}
+	for _, a := range addrs {
+		addr, err := netip.ParseAddr(a)
+		if err == nil && slices.ContainsFunc(e.networks, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *endpoint) run(ctx context.Context) {
+	// Starts with whatever a previous run left in the queue.
+	wake := time.NewTimer(0)
+	defer wake.Stop()
+	backingOff := false
+
+	for {
+		select {
+		case ev := <-e.in:
+			e.enqueue(ev)
+			if !backingOff {
+				wake.Reset(0)
+			}
+		case <-wake.C:
+			delay := e.flush(ctx)
+			backingOff = delay > 0
+			if backingOff {
+				wake.Reset(delay)
+			}
+		case <-ctx.Done():
+			// Keep what was notified for the next run.
+			for {
+				select {
+				case ev := <-e.in:
+					e.enqueue(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *endpoint) enqueue(ev Event) {
+	data, err := marshal(ev)
+	if err != nil {
+		e.l.Sugar().Errorf("Webhook %s: failed to encode a %s event: %v", e.Name, ev.Type, err)
+		return
+	}
+	dropped, err := e.queue.push(data)
+	if err != nil {
+		e.l.Sugar().Errorf("Webhook %s: failed to queue a %s event: %v", e.Name, ev.Type, err)
+		return
+	}
+	if dropped {
+		e.l.Sugar().Warnf("Webhook %s: queue is full, dropped the oldest event", e.Name)
+	}
+}
+
+// flush delivers the queued events in order until the queue is empty, ctx is
+// done or a delivery has to be retried. It returns how long to wait before
+// the retry, 0 otherwise.
+func (e *endpoint) flush(ctx context.Context) time.Duration {
+	for ctx.Err() == nil {
+		name, data, err := e.queue.peek()
+		if err != nil {
+			e.l.Sugar().Errorf("Webhook %s: failed to read the queue: %v", e.Name, err)
+			return retryMax
+		}
+		if name == "" {
+			return 0
+		}
+
+		retry, err := e.send(ctx, data)
+		if err == nil {
+			e.attempts = 0
+			if err := e.queue.remove(name); err != nil {
+				e.l.Sugar().Errorf("Webhook %s: failed to dequeue %s: %v", e.Name, name, err)
+				return retryMax
+			}
+			continue
+		}
+
+		e.attempts++
+		if !retry || e.attempts >= e.MaxAttempts {
+			e.l.Sugar().Errorf("Webhook %s: dropping event after %d attempts: %v", e.Name, e.attempts, err)
+			e.attempts = 0
+			if err := e.queue.remove(name); err != nil {
+				e.l.Sugar().Errorf("Webhook %s: failed to dequeue %s: %v", e.Name, name, err)
+				return retryMax
+			}
+			continue
+		}
+		delay := min(retryMin<<(e.attempts-1), retryMax)
+		e.l.Sugar().Warnf("Webhook %s: attempt %d failed, retrying in %s: %v", e.Name, e.attempts, delay, err)
+		return delay
+	}
+	return 0
+}
+
+// send delivers a queued event. retry tells whether a failure is worth
+// trying again: network errors, timeouts, 429 and 5xx are, other statuses
+// won't get better.
+func (e *endpoint) send(ctx context.Context, data []byte) (retry bool, err error) {
+	var ev Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return false, fmt.Errorf("corrupt queued event: %w", err)
+	}
+	body := data
+	if e.tmpl != nil {
+		var buf bytes.Buffer
+		if err := e.tmpl.Execute(&buf, ev); err != nil {
+			return false, err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, e.Method, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", e.ContentType)
+	req.Header.Set("User-Agent", "home-network-tracker")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s answered %s", e.URL, resp.Status)
+	default:
+		return false, fmt.Errorf("%s answered %s", e.URL, resp.Status)
+	}
+}
@@ -0,0 +1,236 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	"go.uber.org/zap"
+)
+
+var testFlow = tracker.Connection{
+	Saddr:     "192.168.1.10",
+	Daddr:     "1.1.1.1",
+	Sport:     40000,
+	Dport:     443,
+	Proto:     6,
+	Interface: "eth0",
+}
+
+// newTestNotifier returns a Notifier with a single endpoint, queued in a
+// temporary directory unless dir is set.
+func newTestNotifier(t *testing.T, dir string, ep Endpoint) (*Notifier, *endpoint) {
+	t.Helper()
+	if dir == "" {
+		dir = t.TempDir()
+	}
+	if ep.Name == "" {
+		ep.Name = "test"
+	}
+	n, err := New(Options{QueueDir: dir, Endpoints: []Endpoint{ep}}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return n, n.endpoints[0]
+}
+
+func queued(t *testing.T, e *endpoint) int {
+	t.Helper()
+	names, err := e.queue.list()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	return len(names)
+}
+
+func TestWants(t *testing.T) {
+	flow := testFlow
+	wanInterface := testFlow
+	wanInterface.Interface = "wan0"
+	tests := []struct {
+		name string
+		ep   Endpoint
+		ev   Event
+		want bool
+	}{
+		{"no filters", Endpoint{}, Event{Type: EventNewFlow, Connection: &flow}, true},
+		{"event type kept", Endpoint{Events: []string{EventNewFlow}}, Event{Type: EventNewFlow, Connection: &flow}, true},
+		{"event type dropped", Endpoint{Events: []string{EventAlert}}, Event{Type: EventNewFlow, Connection: &flow}, false},
+		{"interface kept", Endpoint{Interfaces: []string{"eth0"}}, Event{Type: EventNewFlow, Connection: &flow}, true},
+		{"interface dropped", Endpoint{Interfaces: []string{"eth0"}}, Event{Type: EventNewFlow, Connection: &wanInterface}, false},
+		{"interface without connection", Endpoint{Interfaces: []string{"eth0"}}, Event{Type: EventAlert, Alert: &alert.Alert{Host: "192.168.1.10"}}, false},
+		{"source in network", Endpoint{Networks: []string{"192.168.1.0/24"}}, Event{Type: EventNewFlow, Connection: &flow}, true},
+		{"destination in network", Endpoint{Networks: []string{"1.1.1.0/24"}}, Event{Type: EventNewFlow, Connection: &flow}, true},
+		{"no end in network", Endpoint{Networks: []string{"10.0.0.0/8"}}, Event{Type: EventNewFlow, Connection: &flow}, false},
+		{"alert host in network", Endpoint{Networks: []string{"192.168.1.0/24"}}, Event{Type: EventAlert, Alert: &alert.Alert{Host: "192.168.1.10"}}, true},
+		{"alert host not in network", Endpoint{Networks: []string{"10.0.0.0/8"}}, Event{Type: EventAlert, Alert: &alert.Alert{Host: "192.168.1.10"}}, false},
+		{"blocked rule overlaps", Endpoint{Networks: []string{"192.168.1.0/24"}}, Event{Type: EventBlocked, Rule: &rules.Rule{CIDR: "192.168.0.0/16"}}, true},
+		{"blocked address overlaps", Endpoint{Networks: []string{"192.168.1.0/24"}}, Event{Type: EventBlocked, Rule: &rules.Rule{CIDR: "192.168.1.20"}}, true},
+		{"blocked rule apart", Endpoint{Networks: []string{"192.168.1.0/24"}}, Event{Type: EventBlocked, Rule: &rules.Rule{CIDR: "10.0.0.0/8"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, e := newTestNotifier(t, "", tt.ep)
+			if got := e.wants(tt.ev); got != tt.want {
+				t.Errorf("wants = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"json quoting", `{"content": {{json .Summary}}}`, `{"content": "New flow tcp 192.168.1.10:40000 -> 1.1.1.1:443 on eth0"}`},
+		{"fields", `{{.Type}} {{.Connection.Saddr}} {{.Connection.Interface}}`, `new_flow 192.168.1.10 eth0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				bodies <- r.Header.Get("Content-Type") + " " + string(b)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			n, e := newTestNotifier(t, "", Endpoint{URL: srv.URL, Template: tt.template, ContentType: "text/plain"})
+			n.NewFlow(testFlow)
+			e.enqueue(<-e.in)
+			if delay := e.flush(context.Background()); delay != 0 {
+				t.Fatalf("flush returned a retry delay of %s", delay)
+			}
+			if got, want := <-bodies, "text/plain "+tt.want; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if queued(t, e) != 0 {
+				t.Errorf("the delivered event is still queued")
+			}
+		})
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	_, err := New(Options{QueueDir: t.TempDir(), Endpoints: []Endpoint{{Name: "bad", Template: "{{.Summary"}}}, zap.NewNop())
+	if err == nil {
+		t.Fatal("New accepted an invalid template")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status []int
+		// delays are what the flushes return, the last one is 0 once the
+		// event is delivered or dropped.
+		delays []time.Duration
+	}{
+		{"delivered first", []int{http.StatusOK}, []time.Duration{0}},
+		{"5xx backs off", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, []time.Duration{retryMin, 2 * retryMin, 0}},
+		{"429 backs off", []int{http.StatusTooManyRequests, http.StatusOK}, []time.Duration{retryMin, 0}},
+		{"4xx dropped", []int{http.StatusBadRequest}, []time.Duration{0}},
+		{"dropped after max attempts", []int{500, 500, 500}, []time.Duration{retryMin, 2 * retryMin, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(calls.Add(1)) - 1
+				w.WriteHeader(tt.status[min(i, len(tt.status)-1)])
+			}))
+			defer srv.Close()
+
+			_, e := newTestNotifier(t, "", Endpoint{URL: srv.URL, MaxAttempts: 3})
+			e.enqueue(Event{Type: EventNewFlow, Summary: "retry"})
+			for i, want := range tt.delays {
+				if got := e.flush(context.Background()); got != want {
+					t.Fatalf("flush %d returned %s, want %s", i, got, want)
+				}
+			}
+			if got := int(calls.Load()); got != len(tt.delays) {
+				t.Errorf("%d requests, want %d", got, len(tt.delays))
+			}
+			if queued(t, e) != 0 {
+				t.Errorf("the event is still queued")
+			}
+		})
+	}
+}
+
+func TestBackoffBound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, e := newTestNotifier(t, "", Endpoint{URL: srv.URL, MaxAttempts: 100})
+	e.enqueue(Event{Type: EventNewFlow})
+	var last time.Duration
+	for range 20 {
+		last = e.flush(context.Background())
+	}
+	if last != retryMax {
+		t.Errorf("backoff reached %s, want it capped at %s", last, retryMax)
+	}
+}
+
+func TestQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	_, e := newTestNotifier(t, dir, Endpoint{URL: down.URL})
+	for _, summary := range []string{"first", "second"} {
+		e.enqueue(Event{Type: EventNewFlow, Summary: summary})
+	}
+	if delay := e.flush(context.Background()); delay == 0 {
+		t.Fatal("flush did not back off from the failing endpoint")
+	}
+	if got := queued(t, e); got != 2 {
+		t.Fatalf("%d events queued, want 2", got)
+	}
+
+	// A new Notifier over the same directory, as after a restart, delivers
+	// them in order.
+	summaries := make(chan string, 2)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		summaries <- string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	n, e := newTestNotifier(t, dir, Endpoint{URL: up.URL, Template: "{{.Summary}}"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.Run(ctx)
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-summaries:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not replayed", want)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for queued(t, e) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the replayed events are still queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
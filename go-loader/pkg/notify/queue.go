@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// diskQueue keeps pending events as one file each in dir, named so they sort
+// in the order they were queued. Files are written next to their final name
+// and renamed, a crash never leaves a partial event.
+type diskQueue struct {
+	dir string
+	max int
+	seq atomic.Uint64
+}
+
+const queueSuffix = ".json"
+
+func newDiskQueue(dir string, max int) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	return &diskQueue{dir: dir, max: max}, nil
+}
+
+// list returns the queued file names, oldest first.
+func (q *diskQueue) list() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), queueSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// push queues data. When the queue is full the oldest event is dropped, the
+// recent ones matter more.
+func (q *diskQueue) push(data []byte) (dropped bool, err error) {
+	names, err := q.list()
+	if err != nil {
+		return false, err
+	}
+	if q.max > 0 && len(names) >= q.max {
+		if err := q.remove(names[0]); err != nil {
+			return false, err
+		}
+		dropped = true
+	}
+
+	name := fmt.Sprintf("%020d-%08d%s", time.Now().UnixNano(), q.seq.Add(1)%1e8, queueSuffix)
+	tmp := filepath.Join(q.dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return dropped, err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return dropped, err
+	}
+	return dropped, nil
+}
+
+// peek returns the oldest queued event, an empty name when there is none.
+func (q *diskQueue) peek() (string, []byte, error) {
+	names, err := q.list()
+	if err != nil || len(names) == 0 {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(q.dir, names[0]))
+	return names[0], data, err
+}
+
+func (q *diskQueue) remove(name string) error {
+	err := os.Remove(filepath.Join(q.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
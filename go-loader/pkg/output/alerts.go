@@ -0,0 +1,33 @@
+package output
+
+import (
+	"net/http"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+)
+
+const alertsPath = "/api/v1/alerts"
+
+// alertsHandler serves GET /api/v1/alerts, ?state=firing or resolved filters
+// the alerts.
+func (s *Server) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Alerts == nil {
+		http.Error(w, "The alert engine is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	if state != "" && state != alert.StateFiring && state != alert.StateResolved {
+		http.Error(w, "state: must be firing or resolved", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.Alerts.Alerts(state))
+}
@@ -0,0 +1,471 @@
+package output
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	ts "github.com/akiasmaka/home-network-tracker/go-loader/pkg/series"
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+// The handlers below follow the API of Grafana's JSON datasource
+// (simpod-json-datasource): POST /search lists the targets, POST /query
+// returns time series or tables for a time range and POST /annotations
+// returns events in a time range.
+
+const (
+	targetBytes      = "bytes:"
+	targetThroughput = "throughput:"
+	targetFlowCount  = "flows:count"
+	targetNewConns   = "new_connections"
+	targetTopTalkers = "top_talkers"
+	targetFlows      = "flows"
+	targetHosts      = "hosts"
+	// The upload and download targets are the throughput between a local
+	// host and the internet.
+	targetUpload     = "upload:"
+	targetDownload   = "download:"
+	targetInternet   = "internet"
+	targetScopes     = "scopes"
+	targetLocalHosts = "local_hosts"
+	hostTotal        = "total"
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+type grafanaSearch struct {
+	Target string `json:"target"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange   `json:"range"`
+	Annotation map[string]any `json:"annotation"`
+}
+
+type timeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type tableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type table struct {
+	Type    string        `json:"type"`
+	Columns []tableColumn `json:"columns"`
+	Rows    [][]any       `json:"rows"`
+}
+
+type annotation struct {
+	Annotation map[string]any `json:"annotation"`
+	Time       int64          `json:"time"`
+	Title      string         `json:"title"`
+	Text       string         `json:"text"`
+	Tags       []string       `json:"tags"`
+}
+
+func decodePost(w http.ResponseWriter, r *http.Request, v any) bool {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func (s *Server) grafanaRootHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) hosts() []string {
+	set := make(map[string]struct{})
+	for _, c := range s.Tracker.Data.ToSilce() {
+		set[c.Saddr] = struct{}{}
+		set[c.Daddr] = struct{}{}
+	}
+	hosts := make([]string, 0, len(set))
+	for h := range set {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (s *Server) localHosts() []string {
+	local := []string{}
+	for _, h := range s.hosts() {
+		if network.IsLocal(h) {
+			local = append(local, h)
+		}
+	}
+	return local
+}
+
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaSearch
+	if !decodePost(w, r, &req) {
+		return
+	}
+
+	if req.Target == targetHosts {
+		writeJSON(w, s.hosts())
+		return
+	}
+	if req.Target == targetLocalHosts {
+		writeJSON(w, s.localHosts())
+		return
+	}
+
+	targets := []string{
+		targetBytes + hostTotal, targetThroughput + hostTotal, targetUpload + hostTotal, targetDownload + hostTotal,
+		targetFlowCount, targetNewConns, targetTopTalkers, targetFlows, targetInternet, targetScopes,
+	}
+	for _, h := range s.hosts() {
+		targets = append(targets, targetBytes+h, targetThroughput+h)
+	}
+	for _, h := range s.localHosts() {
+		targets = append(targets, targetUpload+h, targetDownload+h)
+	}
+	matching := []string{}
+	for _, t := range targets {
+		if strings.Contains(t, req.Target) {
+			matching = append(matching, t)
+		}
+	}
+	writeJSON(w, matching)
+}
+
+func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaQuery
+	if !decodePost(w, r, &req) {
+		return
+	}
+
+	samples := s.History.between(req.Range.From, req.Range.To)
+	resp := []any{}
+	for _, t := range req.Targets {
+		switch {
+		case t.Target == targetTopTalkers:
+			resp = append(resp, s.topTalkersTable())
+		case t.Target == targetFlows:
+			resp = append(resp, s.flowsTable())
+		case t.Target == targetInternet:
+			resp = append(resp, s.internetTable())
+		case t.Target == targetScopes:
+			resp = append(resp, s.scopesTable())
+		default:
+			out, ok, err := s.querySeries(t.Target, req.Range, samples)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "Unknown target "+t.Target, http.StatusBadRequest)
+				return
+			}
+			out.Datapoints = downsample(out.Datapoints, req.MaxDataPoints)
+			resp = append(resp, out)
+		}
+	}
+	writeJSON(w, resp)
+}
+
+// querySeries answers a time series target, the per host ones from the
+// series store when it is enabled.
+func (s *Server) querySeries(target string, r grafanaRange, samples []sample) (timeSeries, bool, error) {
+	if s.Series != nil {
+		if out, ok, err := s.storedSeries(target, r.From, r.To); ok || err != nil {
+			return out, ok, err
+		}
+	}
+	out, ok := seriesFor(target, samples)
+	return out, ok, nil
+}
+
+// storedSeries reads the bytes, throughput, upload and download targets from
+// the series store, ok is false for the others. There bytes: is what the host
+// moved since the start of the range, not the total of its tracked flows.
+func (s *Server) storedSeries(target string, from, to time.Time) (timeSeries, bool, error) {
+	var host string
+	var directions []string
+	cumulative := false
+	switch {
+	case strings.HasPrefix(target, targetBytes):
+		host, cumulative = strings.TrimPrefix(target, targetBytes), true
+		directions = []string{ts.DirectionSent, ts.DirectionReceived}
+	case strings.HasPrefix(target, targetThroughput):
+		host = strings.TrimPrefix(target, targetThroughput)
+		directions = []string{ts.DirectionSent, ts.DirectionReceived}
+	case strings.HasPrefix(target, targetUpload):
+		host = strings.TrimPrefix(target, targetUpload)
+		directions = []string{ts.DirectionUpload}
+	case strings.HasPrefix(target, targetDownload):
+		host = strings.TrimPrefix(target, targetDownload)
+		directions = []string{ts.DirectionDownload}
+	default:
+		return timeSeries{}, false, nil
+	}
+	if host == hostTotal {
+		host = ts.HostTotal
+	}
+
+	res, err := s.Series.Query(ts.Query{Host: host, From: from, To: to, Directions: directions})
+	if err != nil {
+		return timeSeries{}, true, err
+	}
+	step, err := time.ParseDuration(res.Step)
+	if err != nil {
+		return timeSeries{}, true, err
+	}
+	out := timeSeries{Target: target, Datapoints: [][2]float64{}}
+	var total float64
+	for i, p := range res.Series[0].Points {
+		var moved uint64
+		for _, ser := range res.Series {
+			moved += ser.Points[i].Bytes
+		}
+		// Points are stamped with the end of their step, like the in-memory
+		// rates.
+		v := float64(moved) / step.Seconds()
+		if cumulative {
+			total += float64(moved)
+			v = total
+		}
+		out.Datapoints = append(out.Datapoints, [2]float64{v, float64(p.Time.Add(step).UnixMilli())})
+	}
+	return out, true, nil
+}
+
+func hostValue(s sample, host string) uint64 {
+	if host == hostTotal {
+		return s.bytes
+	}
+	return s.hosts[host]
+}
+
+func seriesFor(target string, samples []sample) (timeSeries, bool) {
+	ts := timeSeries{Target: target, Datapoints: [][2]float64{}}
+	point := func(v float64, t time.Time) {
+		ts.Datapoints = append(ts.Datapoints, [2]float64{v, float64(t.UnixMilli())})
+	}
+	rate := func(value func(s sample) uint64) {
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			dt := cur.time.Sub(prev.time).Seconds()
+			delta := float64(value(cur)) - float64(value(prev))
+			// Totals drop when flows expire, that is not negative traffic.
+			point(max(delta, 0)/dt, cur.time)
+		}
+	}
+
+	switch {
+	case target == targetFlowCount:
+		for _, s := range samples {
+			point(float64(s.flows), s.time)
+		}
+	case target == targetNewConns:
+		for _, s := range samples {
+			point(float64(s.newConn), s.time)
+		}
+	case strings.HasPrefix(target, targetBytes):
+		host := strings.TrimPrefix(target, targetBytes)
+		for _, s := range samples {
+			point(float64(hostValue(s, host)), s.time)
+		}
+	case strings.HasPrefix(target, targetThroughput):
+		host := strings.TrimPrefix(target, targetThroughput)
+		rate(func(s sample) uint64 { return hostValue(s, host) })
+	case strings.HasPrefix(target, targetUpload):
+		host := strings.TrimPrefix(target, targetUpload)
+		rate(func(s sample) uint64 { return s.upload[host] })
+	case strings.HasPrefix(target, targetDownload):
+		host := strings.TrimPrefix(target, targetDownload)
+		rate(func(s sample) uint64 { return s.download[host] })
+	default:
+		return ts, false
+	}
+	return ts, true
+}
+
+func downsample(points [][2]float64, maxPoints int) [][2]float64 {
+	if maxPoints <= 0 || len(points) <= maxPoints {
+		return points
+	}
+	step := (len(points) + maxPoints - 1) / maxPoints
+	out := make([][2]float64, 0, maxPoints)
+	for i := 0; i < len(points); i += step {
+		out = append(out, points[i])
+	}
+	return out
+}
+
+func (s *Server) topTalkersTable() table {
+	type talker struct {
+		name  string
+		sent  uint64
+		recv  uint64
+		flows int
+	}
+	talkers := make(map[string]*talker)
+	get := func(addr string, hosts []string) *talker {
+		t, ok := talkers[addr]
+		if !ok {
+			t = &talker{}
+			talkers[addr] = t
+		}
+		if t.name == "" {
+			t.name = firstHost(hosts)
+		}
+		return t
+	}
+	for _, c := range s.Tracker.Data.ToSilce() {
+		src := get(c.Saddr, c.SHost)
+		src.sent += c.TxBytes
+		src.recv += c.RxBytes
+		src.flows++
+		dst := get(c.Daddr, c.DHost)
+		dst.sent += c.RxBytes
+		dst.recv += c.TxBytes
+		dst.flows++
+	}
+
+	t := table{
+		Type: "table",
+		Columns: []tableColumn{
+			{"Address", "string"}, {"Host", "string"}, {"Sent bytes", "number"},
+			{"Received bytes", "number"}, {"Total bytes", "number"}, {"Flows", "number"},
+		},
+		Rows: [][]any{},
+	}
+	for addr, tk := range talkers {
+		t.Rows = append(t.Rows, []any{addr, tk.name, tk.sent, tk.recv, tk.sent + tk.recv, tk.flows})
+	}
+	sort.Slice(t.Rows, func(i, j int) bool { return t.Rows[i][4].(uint64) > t.Rows[j][4].(uint64) })
+	return t
+}
+
+func (s *Server) internetTable() table {
+	hosts, _ := internetStats(s.Tracker.Data.ToSilce())
+	t := table{
+		Type: "table",
+		Columns: []tableColumn{
+			{"Address", "string"}, {"Host", "string"}, {"Upload bytes", "number"}, {"Download bytes", "number"},
+			{"Upload bytes/s", "number"}, {"Download bytes/s", "number"}, {"Flows", "number"},
+		},
+		Rows: [][]any{},
+	}
+	for _, h := range hosts {
+		t.Rows = append(t.Rows, []any{
+			h.Addr, firstHost(h.Names), h.UploadBytes, h.DownloadBytes, h.UploadBytesPerSec, h.DownloadBytesPerSec, h.Flows,
+		})
+	}
+	return t
+}
+
+func (s *Server) scopesTable() table {
+	t := table{
+		Type:    "table",
+		Columns: []tableColumn{{"Scope", "string"}, {"Flows", "number"}, {"Bytes", "number"}, {"Packets", "number"}},
+		Rows:    [][]any{},
+	}
+	for _, sc := range scopeStats(s.Tracker.Data.ToSilce()) {
+		t.Rows = append(t.Rows, []any{sc.Scope, sc.Flows, sc.Bytes, sc.Packets})
+	}
+	return t
+}
+
+func (s *Server) flowsTable() table {
+	conns := s.Tracker.Data.ToSilce()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Bytes() > conns[j].Bytes() })
+
+	t := table{
+		Type: "table",
+		Columns: []tableColumn{
+			{"Protocol", "string"}, {"Source", "string"}, {"Source port", "number"}, {"Source host", "string"},
+			{"Destination", "string"}, {"Destination port", "number"}, {"Destination host", "string"},
+			{"Family", "string"}, {"Interface", "string"}, {"Rx packets", "number"}, {"Rx bytes", "number"},
+			{"Tx packets", "number"}, {"Tx bytes", "number"},
+		},
+		Rows: [][]any{},
+	}
+	for _, c := range conns {
+		t.Rows = append(t.Rows, []any{
+			network.ProtoName(c.Proto), c.Saddr, c.Sport, firstHost(c.SHost),
+			c.Daddr, c.Dport, firstHost(c.DHost), familyLabel(c.Type), c.Interface, c.RxPackets, c.RxBytes, c.TxPackets, c.TxBytes,
+		})
+	}
+	return t
+}
+
+func (s *Server) annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	var req grafanaAnnotationQuery
+	if !decodePost(w, r, &req) {
+		return
+	}
+
+	resp := []annotation{}
+	for _, n := range s.History.newConnections(req.Range.From, req.Range.To) {
+		resp = append(resp, annotation{
+			Annotation: req.Annotation,
+			Time:       n.time.UnixMilli(),
+			Title:      "New connection",
+			Text:       connectionText(n.conn),
+			Tags:       []string{familyLabel(n.conn.Type)},
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func connectionText(c ct.Connection) string {
+	src := net.JoinHostPort(c.Saddr, strconv.Itoa(int(c.Sport)))
+	dst := net.JoinHostPort(c.Daddr, strconv.Itoa(int(c.Dport)))
+	if h := firstHost(c.SHost); h != "" {
+		src += " (" + h + ")"
+	}
+	if h := firstHost(c.DHost); h != "" {
+		dst += " (" + h + ")"
+	}
+	return network.ProtoName(c.Proto) + " " + src + " -> " + dst
+}
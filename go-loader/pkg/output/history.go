@@ -0,0 +1,124 @@
+package output
+
+import (
+	"sync"
+	"time"
+
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+type sample struct {
+	time    time.Time
+	bytes   uint64
+	packets uint64
+	flows   int
+	newConn int
+	hosts   map[string]uint64
+	// upload and download are the bytes between each local host and the
+	// internet, the sum of all of them under hostTotal.
+	upload   map[string]uint64
+	download map[string]uint64
+}
+
+type newConnection struct {
+	time time.Time
+	conn ct.Connection
+}
+
+// History keeps a bounded in-memory series of tracker totals so the Grafana
+// endpoints can answer time range queries.
+type History struct {
+	mu         sync.RWMutex
+	resolution time.Duration
+	retention  time.Duration
+	perHost    bool
+	samples    []sample
+	newConns   []newConnection
+	seen       map[string]struct{}
+}
+
+// NewHistory returns a History sampling every resolution for retention.
+// Without perHost it only keeps the flow counts and the new connections,
+// the byte totals being served from the series store.
+func NewHistory(resolution, retention time.Duration, perHost bool) *History {
+	return &History{
+		resolution: resolution,
+		retention:  retention,
+		perHost:    perHost,
+	}
+}
+
+// Record adds a sample of conns taken at now. Calls closer together than the
+// resolution are ignored.
+func (h *History) Record(now time.Time, conns []ct.Connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n := len(h.samples); n > 0 && now.Sub(h.samples[n-1].time) < h.resolution {
+		return
+	}
+
+	s := sample{time: now, flows: len(conns)}
+	if h.perHost {
+		s.hosts = make(map[string]uint64)
+		s.upload = make(map[string]uint64)
+		s.download = make(map[string]uint64)
+	}
+	seen := make(map[string]struct{}, len(conns))
+	for _, c := range conns {
+		s.bytes += c.Bytes()
+		s.packets += c.Packets()
+		if h.perHost {
+			s.hosts[c.Saddr] += c.Bytes()
+			s.hosts[c.Daddr] += c.Bytes()
+			if f, ok := internetTraffic(c); ok {
+				s.upload[f.addr] += f.up.Bytes()
+				s.upload[hostTotal] += f.up.Bytes()
+				s.download[f.addr] += f.down.Bytes()
+				s.download[hostTotal] += f.down.Bytes()
+			}
+		}
+
+		id := ct.FlowID(c)
+		seen[id] = struct{}{}
+		// The first sample only establishes what already exists.
+		if _, ok := h.seen[id]; !ok && h.seen != nil {
+			s.newConn++
+			h.newConns = append(h.newConns, newConnection{time: now, conn: c})
+		}
+	}
+	h.seen = seen
+	h.samples = append(h.samples, s)
+
+	cutoff := now.Add(-h.retention)
+	for len(h.samples) > 0 && h.samples[0].time.Before(cutoff) {
+		h.samples = h.samples[1:]
+	}
+	for len(h.newConns) > 0 && h.newConns[0].time.Before(cutoff) {
+		h.newConns = h.newConns[1:]
+	}
+}
+
+func (h *History) between(from, to time.Time) []sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []sample
+	for _, s := range h.samples {
+		if !s.time.Before(from) && !s.time.After(to) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (h *History) newConnections(from, to time.Time) []newConnection {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var out []newConnection
+	for _, n := range h.newConns {
+		if !n.time.Before(from) && !n.time.After(to) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
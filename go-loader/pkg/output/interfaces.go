@@ -0,0 +1,99 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+// InterfaceStats is the total of the flows counted on one interface.
+type InterfaceStats struct {
+	Interface string `json:"interface"`
+	Ifindex   uint32 `json:"ifindex"`
+	Flows     int    `json:"flows"`
+	ct.ConnectionStats
+}
+
+type interfacesResponse struct {
+	Interfaces []InterfaceStats `json:"interfaces"`
+	Total      InterfaceStats   `json:"total"`
+}
+
+// filterInterfaces keeps the connections seen on one of the comma separated
+// interfaces of the interface query parameter, all of them when it is empty.
+func filterInterfaces(conns []ct.Connection, r *http.Request) []ct.Connection {
+	param := r.URL.Query().Get("interface")
+	if param == "" {
+		return conns
+	}
+	names := strings.Split(param, ",")
+	out := conns[:0]
+	for _, c := range conns {
+		if slices.Contains(names, c.Interface) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func interfaceStats(conns []ct.Connection) ([]InterfaceStats, InterfaceStats) {
+	byName := make(map[string]*InterfaceStats)
+	total := InterfaceStats{Interface: "total"}
+	for _, c := range conns {
+		s, ok := byName[c.Interface]
+		if !ok {
+			s = &InterfaceStats{Interface: c.Interface, Ifindex: c.Ifindex}
+			byName[c.Interface] = s
+		}
+		for _, agg := range []*InterfaceStats{s, &total} {
+			agg.Flows++
+			agg.RxPackets += c.RxPackets
+			agg.RxBytes += c.RxBytes
+			agg.TxPackets += c.TxPackets
+			agg.TxBytes += c.TxBytes
+		}
+	}
+
+	out := make([]InterfaceStats, 0, len(byName))
+	for _, s := range byName {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Interface < out[j].Interface })
+	return out, total
+}
+
+func (s *Server) interfacesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	ifaces, total := interfaceStats(filterInterfaces(s.Tracker.Data.ToSilce(), r))
+	writeJSON(w, interfacesResponse{Interfaces: ifaces, Total: total})
+}
+
+// WriteInterfaceMetrics renders the per interface totals, they are not
+// affected by the top-N and label options. They are sums over the tracked
+// flows, which expire, so gauges.
+func WriteInterfaceMetrics(w io.Writer, conns []ct.Connection) {
+	ifaces, _ := interfaceStats(conns)
+	fmt.Fprintf(w, "# HELP hnt_interface_flows Number of flows currently tracked per interface.\n# TYPE hnt_interface_flows gauge\n")
+	for _, i := range ifaces {
+		fmt.Fprintf(w, "hnt_interface_flows{interface=\"%s\"} %d\n", escapeLabel(i.Interface), i.Flows)
+	}
+	fmt.Fprintf(w, "# HELP hnt_interface_bytes Bytes counted per interface.\n# TYPE hnt_interface_bytes gauge\n")
+	for _, i := range ifaces {
+		fmt.Fprintf(w, "hnt_interface_bytes{interface=\"%s\",direction=\"%s\"} %d\n", escapeLabel(i.Interface), directionReceived, i.RxBytes)
+		fmt.Fprintf(w, "hnt_interface_bytes{interface=\"%s\",direction=\"%s\"} %d\n", escapeLabel(i.Interface), directionSent, i.TxBytes)
+	}
+	fmt.Fprintf(w, "# HELP hnt_interface_packets Packets counted per interface.\n# TYPE hnt_interface_packets gauge\n")
+	for _, i := range ifaces {
+		fmt.Fprintf(w, "hnt_interface_packets{interface=\"%s\",direction=\"%s\"} %d\n", escapeLabel(i.Interface), directionReceived, i.RxPackets)
+		fmt.Fprintf(w, "hnt_interface_packets{interface=\"%s\",direction=\"%s\"} %d\n", escapeLabel(i.Interface), directionSent, i.TxPackets)
+	}
+}
@@ -0,0 +1,159 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+// InternetStats is the traffic between one local address and the internet,
+// upload being what it sent and download what it received.
+type InternetStats struct {
+	Addr            string   `json:"addr"`
+	Names           []string `json:"names,omitempty"`
+	Flows           int      `json:"flows"`
+	UploadBytes     uint64   `json:"upload_bytes"`
+	UploadPackets   uint64   `json:"upload_packets"`
+	DownloadBytes   uint64   `json:"download_bytes"`
+	DownloadPackets uint64   `json:"download_packets"`
+	// The rates are over the last minute.
+	UploadBytesPerSec   float64 `json:"upload_bytes_per_sec"`
+	DownloadBytesPerSec float64 `json:"download_bytes_per_sec"`
+}
+
+// ScopeStats is the total of the flows of one network.Scope.
+type ScopeStats struct {
+	Scope   string `json:"scope"`
+	Flows   int    `json:"flows"`
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+}
+
+type internetResponse struct {
+	Hosts  []InternetStats `json:"hosts"`
+	Total  InternetStats   `json:"total"`
+	Scopes []ScopeStats    `json:"scopes"`
+}
+
+// scopes is the order ScopeStats are listed in.
+var scopes = []string{network.ScopeLAN, network.ScopeOutbound, network.ScopeInbound, network.ScopeTransit}
+
+// internetFlow is a connection seen from its local end.
+type internetFlow struct {
+	addr     string
+	names    []string
+	up, down ct.ConnectionStats
+	// upRate and downRate are the bytes/s over the last minute.
+	upRate, downRate float64
+}
+
+// internetTraffic returns c from its local end, whichever end opened it. ok
+// is false unless c is between a local address and the internet.
+func internetTraffic(c ct.Connection) (internetFlow, bool) {
+	if c.Scope != network.ScopeOutbound && c.Scope != network.ScopeInbound {
+		return internetFlow{}, false
+	}
+	if network.IsLocal(c.Saddr) {
+		return internetFlow{c.Saddr, c.SHost, c.Sent(), c.Received(), c.Rates.TxBytesPerSec1m, c.Rates.RxBytesPerSec1m}, true
+	}
+	return internetFlow{c.Daddr, c.DHost, c.Received(), c.Sent(), c.Rates.RxBytesPerSec1m, c.Rates.TxBytesPerSec1m}, true
+}
+
+// internetStats sums the traffic with the internet per local address, the
+// busiest first.
+func internetStats(conns []ct.Connection) ([]InternetStats, InternetStats) {
+	byAddr := make(map[string]*InternetStats)
+	total := InternetStats{Addr: "total"}
+	for _, c := range conns {
+		f, ok := internetTraffic(c)
+		if !ok {
+			continue
+		}
+		s, ok := byAddr[f.addr]
+		if !ok {
+			s = &InternetStats{Addr: f.addr}
+			byAddr[f.addr] = s
+		}
+		if len(f.names) > 0 {
+			s.Names = f.names
+		}
+		for _, agg := range []*InternetStats{s, &total} {
+			agg.Flows++
+			agg.UploadBytes += f.up.Bytes()
+			agg.UploadPackets += f.up.Packets()
+			agg.UploadBytesPerSec += f.upRate
+			agg.DownloadBytes += f.down.Bytes()
+			agg.DownloadPackets += f.down.Packets()
+			agg.DownloadBytesPerSec += f.downRate
+		}
+	}
+
+	out := make([]InternetStats, 0, len(byAddr))
+	for _, s := range byAddr {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		bi := out[i].UploadBytes + out[i].DownloadBytes
+		bj := out[j].UploadBytes + out[j].DownloadBytes
+		if bi != bj {
+			return bi > bj
+		}
+		return out[i].Addr < out[j].Addr
+	})
+	return out, total
+}
+
+func scopeStats(conns []ct.Connection) []ScopeStats {
+	out := make([]ScopeStats, len(scopes))
+	for i, scope := range scopes {
+		out[i].Scope = scope
+	}
+	for _, c := range conns {
+		for i := range out {
+			if out[i].Scope == c.Scope {
+				out[i].Flows++
+				out[i].Bytes += c.Bytes()
+				out[i].Packets += c.Packets()
+			}
+		}
+	}
+	return out
+}
+
+func (s *Server) internetHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	conns := filterInterfaces(s.Tracker.Data.ToSilce(), r)
+	hosts, total := internetStats(conns)
+	writeJSON(w, internetResponse{Hosts: hosts, Total: total, Scopes: scopeStats(conns)})
+}
+
+// WriteInternetMetrics renders the traffic per scope and between each local
+// address and the internet, they are not affected by the top-N and label
+// options. Like the interface totals they are gauges.
+func WriteInternetMetrics(w io.Writer, conns []ct.Connection) {
+	fmt.Fprintf(w, "# HELP hnt_scope_bytes Bytes counted per flow scope.\n# TYPE hnt_scope_bytes gauge\n")
+	for _, s := range scopeStats(conns) {
+		fmt.Fprintf(w, "hnt_scope_bytes{scope=\"%s\"} %d\n", s.Scope, s.Bytes)
+	}
+	hosts, _ := internetStats(conns)
+	fmt.Fprintf(w, "# HELP hnt_internet_bytes Bytes between a local address and the internet.\n# TYPE hnt_internet_bytes gauge\n")
+	for _, h := range hosts {
+		labels := fmt.Sprintf("addr=\"%s\",host=\"%s\"", escapeLabel(h.Addr), escapeLabel(firstHost(h.Names)))
+		fmt.Fprintf(w, "hnt_internet_bytes{%s,direction=\"%s\"} %d\n", labels, directionSent, h.UploadBytes)
+		fmt.Fprintf(w, "hnt_internet_bytes{%s,direction=\"%s\"} %d\n", labels, directionReceived, h.DownloadBytes)
+	}
+	fmt.Fprintf(w, "# HELP hnt_internet_packets Packets between a local address and the internet.\n# TYPE hnt_internet_packets gauge\n")
+	for _, h := range hosts {
+		labels := fmt.Sprintf("addr=\"%s\",host=\"%s\"", escapeLabel(h.Addr), escapeLabel(firstHost(h.Names)))
+		fmt.Fprintf(w, "hnt_internet_packets{%s,direction=\"%s\"} %d\n", labels, directionSent, h.UploadPackets)
+		fmt.Fprintf(w, "hnt_internet_packets{%s,direction=\"%s\"} %d\n", labels, directionReceived, h.DownloadPackets)
+	}
+}
@@ -0,0 +1,222 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+// MetricsOptions keeps the number of exported series bounded on a busy LAN.
+type MetricsOptions struct {
+	// TopN only exports the N flows (or hosts) with the most bytes, 0 exports
+	// everything.
+	TopN int `json:"top_n"`
+	// AggregateByHost exports per address totals instead of per flow series.
+	AggregateByHost bool `json:"aggregate_by_host"`
+	// Labels is the allowlist of labels to keep, series that only differ by
+	// a dropped label are summed. Empty keeps every label.
+	Labels []string `json:"labels"`
+}
+
+var (
+	FlowLabels = []string{"saddr", "daddr", "sport", "dport", "proto", "shost", "dhost", "family", "interface", "direction"}
+	HostLabels = []string{"addr", "host", "family", "interface", "direction"}
+)
+
+// Values of the direction label of every hnt_* metric, seen from the
+// address, interface or local host the series is about.
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+type series struct {
+	labels  []string
+	bytes   uint64
+	packets uint64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func firstHost(hosts []string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(hosts[0], ".")
+}
+
+func familyLabel(t int) string {
+	if t == network.IPV6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// aggregate folds series with the same kept labels together, sorts them by
+// bytes and keeps the first topN.
+func aggregate(in []series, names, allow []string, topN int) ([]string, []series) {
+	var keep []int
+	var kept []string
+	for i, n := range names {
+		if len(allow) == 0 || slices.Contains(allow, n) {
+			keep = append(keep, i)
+			kept = append(kept, n)
+		}
+	}
+
+	byKey := make(map[string]*series)
+	var out []*series
+	for _, s := range in {
+		labels := make([]string, len(keep))
+		for i, k := range keep {
+			labels[i] = s.labels[k]
+		}
+		key := strings.Join(labels, "\x00")
+		if agg, ok := byKey[key]; ok {
+			agg.bytes += s.bytes
+			agg.packets += s.packets
+			continue
+		}
+		agg := &series{labels: labels, bytes: s.bytes, packets: s.packets}
+		byKey[key] = agg
+		out = append(out, agg)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].bytes > out[j].bytes })
+	if topN > 0 && len(out) > topN {
+		out = out[:topN]
+	}
+	res := make([]series, len(out))
+	for i, s := range out {
+		res[i] = *s
+	}
+	return kept, res
+}
+
+// flowSeries exports each flow twice, direction="sent" for what saddr sent
+// and direction="received" for what it received.
+func flowSeries(conns []ct.Connection) []series {
+	out := make([]series, 0, 2*len(conns))
+	for _, c := range conns {
+		labels := []string{
+			c.Saddr, c.Daddr, strconv.Itoa(int(c.Sport)), strconv.Itoa(int(c.Dport)), network.ProtoName(c.Proto),
+			firstHost(c.SHost), firstHost(c.DHost), familyLabel(c.Type), c.Interface,
+		}
+		out = append(out,
+			series{labels: append(slices.Clip(labels), directionReceived), bytes: c.RxBytes, packets: c.RxPackets},
+			series{labels: append(slices.Clip(labels), directionSent), bytes: c.TxBytes, packets: c.TxPackets},
+		)
+	}
+	return out
+}
+
+func hostSeries(conns []ct.Connection) []series {
+	out := make([]series, 0, 4*len(conns))
+	for _, c := range conns {
+		family := familyLabel(c.Type)
+		out = append(out,
+			series{labels: []string{c.Saddr, firstHost(c.SHost), family, c.Interface, directionSent}, bytes: c.TxBytes, packets: c.TxPackets},
+			series{labels: []string{c.Saddr, firstHost(c.SHost), family, c.Interface, directionReceived}, bytes: c.RxBytes, packets: c.RxPackets},
+			series{labels: []string{c.Daddr, firstHost(c.DHost), family, c.Interface, directionSent}, bytes: c.RxBytes, packets: c.RxPackets},
+			series{labels: []string{c.Daddr, firstHost(c.DHost), family, c.Interface, directionReceived}, bytes: c.TxBytes, packets: c.TxPackets},
+		)
+	}
+	return out
+}
+
+func writeSeries(w io.Writer, name, typ, help string, names []string, ss []series, value func(series) uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range ss {
+		pairs := make([]string, len(names))
+		for i, n := range names {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, n, escapeLabel(s.labels[i]))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", name, strings.Join(pairs, ","), value(s))
+	}
+}
+
+// WriteMetrics renders the tracker counters in the Prometheus text format.
+// Once summed per host or over dropped labels, or cut to the top N, a series
+// goes down when a flow expires or falls out of the cut, those are exported
+// as gauges without the _total suffix.
+func WriteMetrics(w io.Writer, conns []ct.Connection, opts MetricsOptions) {
+	prefix, names, in := "hnt_flow", FlowLabels, flowSeries(conns)
+	if opts.AggregateByHost {
+		prefix, names, in = "hnt_host", HostLabels, hostSeries(conns)
+	}
+	kept, ss := aggregate(in, names, opts.Labels, opts.TopN)
+	suffix, typ := "_total", "counter"
+	if opts.AggregateByHost || len(kept) < len(names) || opts.TopN > 0 {
+		suffix, typ = "", "gauge"
+	}
+
+	fmt.Fprintf(w, "# HELP hnt_tracked_flows Number of flows currently tracked.\n# TYPE hnt_tracked_flows gauge\nhnt_tracked_flows %d\n", len(conns))
+	fmt.Fprintf(w, "# HELP hnt_exported_series Number of series exported per metric after aggregation and top-N.\n# TYPE hnt_exported_series gauge\nhnt_exported_series %d\n", len(ss))
+	writeSeries(w, prefix+"_bytes"+suffix, typ, "Bytes counted by the tracker.", kept, ss, func(s series) uint64 { return s.bytes })
+	writeSeries(w, prefix+"_packets"+suffix, typ, "Packets counted by the tracker.", kept, ss, func(s series) uint64 { return s.packets })
+}
+
+// WriteHarvestMetrics renders how long reading the kernel maps takes.
+func WriteHarvestMetrics(w io.Writer, stats []ct.HarvestStats) {
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Family < stats[j].Family })
+	gauges := []struct {
+		name, help string
+		value      func(ct.HarvestStats) string
+	}{
+		{"hnt_harvest_duration_seconds", "Duration of the last kernel map harvest.", func(s ct.HarvestStats) string { return fmt.Sprint(s.Duration.Seconds()) }},
+		{"hnt_harvest_entries", "Entries read by the last kernel map harvest.", func(s ct.HarvestStats) string { return fmt.Sprint(s.Entries) }},
+		{"hnt_harvest_errors", "Entries that could not be read by the last kernel map harvest.", func(s ct.HarvestStats) string { return fmt.Sprint(s.Errors) }},
+		{"hnt_harvest_batched", "1 if the last kernel map harvest used batch lookups.", func(s ct.HarvestStats) string {
+			if s.Batched {
+				return "1"
+			}
+			return "0"
+		}},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{family=\"%s\"} %s\n", g.name, familyLabel(s.Family), g.value(s))
+		}
+	}
+}
+
+// WriteBlocklistMetrics renders the drop counters of the blocklist rules.
+func WriteBlocklistMetrics(w io.Writer, stats []rules.RuleStats) {
+	fmt.Fprintf(w, "# HELP hnt_blocklist_dropped_packets_total Packets dropped per blocklist rule.\n# TYPE hnt_blocklist_dropped_packets_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "hnt_blocklist_dropped_packets_total{rule=\"%s\"} %d\n", escapeLabel(s.Name), s.Packets)
+	}
+	fmt.Fprintf(w, "# HELP hnt_blocklist_dropped_bytes_total Bytes dropped per blocklist rule.\n# TYPE hnt_blocklist_dropped_bytes_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(w, "hnt_blocklist_dropped_bytes_total{rule=\"%s\"} %d\n", escapeLabel(s.Name), s.Bytes)
+	}
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	conns := filterInterfaces(s.Tracker.Data.ToSilce(), r)
+	WriteMetrics(w, conns, s.Metrics)
+	WriteInterfaceMetrics(w, conns)
+	WriteInternetMetrics(w, conns)
+	WriteHarvestMetrics(w, s.Tracker.HarvestStats())
+	if s.Blocklist != nil {
+		WriteBlocklistMetrics(w, s.Blocklist.Stats())
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/alert"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	ts "github.com/akiasmaka/home-network-tracker/go-loader/pkg/series"
 	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
 )
 
@@ -12,12 +15,24 @@ type Server struct {
 	Addr    string `json:"addr"`
 	Port    int    `json:"port"`
 	Tracker *ct.ConnectionTracker
+	Metrics MetricsOptions `json:"metrics"`
+	History *History
+	// Blocklist is optional, its drop counters are exported on /metrics and
+	// it is managed through /api/v1/rules.
+	Blocklist *rules.Blocklist
+	// Alerts are listed on /api/v1/alerts.
+	Alerts *alert.Engine
+	// Series is the history served on /api/v1/series, nil when disabled.
+	Series *ts.Store
+	// APIToken is the bearer token of /api/v1/rules, which is disabled when
+	// it is empty.
+	APIToken string `json:"-"`
 }
 
 func enableCors(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 }
 
 func (s *Server) Serve() {
@@ -29,11 +44,23 @@ func (s *Server) Serve() {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		data := s.Tracker.Data.ToSilce()
+		data := filterInterfaces(s.Tracker.Data.ToSilce(), r)
 		json.NewEncoder(w).Encode(data)
 	}
 
 	http.HandleFunc("/data", f)
+	http.HandleFunc("/interfaces", s.interfacesHandler)
+	http.HandleFunc("/internet", s.internetHandler)
+	http.HandleFunc("/metrics", s.metricsHandler)
+	http.HandleFunc(rulesPath, s.rulesHandler)
+	http.HandleFunc(rulesPath+"/", s.rulesHandler)
+	http.HandleFunc(alertsPath, s.alertsHandler)
+	http.HandleFunc(topPath, s.topHandler)
+	http.HandleFunc(seriesPath, s.seriesHandler)
+	http.HandleFunc("/", s.grafanaRootHandler)
+	http.HandleFunc("/search", s.searchHandler)
+	http.HandleFunc("/query", s.queryHandler)
+	http.HandleFunc("/annotations", s.annotationsHandler)
 	url := fmt.Sprintf("%s:%d", s.Addr, s.Port)
 	fmt.Println("Server is running on ", url)
 	if err := http.ListenAndServe(url, nil); err != nil {
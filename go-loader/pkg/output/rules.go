@@ -0,0 +1,129 @@
+package output
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+)
+
+const rulesPath = "/api/v1/rules"
+
+// ruleRequest is the body of POST /api/v1/rules. For is a duration such as
+// "2h" after which the rule expires, an alternative to an absolute Expires.
+type ruleRequest struct {
+	rules.Rule
+	For string `json:"for"`
+}
+
+// authorized checks the bearer token of r. The rules API is refused
+// altogether when no token is configured.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.APIToken == "" {
+		http.Error(w, "The rules API is disabled, set http.api_token to enable it", http.StatusForbidden)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.APIToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="home-network-tracker"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// rulesHandler serves GET /api/v1/rules[/<name>], POST /api/v1/rules and
+// DELETE /api/v1/rules/<name>.
+func (s *Server) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+	if s.Blocklist == nil {
+		http.Error(w, "No blocklist is loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, rulesPath), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, s.Blocklist.Stats())
+	case r.Method == http.MethodGet:
+		stats, ok := s.ruleStats(name)
+		if !ok {
+			http.Error(w, rules.ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, stats)
+	case r.Method == http.MethodPost && name == "":
+		s.addRule(w, r)
+	case r.Method == http.MethodDelete && name != "":
+		if err := s.Blocklist.Delete(name); err != nil {
+			http.Error(w, err.Error(), ruleErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) addRule(w http.ResponseWriter, r *http.Request) {
+	var req ruleRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.For != "" {
+		d, err := time.ParseDuration(req.For)
+		if err != nil || d <= 0 {
+			http.Error(w, "for: must be a positive duration such as 2h", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().Add(d).Truncate(time.Second)
+		req.Expires = &expires
+	}
+
+	if err := s.Blocklist.Add(req.Rule); err != nil {
+		http.Error(w, err.Error(), ruleErrorStatus(err))
+		return
+	}
+	stats, _ := s.ruleStats(req.Name)
+	w.Header().Set("Location", rulesPath+"/"+req.Name)
+	// Headers set after WriteHeader are not sent.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, stats)
+}
+
+func (s *Server) ruleStats(name string) (rules.RuleStats, bool) {
+	for _, stats := range s.Blocklist.Stats() {
+		if stats.Name == name {
+			return stats, true
+		}
+	}
+	return rules.RuleStats{}, false
+}
+
+func ruleErrorStatus(err error) int {
+	var invalid *rules.InvalidError
+	switch {
+	case errors.As(err, &invalid), errors.Is(err, rules.ErrExpiredRule):
+		return http.StatusBadRequest
+	case errors.Is(err, rules.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, rules.ErrExists), errors.Is(err, rules.ErrConfigRule):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,109 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ts "github.com/akiasmaka/home-network-tracker/go-loader/pkg/series"
+)
+
+const (
+	seriesPath        = "/api/v1/series"
+	defaultSeriesSpan = time.Hour
+)
+
+// parseSeriesTime reads the from and to parameters: RFC 3339, unix seconds
+// or a negative duration like -6h, relative to now.
+func parseSeriesTime(v string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(v, "-") {
+		if d, err := time.ParseDuration(v); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339, unix seconds nor a negative duration", v)
+	}
+	return t, nil
+}
+
+// seriesHandler serves GET /api/v1/series?host=&from=&to=&step=&flows=true,
+// what a host sent and received between from (an hour ago by default) and to
+// (now), in steps of step, picked from the range when empty.
+func (s *Server) seriesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Series == nil {
+		http.Error(w, "The history is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	params := r.URL.Query()
+	now := time.Now()
+	q := ts.Query{Host: params.Get("host"), To: now}
+	if q.Host == "" {
+		http.Error(w, "host: missing", http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("to"); v != "" {
+		t, err := parseSeriesTime(v, now)
+		if err != nil {
+			http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-defaultSeriesSpan)
+	if v := params.Get("from"); v != "" {
+		t, err := parseSeriesTime(v, now)
+		if err != nil {
+			http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.From = t
+	}
+	if !q.To.After(q.From) {
+		http.Error(w, "from: must be before to", http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "step: must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		q.Step = d
+	}
+	if v := params.Get("flows"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "flows: must be true or false", http.StatusBadRequest)
+			return
+		}
+		q.Flows = b
+	}
+
+	res, err := s.Series.Query(q)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ts.ErrTooManyPoints) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, res)
+}
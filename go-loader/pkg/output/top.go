@@ -0,0 +1,109 @@
+package output
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+
+	ct "github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+const (
+	topPath         = "/api/v1/top"
+	defaultTopLimit = 10
+	maxTopLimit     = 1000
+)
+
+// topRates are the rates flows can be ranked by, per window and metric.
+var topRates = map[string]map[string]func(r ct.Rates) float64{
+	"now": {
+		"bytes":   func(r ct.Rates) float64 { return r.BytesPerSec },
+		"packets": func(r ct.Rates) float64 { return r.PacketsPerSec },
+	},
+	"1m": {
+		"bytes":   func(r ct.Rates) float64 { return r.BytesPerSec1m },
+		"packets": func(r ct.Rates) float64 { return r.PacketsPerSec1m },
+	},
+	"5m": {
+		"bytes":   func(r ct.Rates) float64 { return r.BytesPerSec5m },
+		"packets": func(r ct.Rates) float64 { return r.PacketsPerSec5m },
+	},
+	"peak": {
+		"bytes":   func(r ct.Rates) float64 { return r.PeakBytesPerSec },
+		"packets": func(r ct.Rates) float64 { return r.PeakPacketsPerSec },
+	},
+}
+
+// topKey returns what flows are ranked by on /api/v1/top: by is rate (the
+// default), bytes or packets (lifetime totals). Rates are of metric, bytes
+// or packets, over window, 1m by default.
+func topKey(by, metric, window string) (func(c ct.Connection) float64, bool) {
+	switch by {
+	case "bytes":
+		return func(c ct.Connection) float64 { return float64(c.Bytes()) }, true
+	case "packets":
+		return func(c ct.Connection) float64 { return float64(c.Packets()) }, true
+	case "", "rate":
+	default:
+		return nil, false
+	}
+	if metric == "" {
+		metric = "bytes"
+	}
+	if window == "" {
+		window = "1m"
+	}
+	rate, ok := topRates[window][metric]
+	if !ok {
+		return nil, false
+	}
+	return func(c ct.Connection) float64 { return rate(c.Rates) }, true
+}
+
+// topHandler serves GET /api/v1/top?by=rate&metric=bytes&window=1m&limit=10,
+// the busiest flows first. interface filters the flows like on /data.
+func (s *Server) topHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(w)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	key, ok := topKey(q.Get("by"), q.Get("metric"), q.Get("window"))
+	if !ok {
+		http.Error(w, "by must be rate, bytes or packets, metric bytes or packets and window now, 1m, 5m or peak", http.StatusBadRequest)
+		return
+	}
+	limit := defaultTopLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTopLimit {
+			http.Error(w, "limit: must be between 1 and "+strconv.Itoa(maxTopLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	conns := filterInterfaces(s.Tracker.Data.ToSilce(), r)
+	slices.SortFunc(conns, func(a, b ct.Connection) int {
+		ka, kb := key(a), key(b)
+		switch {
+		case ka > kb:
+			return -1
+		case ka < kb:
+			return 1
+		}
+		return 0
+	})
+	if len(conns) > limit {
+		conns = conns[:limit]
+	}
+	if conns == nil {
+		conns = []ct.Connection{}
+	}
+	writeJSON(w, conns)
+}
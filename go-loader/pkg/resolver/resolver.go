@@ -0,0 +1,162 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type Options struct {
+	// Server is the host:port of the DNS server used for PTR lookups, empty
+	// uses the system resolver.
+	Server  string
+	Timeout time.Duration
+	Workers int
+	// QueueSize bounds the lookups waiting for a worker, addresses that don't
+	// fit are retried on their next Lookup.
+	QueueSize   int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+type entry struct {
+	names   []string
+	expires time.Time
+}
+
+// Resolver does reverse DNS lookups in the background. Lookup never blocks,
+// it answers from the cache and queues the address when the answer is
+// missing or expired.
+type Resolver struct {
+	opts   Options
+	lookup func(ctx context.Context, addr string) ([]string, error)
+	queue  chan string
+
+	mu      sync.Mutex
+	cache   map[string]entry
+	pending map[string]struct{}
+
+	l *zap.Logger
+}
+
+func New(opts Options, l *zap.Logger) *Resolver {
+	r := &Resolver{
+		opts:    opts,
+		queue:   make(chan string, opts.QueueSize),
+		cache:   make(map[string]entry),
+		pending: make(map[string]struct{}),
+		l:       l,
+	}
+
+	res := net.DefaultResolver
+	if opts.Server != "" {
+		res = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, opts.Server)
+			},
+		}
+	}
+	r.lookup = res.LookupAddr
+	return r
+}
+
+// Run starts the workers and blocks until ctx is done.
+func (r *Resolver) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(r.opts.TTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.prune(time.Now())
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// Lookup returns the cached names of addr. ok is false while addr has never
+// been resolved, an address without PTR record returns no names and true.
+// Expired names are still returned while they are resolved again.
+func (r *Resolver) Lookup(addr string) (names []string, ok bool) {
+	r.mu.Lock()
+	e, ok := r.cache[addr]
+	if ok && time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		return e.names, true
+	}
+	if _, queued := r.pending[addr]; queued {
+		r.mu.Unlock()
+		return e.names, ok
+	}
+	r.pending[addr] = struct{}{}
+	r.mu.Unlock()
+
+	select {
+	case r.queue <- addr:
+	default:
+		r.l.Sugar().Debugf("Resolver queue full, dropping lookup of %s", addr)
+		r.mu.Lock()
+		delete(r.pending, addr)
+		r.mu.Unlock()
+	}
+	return e.names, ok
+}
+
+func (r *Resolver) work(ctx context.Context) {
+	for {
+		select {
+		case addr := <-r.queue:
+			r.resolve(ctx, addr)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, addr string) {
+	lookupCtx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	names, err := r.lookup(lookupCtx, addr)
+	cancel()
+
+	ttl := r.opts.TTL
+	if err != nil {
+		r.l.Sugar().Debugf("lookup for %s failed with: %s", addr, err)
+		names, ttl = nil, r.opts.NegativeTTL
+	}
+	for i, n := range names {
+		names[i] = strings.TrimSuffix(n, ".")
+	}
+
+	r.mu.Lock()
+	r.cache[addr] = entry{names: names, expires: time.Now().Add(ttl)}
+	delete(r.pending, addr)
+	r.mu.Unlock()
+}
+
+// prune drops the entries nobody asked to refresh for a whole TTL, the
+// address is most likely gone from the tracker.
+func (r *Resolver) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, e := range r.cache {
+		if now.Sub(e.expires) > r.opts.TTL {
+			delete(r.cache, addr)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"go.uber.org/zap"
+)
+
+// Blocklist keeps the blocklist maps of xdp.bpf.c in line with the rules of
+// the config file and the ones added at runtime. Every rule gets an id, the
+// index of its drop counters, which it keeps for as long as a rule with its
+// name is applied.
+type Blocklist struct {
+	maps  map[int]kernelmap.KernelMap
+	drops kernelmap.KernelMap
+
+	mu sync.Mutex
+	// config comes from the config file, runtime from Add and Restore.
+	config   []Rule
+	runtime  []Rule
+	ids      map[string]uint32
+	onChange func()
+
+	l *zap.Logger
+}
+
+// Sources of a rule.
+const (
+	SourceConfig  = "config"
+	SourceRuntime = "api"
+)
+
+var (
+	ErrExists      = errors.New("a rule with this name already exists")
+	ErrNotFound    = errors.New("no such rule")
+	ErrConfigRule  = errors.New("rule comes from the config file")
+	ErrExpiredRule = errors.New("rule is already expired")
+)
+
+// RuleStats is a rule and what it dropped since it was added.
+type RuleStats struct {
+	Rule
+	Source string `json:"source"`
+	DropStats
+}
+
+// NewBlocklist expects the LPM tries keyed by network.IPV4 and network.IPV6,
+// and the array of drop counters.
+func NewBlocklist(maps map[int]kernelmap.KernelMap, drops kernelmap.KernelMap, l *zap.Logger) *Blocklist {
+	return &Blocklist{
+		maps:  maps,
+		drops: drops,
+		ids:   make(map[string]uint32),
+		l:     l,
+	}
+}
+
+// OnChange registers fn to be called after the runtime rules changed, to
+// persist them.
+func (b *Blocklist) OnChange(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+func (b *Blocklist) changed() {
+	b.mu.Lock()
+	fn := b.onChange
+	b.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// Apply replaces the config rules and reconciles the kernel maps. Invalid
+// rules leave the kernel untouched. A runtime rule named like a config rule,
+// added through the API before the name was in the config file, is dropped.
+func (b *Blocklist) Apply(rules []Rule) error {
+	var dropped []string
+	err := func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		runtime := slices.DeleteFunc(slices.Clone(b.runtime), func(r Rule) bool {
+			if slices.ContainsFunc(rules, func(c Rule) bool { return c.Name == r.Name }) {
+				dropped = append(dropped, r.Name)
+				return true
+			}
+			return false
+		})
+		if err := b.reconcile(rules, runtime); err != nil {
+			return err
+		}
+		b.config, b.runtime = rules, runtime
+		return nil
+	}()
+	if err != nil || len(dropped) == 0 {
+		return err
+	}
+	for _, name := range dropped {
+		b.l.Sugar().Warnf("Runtime blocklist rule %s dropped, the config has a rule of the same name", name)
+	}
+	b.changed()
+	return nil
+}
+
+// Add applies a runtime rule on top of the others.
+func (b *Blocklist) Add(r Rule) error {
+	err := func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.find(r.Name) != "" {
+			return ErrExists
+		}
+		if r.expired(time.Now()) {
+			return ErrExpiredRule
+		}
+		runtime := append(slices.Clip(b.runtime), r)
+		if err := b.reconcile(b.config, runtime); err != nil {
+			return err
+		}
+		b.runtime = runtime
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	b.changed()
+	return nil
+}
+
+// Delete removes the runtime rule called name, config rules can only be
+// removed from the config file.
+func (b *Blocklist) Delete(name string) error {
+	err := func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		switch b.find(name) {
+		case "":
+			return ErrNotFound
+		case SourceConfig:
+			return ErrConfigRule
+		}
+		runtime := slices.DeleteFunc(slices.Clone(b.runtime), func(r Rule) bool { return r.Name == name })
+		if err := b.reconcile(b.config, runtime); err != nil {
+			return err
+		}
+		b.runtime = runtime
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	b.changed()
+	return nil
+}
+
+// Restore sets the runtime rules of a snapshot, they are written to the
+// kernel by the next Apply. Expired rules are dropped.
+func (b *Blocklist) Restore(rules []Rule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.runtime = slices.DeleteFunc(slices.Clone(rules), func(r Rule) bool { return r.expired(now) })
+}
+
+// Runtime returns the rules added at runtime, they are what snapshots keep.
+func (b *Blocklist) Runtime() []Rule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.runtime)
+}
+
+// Run removes the rules as they expire until ctx is done.
+func (b *Blocklist) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if b.expire(now) {
+				b.changed()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+const expiryCheckInterval = time.Second
+
+// expire reconciles without the rules expired at now, it reports whether
+// runtime rules were removed.
+func (b *Blocklist) expire(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	expired := func(r Rule) bool { return r.expired(now) }
+	if !slices.ContainsFunc(b.config, expired) && !slices.ContainsFunc(b.runtime, expired) {
+		return false
+	}
+	config := slices.DeleteFunc(slices.Clone(b.config), expired)
+	runtime := slices.DeleteFunc(slices.Clone(b.runtime), expired)
+	// The rules are kept until the kernel maps are reconciled, the next
+	// check tries again.
+	if err := b.reconcile(config, runtime); err != nil {
+		b.l.Sugar().Errorf("Failed to remove expired blocklist rules: %v", err)
+		return false
+	}
+	for _, r := range slices.Concat(b.config, b.runtime) {
+		if expired(r) {
+			b.l.Sugar().Infof("Blocklist rule %s expired", r.Name)
+		}
+	}
+	removed := len(runtime) != len(b.runtime)
+	b.config, b.runtime = config, runtime
+	return removed
+}
+
+// find returns the source of the rule called name, empty when there is none.
+func (b *Blocklist) find(name string) string {
+	match := func(r Rule) bool { return r.Name == name }
+	if slices.ContainsFunc(b.config, match) {
+		return SourceConfig
+	}
+	if slices.ContainsFunc(b.runtime, match) {
+		return SourceRuntime
+	}
+	return ""
+}
+
+// reconcile writes config and runtime to the kernel maps. New and changed
+// prefixes are written before the stale ones are deleted and unchanged ones
+// are left alone, so rules that stay never stop matching.
+func (b *Blocklist) reconcile(config, runtime []Rule) error {
+	now := time.Now()
+	active := slices.DeleteFunc(slices.Concat(config, runtime), func(r Rule) bool { return r.expired(now) })
+	compiled, err := compileAll(active)
+	if err != nil {
+		return err
+	}
+
+	ids, err := b.assignIDs(compiled)
+	if err != nil {
+		return err
+	}
+	want := make(map[int]map[string][]byte)
+	for _, e := range buildEntries(compiled, ids) {
+		if want[e.family()] == nil {
+			want[e.family()] = make(map[string][]byte)
+		}
+		want[e.family()][string(e.key())] = e.value()
+	}
+
+	var errs []error
+	var written, removed int
+	for family, m := range b.maps {
+		for k, v := range want[family] {
+			key := []byte(k)
+			if cur, err := m.GetValue(unsafe.Pointer(&key[0])); err == nil && bytes.Equal(cur, v) {
+				continue
+			}
+			if err := m.Update(unsafe.Pointer(&key[0]), unsafe.Pointer(&v[0])); err != nil {
+				errs = append(errs, fmt.Errorf("failed to write blocklist entry: %w", err))
+				continue
+			}
+			written++
+		}
+
+		var stale [][]byte
+		err := kernelmap.Iterate(m, func(key []byte) bool {
+			if _, ok := want[family][string(key)]; !ok {
+				stale = append(stale, bytes.Clone(key))
+			}
+			return true
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list blocklist entries: %w", err))
+		}
+		for _, key := range stale {
+			if err := m.DeleteKey(unsafe.Pointer(&key[0])); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete blocklist entry: %w", err))
+				continue
+			}
+			removed++
+		}
+	}
+
+	b.ids = ids
+	b.l.Sugar().Infof("Blocklist has %d rules, %d prefixes written and %d removed", len(active), written, removed)
+	return errors.Join(errs...)
+}
+
+// assignIDs keeps the ids of the rules already applied and gives the new
+// ones the lowest free ids, with their counters reset.
+func (b *Blocklist) assignIDs(compiled []compiledRule) (map[string]uint32, error) {
+	ids := make(map[string]uint32, len(compiled))
+	used := make(map[uint32]bool)
+	for _, c := range compiled {
+		if id, ok := b.ids[c.Name]; ok {
+			ids[c.Name] = id
+			used[id] = true
+		}
+	}
+
+	var next uint32
+	for _, c := range compiled {
+		if _, ok := ids[c.Name]; ok {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		zero := DropStats{}.KernelValue()
+		if err := b.drops.Update(unsafe.Pointer(&next), unsafe.Pointer(&zero[0])); err != nil {
+			return nil, fmt.Errorf("failed to reset the drop counters of %s: %w", c.Name, err)
+		}
+		ids[c.Name] = next
+		used[next] = true
+	}
+	return ids, nil
+}
+
+// Stats returns the active rules, config ones first, with their drop
+// counters.
+func (b *Blocklist) Stats() []RuleStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]RuleStats, 0, len(b.config)+len(b.runtime))
+	for _, set := range []struct {
+		source string
+		rules  []Rule
+	}{{SourceConfig, b.config}, {SourceRuntime, b.runtime}} {
+		for _, r := range set.rules {
+			id, ok := b.ids[r.Name]
+			if !ok {
+				// Expired, Run removes it shortly.
+				continue
+			}
+			s := RuleStats{Rule: r, Source: set.source}
+			if v, err := b.drops.GetValue(unsafe.Pointer(&id)); err == nil {
+				s.DropStats = ParseDropStats(v)
+			}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Match finds the rule dropping a packet the way the XDP program does, it is
+// how the simulator enforces the blocklist. Every prefix length is tried from
+// the longest down so it works on a plain hash map too.
+func Match(maps map[int]kernelmap.KernelMap, saddr, daddr netip.Addr, proto uint8, dport uint16) (uint32, bool) {
+	family := network.IPV6
+	if saddr.Is4() {
+		family = network.IPV4
+	}
+	m := maps[family]
+	if m == nil {
+		return 0, false
+	}
+	for _, addr := range []netip.Addr{saddr, daddr} {
+		for bits := addr.BitLen(); bits >= 0; bits-- {
+			p, _ := addr.Prefix(bits)
+			key := lpmKey(p.Addr(), bits)
+			v, err := m.GetValue(unsafe.Pointer(&key[0]))
+			if err != nil {
+				continue
+			}
+			// Like the kernel, only the longest match is looked at.
+			if id, ok := matchValue(v, proto, dport); ok {
+				return id, true
+			}
+			break
+		}
+	}
+	return 0, false
+}
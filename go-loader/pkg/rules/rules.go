@@ -0,0 +1,245 @@
+package rules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+// Limits and layouts of the blocklist maps in xdp.bpf.c.
+const (
+	MaxRules          = 256
+	MaxRulesPerPrefix = 8
+	// struct ipv4_lpm_key and struct ipv6_lpm_key.
+	IPv4KeySize = 8
+	IPv6KeySize = 20
+	// struct block_rules.
+	ValueSize = 4 + MaxRulesPerPrefix*8
+	// struct drop_stats.
+	DropStatsSize = 16
+)
+
+// Rule drops the received packets of an address or network. A packet matches
+// when its source or destination address is in CIDR and, when they are set,
+// its protocol is Proto and its destination port is Port.
+type Rule struct {
+	Name string `yaml:"name" json:"name"`
+	// CIDR is a network or a single address.
+	CIDR string `yaml:"cidr" json:"cidr"`
+	// Proto is tcp, udp, icmp, icmpv6 or a protocol number, empty for any.
+	Proto string `yaml:"proto" json:"proto,omitempty"`
+	// Port needs Proto to be tcp or udp, 0 for any.
+	Port uint16 `yaml:"port" json:"port,omitempty"`
+	// Expires removes the rule at that time, nil keeps it forever.
+	Expires *time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+}
+
+func (r Rule) expired(now time.Time) bool {
+	return r.Expires != nil && !now.Before(*r.Expires)
+}
+
+type compiledRule struct {
+	Rule
+	prefix netip.Prefix
+	proto  uint8
+}
+
+func (r Rule) compile() (compiledRule, error) {
+	c := compiledRule{Rule: r}
+	if r.Name == "" {
+		return c, errors.New("rule has no name")
+	}
+
+	var err error
+	if strings.Contains(r.CIDR, "/") {
+		c.prefix, err = netip.ParsePrefix(r.CIDR)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(r.CIDR)
+		c.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return c, fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+	if c.prefix.Addr().Is4In6() || c.prefix.Addr().Zone() != "" {
+		return c, fmt.Errorf("rule %s: %s is not a plain IPv4 or IPv6 network", r.Name, r.CIDR)
+	}
+	c.prefix = c.prefix.Masked()
+
+	if r.Proto != "" {
+		if c.proto, err = network.ParseProto(r.Proto); err != nil {
+			return c, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Port != 0 && c.proto != network.ProtoTCP && c.proto != network.ProtoUDP {
+		return c, fmt.Errorf("rule %s: a port needs proto tcp or udp", r.Name)
+	}
+	return c, nil
+}
+
+// InvalidError is returned for rules that can't be compiled, as opposed to
+// failures to write them to the kernel.
+type InvalidError struct {
+	err error
+}
+
+func (e *InvalidError) Error() string {
+	return e.err.Error()
+}
+
+func (e *InvalidError) Unwrap() error {
+	return e.err
+}
+
+// Validate checks rules the way Blocklist.Apply does, without touching the
+// kernel.
+func Validate(rules []Rule) error {
+	_, err := compileAll(rules)
+	return err
+}
+
+func compileAll(rules []Rule) ([]compiledRule, error) {
+	var errs []error
+	if len(rules) > MaxRules {
+		errs = append(errs, fmt.Errorf("%d rules, at most %d are supported", len(rules), MaxRules))
+	}
+	compiled := make([]compiledRule, 0, len(rules))
+	for i, r := range rules {
+		c, err := r.compile()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if slices.ContainsFunc(rules[:i], func(o Rule) bool { return o.Name == r.Name }) {
+			errs = append(errs, fmt.Errorf("rule %s: name is used twice", r.Name))
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+	if len(errs) == 0 {
+		for _, e := range buildEntries(compiled, nil) {
+			if len(e.rules) > MaxRulesPerPrefix {
+				errs = append(errs, fmt.Errorf("%s is covered by %d rules, at most %d are supported", e.prefix, len(e.rules), MaxRulesPerPrefix))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return compiled, &InvalidError{errors.Join(errs...)}
+	}
+	return compiled, nil
+}
+
+// entry is one key of a blocklist map. An LPM lookup only returns the longest
+// matching prefix, so rules holds the rules of every prefix covering this one,
+// the most specific first.
+type entry struct {
+	prefix netip.Prefix
+	rules  []compiledRule
+	ids    []uint32
+}
+
+func buildEntries(compiled []compiledRule, ids map[string]uint32) []entry {
+	var prefixes []netip.Prefix
+	for _, c := range compiled {
+		if !slices.Contains(prefixes, c.prefix) {
+			prefixes = append(prefixes, c.prefix)
+		}
+	}
+
+	entries := make([]entry, 0, len(prefixes))
+	for _, p := range prefixes {
+		e := entry{prefix: p}
+		for _, c := range compiled {
+			if c.prefix.Bits() <= p.Bits() && c.prefix.Contains(p.Addr()) {
+				e.rules = append(e.rules, c)
+			}
+		}
+		sort.SliceStable(e.rules, func(i, j int) bool { return e.rules[i].prefix.Bits() > e.rules[j].prefix.Bits() })
+		for _, c := range e.rules {
+			e.ids = append(e.ids, ids[c.Name])
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (e entry) family() int {
+	if e.prefix.Addr().Is4() {
+		return network.IPV4
+	}
+	return network.IPV6
+}
+
+// key encodes e.prefix as struct ipv4_lpm_key or struct ipv6_lpm_key.
+func (e entry) key() []byte {
+	return lpmKey(e.prefix.Addr(), e.prefix.Bits())
+}
+
+func lpmKey(addr netip.Addr, bits int) []byte {
+	raw := addr.AsSlice()
+	k := make([]byte, 4+len(raw))
+	binary.NativeEndian.PutUint32(k[0:4], uint32(bits))
+	copy(k[4:], raw)
+	return k
+}
+
+// value encodes e as struct block_rules.
+func (e entry) value() []byte {
+	v := make([]byte, ValueSize)
+	n := min(len(e.rules), MaxRulesPerPrefix)
+	binary.NativeEndian.PutUint32(v[0:4], uint32(n))
+	for i := 0; i < n; i++ {
+		r := v[4+i*8:]
+		binary.NativeEndian.PutUint32(r[0:4], e.ids[i])
+		binary.BigEndian.PutUint16(r[4:6], e.rules[i].Port)
+		r[6] = e.rules[i].proto
+	}
+	return v
+}
+
+// matchValue does what match_rule does in xdp.bpf.c on an encoded struct
+// block_rules.
+func matchValue(v []byte, proto uint8, dport uint16) (uint32, bool) {
+	if len(v) < ValueSize {
+		return 0, false
+	}
+	n := min(int(binary.NativeEndian.Uint32(v[0:4])), MaxRulesPerPrefix)
+	for i := 0; i < n; i++ {
+		r := v[4+i*8:]
+		port := binary.BigEndian.Uint16(r[4:6])
+		if (r[6] == 0 || r[6] == proto) && (port == 0 || port == dport) {
+			return binary.NativeEndian.Uint32(r[0:4]), true
+		}
+	}
+	return 0, false
+}
+
+// DropStats mirrors struct drop_stats.
+type DropStats struct {
+	Packets uint64 `json:"dropped_packets"`
+	Bytes   uint64 `json:"dropped_bytes"`
+}
+
+func ParseDropStats(v []byte) DropStats {
+	if len(v) < DropStatsSize {
+		return DropStats{}
+	}
+	return DropStats{
+		Packets: binary.NativeEndian.Uint64(v[0:8]),
+		Bytes:   binary.NativeEndian.Uint64(v[8:16]),
+	}
+}
+
+func (s DropStats) KernelValue() []byte {
+	v := make([]byte, DropStatsSize)
+	binary.NativeEndian.PutUint64(v[0:8], s.Packets)
+	binary.NativeEndian.PutUint64(v[8:16], s.Bytes)
+	return v
+}
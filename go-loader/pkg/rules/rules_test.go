@@ -0,0 +1,346 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"go.uber.org/zap"
+)
+
+func newTestBlocklist() (*Blocklist, map[int]*kernelmap.MemoryMap) {
+	mem := map[int]*kernelmap.MemoryMap{
+		network.IPV4: kernelmap.NewMemoryMap(IPv4KeySize, ValueSize, 64),
+		network.IPV6: kernelmap.NewMemoryMap(IPv6KeySize, ValueSize, 64),
+	}
+	maps := map[int]kernelmap.KernelMap{network.IPV4: mem[network.IPV4], network.IPV6: mem[network.IPV6]}
+	return NewBlocklist(maps, kernelmap.NewMemoryMap(4, DropStatsSize, MaxRules), zap.NewNop()), mem
+}
+
+// match returns the name of the rule dropping a packet, "" when none does.
+func match(t *testing.T, b *Blocklist, saddr, daddr string, proto uint8, dport uint16) string {
+	t.Helper()
+	id, ok := Match(b.maps, netip.MustParseAddr(saddr), netip.MustParseAddr(daddr), proto, dport)
+	if !ok {
+		return ""
+	}
+	for name, i := range b.ids {
+		if i == id {
+			return name
+		}
+	}
+	t.Fatalf("%s -> %s matched unknown rule id %d", saddr, daddr, id)
+	return ""
+}
+
+func TestCompileAll(t *testing.T) {
+	covering := make([]Rule, MaxRulesPerPrefix+1)
+	for i := range covering {
+		covering[i] = Rule{Name: fmt.Sprintf("r%d", i), CIDR: fmt.Sprintf("10.0.0.0/%d", 8+i)}
+	}
+	tests := []struct {
+		name  string
+		rules []Rule
+		// want is part of the error, none when the rules are valid.
+		want string
+	}{
+		{"address", []Rule{{Name: "a", CIDR: "192.0.2.1"}}, ""},
+		{"networks of both families", []Rule{{Name: "a", CIDR: "10.0.0.0/8"}, {Name: "b", CIDR: "2001:db8::/32", Proto: "tcp", Port: 22}}, ""},
+		{"unmasked network", []Rule{{Name: "a", CIDR: "10.1.2.3/8"}}, ""},
+		{"protocol number", []Rule{{Name: "a", CIDR: "10.0.0.0/8", Proto: "47"}}, ""},
+		{"no name", []Rule{{CIDR: "10.0.0.0/8"}}, "no name"},
+		{"bad cidr", []Rule{{Name: "a", CIDR: "10.0.0.0/33"}}, "rule a"},
+		{"mapped address", []Rule{{Name: "a", CIDR: "::ffff:10.0.0.1"}}, "not a plain"},
+		{"unknown protocol", []Rule{{Name: "a", CIDR: "10.0.0.0/8", Proto: "sctp"}}, "unknown protocol"},
+		{"port without protocol", []Rule{{Name: "a", CIDR: "10.0.0.0/8", Port: 22}}, "needs proto"},
+		{"name used twice", []Rule{{Name: "a", CIDR: "10.0.0.0/8"}, {Name: "a", CIDR: "10.0.0.0/16"}}, "used twice"},
+		{"prefix covered too often", covering, "covered by 9 rules"},
+		{"too many rules", make([]Rule, MaxRules+1), "at most 256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileAll(tt.rules)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("compileAll: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("compileAll error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Overlapping prefixes match their most specific rule first and fall back
+// to the wider ones.
+func TestApply(t *testing.T) {
+	b, mem := newTestBlocklist()
+	err := b.Apply([]Rule{
+		{Name: "lan", CIDR: "10.0.0.0/8"},
+		{Name: "ssh", CIDR: "10.1.0.0/16", Proto: "tcp", Port: 22},
+		{Name: "doc", CIDR: "2001:db8::/32", Proto: "icmpv6"},
+	})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if mem[network.IPV4].Len() != 2 || mem[network.IPV6].Len() != 1 {
+		t.Errorf("%d IPv4 and %d IPv6 prefixes written, want 2 and 1", mem[network.IPV4].Len(), mem[network.IPV6].Len())
+	}
+
+	tests := []struct {
+		saddr, daddr string
+		proto        uint8
+		dport        uint16
+		want         string
+	}{
+		{"10.1.2.3", "192.168.1.10", network.ProtoTCP, 22, "ssh"},
+		{"192.168.1.10", "10.1.2.3", network.ProtoTCP, 22, "ssh"},
+		{"10.1.2.3", "192.168.1.10", network.ProtoUDP, 53, "lan"},
+		{"10.2.0.1", "192.168.1.10", network.ProtoTCP, 22, "lan"},
+		{"192.0.2.1", "192.168.1.10", network.ProtoTCP, 22, ""},
+		{"2001:db8::1", "fd00::10", network.ProtoICMPv6, 0, "doc"},
+		{"2001:db8::1", "fd00::10", network.ProtoTCP, 443, ""},
+	}
+	for _, tt := range tests {
+		if got := match(t, b, tt.saddr, tt.daddr, tt.proto, tt.dport); got != tt.want {
+			t.Errorf("%s -> %s proto %d port %d matched %q, want %q", tt.saddr, tt.daddr, tt.proto, tt.dport, got, tt.want)
+		}
+	}
+}
+
+// A rule keeps its id and counters while it stays, a removed rule's id goes
+// to the next new rule with its counters reset, and stale prefixes are
+// deleted.
+func TestApplyIDs(t *testing.T) {
+	b, mem := newTestBlocklist()
+	if err := b.Apply([]Rule{{Name: "a", CIDR: "10.0.0.0/8"}, {Name: "b", CIDR: "192.0.2.0/24"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	idA, idB := b.ids["a"], b.ids["b"]
+	for _, id := range []uint32{idA, idB} {
+		v := DropStats{Packets: 5, Bytes: 500}.KernelValue()
+		if err := b.drops.Update(unsafe.Pointer(&id), unsafe.Pointer(&v[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Apply([]Rule{{Name: "c", CIDR: "198.51.100.0/24"}, {Name: "a", CIDR: "10.0.0.0/8"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if b.ids["a"] != idA || b.ids["c"] != idB {
+		t.Errorf("ids = %v, want a to keep %d and c to reuse %d", b.ids, idA, idB)
+	}
+	if mem[network.IPV4].Len() != 2 {
+		t.Errorf("%d prefixes left, want 2", mem[network.IPV4].Len())
+	}
+	if got := match(t, b, "192.0.2.1", "192.168.1.10", network.ProtoTCP, 22); got != "" {
+		t.Errorf("removed rule still matches, got %q", got)
+	}
+
+	stats := make(map[string]DropStats)
+	for _, s := range b.Stats() {
+		stats[s.Name] = s.DropStats
+	}
+	if stats["a"].Packets != 5 || stats["c"].Packets != 0 {
+		t.Errorf("stats = %+v, want a to keep its counters and c to start at zero", stats)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	b, mem := newTestBlocklist()
+	if err := b.Apply([]Rule{{Name: "a", CIDR: "10.0.0.0/8"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := b.Apply([]Rule{{Name: "b", CIDR: "not a network"}}); err == nil {
+		t.Fatal("invalid rules applied")
+	}
+	if stats := b.Stats(); len(stats) != 1 || stats[0].Name != "a" || mem[network.IPV4].Len() != 1 {
+		t.Errorf("invalid rules changed the blocklist to %+v", stats)
+	}
+}
+
+func TestAddDelete(t *testing.T) {
+	b, mem := newTestBlocklist()
+	changes := 0
+	b.OnChange(func() { changes++ })
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	var invalid *InvalidError
+	for _, tt := range []struct {
+		name string
+		rule Rule
+		want error
+	}{
+		{"config name", Rule{Name: "lan", CIDR: "192.0.2.0/24"}, ErrExists},
+		{"expired", Rule{Name: "old", CIDR: "192.0.2.0/24", Expires: &past}, ErrExpiredRule},
+	} {
+		if err := b.Add(tt.rule); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Add returned %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if err := b.Add(Rule{Name: "bad", CIDR: "192.0.2.0/33"}); !errors.As(err, &invalid) {
+		t.Errorf("invalid rule: Add returned %v, want an InvalidError", err)
+	}
+	if changes != 0 {
+		t.Errorf("%d changes reported for rejected rules", changes)
+	}
+
+	if err := b.Add(Rule{Name: "doc", CIDR: "192.0.2.0/24"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := b.Add(Rule{Name: "doc", CIDR: "198.51.100.0/24"}); !errors.Is(err, ErrExists) {
+		t.Errorf("adding doc twice returned %v, want ErrExists", err)
+	}
+	if got := match(t, b, "192.0.2.1", "192.168.1.10", network.ProtoTCP, 22); got != "doc" || mem[network.IPV4].Len() != 2 {
+		t.Errorf("added rule matched %q with %d prefixes written", got, mem[network.IPV4].Len())
+	}
+
+	for name, want := range map[string]error{"lan": ErrConfigRule, "nope": ErrNotFound} {
+		if err := b.Delete(name); !errors.Is(err, want) {
+			t.Errorf("Delete(%s) returned %v, want %v", name, err, want)
+		}
+	}
+	if err := b.Delete("doc"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(b.Runtime()) != 0 || mem[network.IPV4].Len() != 1 {
+		t.Errorf("deleted rule left %+v with %d prefixes", b.Runtime(), mem[network.IPV4].Len())
+	}
+	if changes != 2 {
+		t.Errorf("%d changes reported, want 2", changes)
+	}
+}
+
+// Expired rules stop matching and only the runtime ones count as a change
+// to persist.
+func TestExpire(t *testing.T) {
+	b, mem := newTestBlocklist()
+	now := time.Now()
+	soon, later := now.Add(time.Minute), now.Add(time.Hour)
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}, {Name: "maintenance", CIDR: "10.1.0.0/16", Expires: &soon}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := b.Add(Rule{Name: "doc", CIDR: "192.0.2.0/24", Expires: &later}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if b.expire(now) {
+		t.Error("expire reported a change with nothing expired")
+	}
+	if b.expire(soon) {
+		t.Error("an expired config rule was reported as a runtime change")
+	}
+	if got := match(t, b, "10.1.2.3", "192.168.1.10", network.ProtoTCP, 22); got != "lan" {
+		t.Errorf("10.1.2.3 matched %q after maintenance expired, want lan", got)
+	}
+	if !b.expire(later) {
+		t.Error("an expired runtime rule was not reported")
+	}
+	if len(b.Runtime()) != 0 || mem[network.IPV4].Len() != 1 {
+		t.Errorf("expired rules left %+v with %d prefixes", b.Runtime(), mem[network.IPV4].Len())
+	}
+}
+
+// failingMap fails every delete while fail is set.
+type failingMap struct {
+	*kernelmap.MemoryMap
+	fail bool
+}
+
+func (m *failingMap) DeleteKey(key unsafe.Pointer) error {
+	if m.fail {
+		return errors.New("delete failed")
+	}
+	return m.MemoryMap.DeleteKey(key)
+}
+
+// Expired rules are only forgotten once they are out of the kernel maps.
+func TestExpireFailed(t *testing.T) {
+	b, mem := newTestBlocklist()
+	v4 := &failingMap{MemoryMap: mem[network.IPV4]}
+	b.maps[network.IPV4] = v4
+	now := time.Now()
+	soon := now.Add(time.Minute)
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}, {Name: "maintenance", CIDR: "10.1.0.0/16", Expires: &soon}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if err := b.Add(Rule{Name: "doc", CIDR: "192.0.2.0/24", Expires: &soon}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	v4.fail = true
+	if b.expire(soon) {
+		t.Error("expire reported a change it failed to make")
+	}
+	if len(b.config) != 2 || len(b.Runtime()) != 1 {
+		t.Errorf("rules after a failed expiry = %+v and %+v, want them all kept", b.config, b.Runtime())
+	}
+
+	v4.fail = false
+	if !b.expire(soon) {
+		t.Error("the retried expiry was not reported")
+	}
+	if len(b.config) != 1 || len(b.Runtime()) != 0 || mem[network.IPV4].Len() != 1 {
+		t.Errorf("retried expiry left %+v and %+v with %d prefixes", b.config, b.Runtime(), mem[network.IPV4].Len())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	b, _ := newTestBlocklist()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	b.Restore([]Rule{{Name: "old", CIDR: "192.0.2.0/24", Expires: &past}, {Name: "doc", CIDR: "198.51.100.0/24", Expires: &future}})
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	var got []string
+	for _, s := range b.Stats() {
+		got = append(got, s.Source+":"+s.Name)
+	}
+	if want := []string{"config:lan", "api:doc"}; !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+}
+
+// Config rules win over the runtime rules of the same name, on startup and
+// on reload.
+func TestApplyNameClash(t *testing.T) {
+	b, _ := newTestBlocklist()
+	changes := 0
+	b.OnChange(func() { changes++ })
+	b.Restore([]Rule{{Name: "lan", CIDR: "192.0.2.0/24"}, {Name: "doc", CIDR: "198.51.100.0/24"}})
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}}); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := b.Runtime(); len(got) != 1 || got[0].Name != "doc" {
+		t.Errorf("runtime rules = %+v, want only doc", got)
+	}
+	if got := match(t, b, "192.0.2.1", "192.168.1.10", network.ProtoTCP, 22); got != "" {
+		t.Errorf("192.0.2.1 matched %q, want the dropped runtime rule gone", got)
+	}
+
+	if err := b.Apply([]Rule{{Name: "lan", CIDR: "10.0.0.0/8"}, {Name: "doc", CIDR: "203.0.113.0/24"}}); err != nil {
+		t.Fatalf("Apply on reload: %v", err)
+	}
+	if got := b.Runtime(); len(got) != 0 {
+		t.Errorf("runtime rules after reload = %+v, want none", got)
+	}
+	if got := match(t, b, "203.0.113.1", "192.168.1.10", network.ProtoTCP, 22); got != "doc" {
+		t.Errorf("203.0.113.1 matched %q, want the config rule doc", got)
+	}
+	if changes != 2 {
+		t.Errorf("%d changes reported, want one per dropped runtime rule set", changes)
+	}
+}
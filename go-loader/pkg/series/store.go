@@ -0,0 +1,556 @@
+package series
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// Resolutions the deltas are kept at, each in its own bucket. Raw points are
+// one per harvest, the others add up the harvests of their minute, hour or
+// (local) day.
+const (
+	ResolutionRaw    = "raw"
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+	ResolutionDay    = "1d"
+)
+
+// Directions of the host series. Upload and download are only kept for
+// local hosts, and only count their traffic with the internet.
+const (
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// HostTotal is the host whose series add up every flow.
+const HostTotal = "total"
+
+// indexBucket maps every host to the flow series it took part in, as a
+// sub-bucket per host whose values are the flow's labels.
+var indexBucket = []byte("index")
+
+// pruneInterval is how often points past their retention are deleted.
+const pruneInterval = 10 * time.Minute
+
+// Retention is how long the points of every resolution are kept.
+type Retention struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+	Day    time.Duration
+}
+
+type Options struct {
+	Path string
+	// Flows keeps a series per flow next to the per host ones.
+	Flows bool
+	// Interval is the harvest interval, the step of the raw resolution.
+	Interval  time.Duration
+	Retention Retention
+}
+
+// Store keeps what hosts and flows moved over time in a bbolt file. A series
+// is a sub-bucket of its resolution's bucket, keyed by the big endian unix
+// milliseconds of its points.
+type Store struct {
+	db     *bolt.DB
+	opts   Options
+	levels []level
+	// deltas and primed are only used by Record.
+	deltas tracker.Deltas
+	primed bool
+
+	mu sync.Mutex
+	// indexed are the flow series already in the index.
+	indexed map[string]bool
+	l       *zap.Logger
+}
+
+type level struct {
+	name      string
+	step      time.Duration
+	retention time.Duration
+	truncate  func(t time.Time) time.Time
+}
+
+// FlowLabels describe the flow of a flow series.
+type FlowLabels struct {
+	Saddr     string `json:"saddr"`
+	Daddr     string `json:"daddr"`
+	Sport     uint16 `json:"sport"`
+	Dport     uint16 `json:"dport"`
+	Proto     uint8  `json:"proto"`
+	Interface string `json:"interface"`
+}
+
+// Point is what a series moved in the step starting at Time.
+type Point struct {
+	Time    time.Time `json:"time"`
+	Bytes   uint64    `json:"bytes"`
+	Packets uint64    `json:"packets"`
+}
+
+func (p *Point) add(o Point) {
+	p.Bytes += o.Bytes
+	p.Packets += o.Packets
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func Open(opts Options, l *zap.Logger) (*Store, error) {
+	db, err := bolt.Open(opts.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", opts.Path, err)
+	}
+	s := &Store{
+		db:   db,
+		opts: opts,
+		levels: []level{
+			{ResolutionRaw, opts.Interval, opts.Retention.Raw, func(t time.Time) time.Time { return t.Truncate(time.Millisecond) }},
+			{ResolutionMinute, time.Minute, opts.Retention.Minute, func(t time.Time) time.Time { return t.Truncate(time.Minute) }},
+			{ResolutionHour, time.Hour, opts.Retention.Hour, func(t time.Time) time.Time { return t.Truncate(time.Hour) }},
+			{ResolutionDay, 24 * time.Hour, opts.Retention.Day, startOfDay},
+		},
+		indexed: make(map[string]bool),
+		l:       l,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, lvl := range s.levels {
+			if _, err := tx.CreateBucketIfNotExists([]byte(lvl.name)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize %s: %w", opts.Path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func hostSeries(addr, direction string) string {
+	return "host|" + addr + "|" + direction
+}
+
+func flowSeries(c tracker.Connection) string {
+	return "flow|" + tracker.FlowID(c)
+}
+
+func encodeTime(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixMilli()))
+	return k
+}
+
+func decodeTime(k []byte) time.Time {
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(k)))
+}
+
+func encodePoint(p Point) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[0:8], p.Bytes)
+	binary.BigEndian.PutUint64(v[8:16], p.Packets)
+	return v
+}
+
+func decodePoint(v []byte) Point {
+	if len(v) < 16 {
+		return Point{}
+	}
+	return Point{Bytes: binary.BigEndian.Uint64(v[0:8]), Packets: binary.BigEndian.Uint64(v[8:16])}
+}
+
+// Record adds what conns moved since the previous call, at now, to every
+// resolution. The first call only takes the counters as a baseline. It must
+// not be called concurrently.
+func (s *Store) Record(now time.Time, conns []tracker.Connection) error {
+	deltas := s.deltas.Next(conns)
+	if !s.primed {
+		s.primed = true
+		return nil
+	}
+
+	points := make(map[string]Point)
+	add := func(name string, p Point) {
+		if p.Bytes == 0 && p.Packets == 0 {
+			return
+		}
+		cur := points[name]
+		cur.add(p)
+		points[name] = cur
+	}
+	newFlows := make(map[string]tracker.Connection)
+	for _, d := range deltas {
+		p := Point{Bytes: d.Moved.Bytes(), Packets: d.Moved.Packets()}
+		if p.Bytes == 0 && p.Packets == 0 {
+			continue
+		}
+		sent := Point{Bytes: d.Moved.TxBytes, Packets: d.Moved.TxPackets}
+		received := Point{Bytes: d.Moved.RxBytes, Packets: d.Moved.RxPackets}
+		add(hostSeries(d.Saddr, DirectionSent), sent)
+		add(hostSeries(d.Saddr, DirectionReceived), received)
+		add(hostSeries(d.Daddr, DirectionSent), received)
+		add(hostSeries(d.Daddr, DirectionReceived), sent)
+		add(hostSeries(HostTotal, DirectionSent), sent)
+		add(hostSeries(HostTotal, DirectionReceived), received)
+		if local, up, down, ok := internetTraffic(d.Saddr, d.Daddr, sent, received); ok {
+			add(hostSeries(local, DirectionUpload), up)
+			add(hostSeries(local, DirectionDownload), down)
+			add(hostSeries(HostTotal, DirectionUpload), up)
+			add(hostSeries(HostTotal, DirectionDownload), down)
+		}
+		if s.opts.Flows {
+			name := flowSeries(d.Connection)
+			add(name, p)
+			if !s.isIndexed(name) {
+				newFlows[name] = d.Connection
+			}
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, lvl := range s.levels {
+			b := tx.Bucket([]byte(lvl.name))
+			key := encodeTime(lvl.truncate(now))
+			for name, p := range points {
+				sb, err := b.CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+				cur := decodePoint(sb.Get(key))
+				cur.add(p)
+				if err := sb.Put(key, encodePoint(cur)); err != nil {
+					return err
+				}
+			}
+		}
+
+		index := tx.Bucket(indexBucket)
+		for name, c := range newFlows {
+			labels, err := json.Marshal(FlowLabels{
+				Saddr:     c.Saddr,
+				Daddr:     c.Daddr,
+				Sport:     c.Sport,
+				Dport:     c.Dport,
+				Proto:     c.Proto,
+				Interface: c.Interface,
+			})
+			if err != nil {
+				return err
+			}
+			for _, host := range []string{c.Saddr, c.Daddr} {
+				hb, err := index.CreateBucketIfNotExists([]byte(host))
+				if err != nil {
+					return err
+				}
+				if err := hb.Put([]byte(name), labels); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for name := range newFlows {
+		s.indexed[name] = true
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// internetTraffic returns the local end of a flow between saddr and the
+// internet with what it uploaded and downloaded, ok is false for any other
+// flow.
+func internetTraffic(saddr, daddr string, sent, received Point) (string, Point, Point, bool) {
+	switch src, dst := network.IsLocal(saddr), network.IsLocal(daddr); {
+	case src && !dst:
+		return saddr, sent, received, true
+	case dst && !src:
+		return daddr, received, sent, true
+	}
+	return "", Point{}, Point{}, false
+}
+
+func (s *Store) isIndexed(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.indexed[name]
+}
+
+// Run deletes the points past their retention until ctx is done.
+func (s *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.prune(time.Now()); err != nil {
+			s.l.Sugar().Errorf("Failed to prune the series store: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prune deletes the points older than their resolution's retention, then
+// the series left empty and their index entries.
+func (s *Store) prune(now time.Time) error {
+	var removed int
+	var gone []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, lvl := range s.levels {
+			b := tx.Bucket([]byte(lvl.name))
+			cutoff := encodeTime(now.Add(-lvl.retention))
+			var empty [][]byte
+			err := b.ForEachBucket(func(name []byte) error {
+				sb := b.Bucket(name)
+				// Deleting while iterating would skip keys.
+				var old [][]byte
+				c := sb.Cursor()
+				for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+					old = append(old, bytes.Clone(k))
+				}
+				for _, k := range old {
+					if err := sb.Delete(k); err != nil {
+						return err
+					}
+				}
+				removed += len(old)
+				if k, _ := sb.Cursor().First(); k == nil {
+					empty = append(empty, bytes.Clone(name))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, name := range empty {
+				if err := b.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		// A flow is dropped from the index once no resolution has it.
+		index := tx.Bucket(indexBucket)
+		return index.ForEachBucket(func(host []byte) error {
+			hb := index.Bucket(host)
+			var stale [][]byte
+			hb.ForEach(func(name, _ []byte) error {
+				if !s.exists(tx, name) {
+					stale = append(stale, bytes.Clone(name))
+				}
+				return nil
+			})
+			for _, name := range stale {
+				if err := hb.Delete(name); err != nil {
+					return err
+				}
+				gone = append(gone, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for _, name := range gone {
+		delete(s.indexed, name)
+	}
+	s.mu.Unlock()
+	if removed > 0 {
+		s.l.Sugar().Debugf("Pruned %d series points", removed)
+	}
+	return nil
+}
+
+func (s *Store) exists(tx *bolt.Tx, name []byte) bool {
+	for _, lvl := range s.levels {
+		if tx.Bucket([]byte(lvl.name)).Bucket(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Query asks for the series of a host between From and To, in steps of Step.
+// A zero Step picks one giving about defaultPoints points, steps are at
+// least a second.
+type Query struct {
+	Host  string
+	From  time.Time
+	To    time.Time
+	Step  time.Duration
+	Flows bool
+	// Directions are the host series to read, sent and received when empty.
+	Directions []string
+}
+
+// Result holds a series per direction, and with Query.Flows one per flow of
+// the host. Every step of the range has a point, zero when nothing moved.
+type Result struct {
+	Host string    `json:"host"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Step string    `json:"step"`
+	// Resolution is the one the points were read from.
+	Resolution string   `json:"resolution"`
+	Series     []Series `json:"series"`
+}
+
+type Series struct {
+	// Name is the direction or the id of the flow.
+	Name    string      `json:"name"`
+	Flow    *FlowLabels `json:"flow,omitempty"`
+	Bytes   uint64      `json:"bytes"`
+	Packets uint64      `json:"packets"`
+	Points  []Point     `json:"points"`
+}
+
+const (
+	defaultPoints = 300
+	maxPoints     = 10000
+)
+
+var ErrTooManyPoints = fmt.Errorf("the step is too small for the range, at most %d points are returned", maxPoints)
+
+// pick returns the coarsest resolution whose step fits in step, or a coarser
+// one when it doesn't reach back to from anymore.
+func (s *Store) pick(now, from time.Time, step time.Duration) level {
+	i := 0
+	for i+1 < len(s.levels) && s.levels[i+1].step <= step {
+		i++
+	}
+	for i+1 < len(s.levels) && from.Before(now.Add(-s.levels[i].retention)) {
+		i++
+	}
+	return s.levels[i]
+}
+
+// align returns the start of the step t is in. Steps of whole days start at
+// local midnight like the day resolution.
+func align(t time.Time, step time.Duration) time.Time {
+	if step%(24*time.Hour) == 0 {
+		return startOfDay(t)
+	}
+	return t.Truncate(step)
+}
+
+// next returns the start of the step after the one starting at t, days are
+// added on the calendar so they survive DST changes.
+func next(t time.Time, step time.Duration) time.Time {
+	if step%(24*time.Hour) == 0 {
+		return t.AddDate(0, 0, int(step/(24*time.Hour)))
+	}
+	return t.Add(step)
+}
+
+func (s *Store) Query(q Query) (Result, error) {
+	if q.Host == "" {
+		return Result{}, errors.New("no host given")
+	}
+	if !q.To.After(q.From) {
+		return Result{}, errors.New("to must be after from")
+	}
+	span := q.To.Sub(q.From)
+	if q.Step <= 0 {
+		q.Step = max(s.opts.Interval, span/defaultPoints).Round(time.Second)
+	}
+	q.Step = max(q.Step, time.Second)
+	if span/q.Step >= maxPoints {
+		return Result{}, ErrTooManyPoints
+	}
+	lvl := s.pick(time.Now(), q.From, q.Step)
+	start := align(q.From, q.Step)
+	res := Result{Host: q.Host, From: q.From, To: q.To, Step: q.Step.String(), Resolution: lvl.name}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lvl.name))
+		read := func(name string) Series {
+			var ser Series
+			for t := start; t.Before(q.To); t = next(t, q.Step) {
+				ser.Points = append(ser.Points, Point{Time: t})
+			}
+			sb := b.Bucket([]byte(name))
+			if sb == nil {
+				return ser
+			}
+			c := sb.Cursor()
+			end := encodeTime(q.To)
+			for k, v := c.Seek(encodeTime(start)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+				p := decodePoint(v)
+				t := decodeTime(k)
+				i := sort.Search(len(ser.Points), func(i int) bool { return ser.Points[i].Time.After(t) }) - 1
+				ser.Points[max(i, 0)].add(p)
+				ser.Bytes += p.Bytes
+				ser.Packets += p.Packets
+			}
+			return ser
+		}
+
+		directions := q.Directions
+		if len(directions) == 0 {
+			directions = []string{DirectionSent, DirectionReceived}
+		}
+		for _, direction := range directions {
+			ser := read(hostSeries(q.Host, direction))
+			ser.Name = direction
+			res.Series = append(res.Series, ser)
+		}
+		if !q.Flows {
+			return nil
+		}
+		hb := tx.Bucket(indexBucket).Bucket([]byte(q.Host))
+		if hb == nil {
+			return nil
+		}
+		return hb.ForEach(func(name, labels []byte) error {
+			ser := read(string(name))
+			if ser.Bytes == 0 && ser.Packets == 0 {
+				return nil
+			}
+			ser.Name = string(bytes.TrimPrefix(name, []byte("flow|")))
+			ser.Flow = &FlowLabels{}
+			if err := json.Unmarshal(labels, ser.Flow); err != nil {
+				return err
+			}
+			res.Series = append(res.Series, ser)
+			return nil
+		})
+	})
+	return res, err
+}
@@ -0,0 +1,243 @@
+package series
+
+import (
+	"errors"
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+func newTestStore(t *testing.T, retention Retention) *Store {
+	t.Helper()
+	s, err := Open(Options{
+		Path:      filepath.Join(t.TempDir(), "series.db"),
+		Flows:     true,
+		Interval:  10 * time.Second,
+		Retention: retention,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+var testRetention = Retention{Raw: 24 * time.Hour, Minute: 7 * 24 * time.Hour, Hour: 30 * 24 * time.Hour, Day: 365 * 24 * time.Hour}
+
+// testFlow is 192.168.1.10 talking to 1.1.1.1, with what it sent and got
+// back so far.
+func testFlow(tx, rx uint64) []tracker.Connection {
+	return []tracker.Connection{{
+		Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4,
+		ConnectionStats: tracker.ConnectionStats{TxPackets: tx / 100, TxBytes: tx, RxPackets: rx / 100, RxBytes: rx},
+	}}
+}
+
+func record(t *testing.T, s *Store, at time.Time, conns []tracker.Connection) {
+	t.Helper()
+	if err := s.Record(at, conns); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+}
+
+func totals(res Result) map[string]uint64 {
+	out := make(map[string]uint64)
+	for _, ser := range res.Series {
+		out[ser.Name] = ser.Bytes
+	}
+	return out
+}
+
+// Both ends of a flow get what it moved, each in its own direction.
+func TestRecordQuery(t *testing.T) {
+	s := newTestStore(t, testRetention)
+	now := time.Now().Truncate(time.Minute)
+	record(t, s, now, testFlow(100, 0))
+	record(t, s, now.Add(10*time.Second), testFlow(1100, 500))
+	record(t, s, now.Add(20*time.Second), testFlow(1100, 500))
+	record(t, s, now.Add(30*time.Second), testFlow(1600, 800))
+
+	flow := tracker.FlowID(testFlow(0, 0)[0])
+	for host, want := range map[string]map[string]uint64{
+		"192.168.1.10": {DirectionSent: 1500, DirectionReceived: 800, flow: 2300},
+		"1.1.1.1":      {DirectionSent: 800, DirectionReceived: 1500, flow: 2300},
+		"192.168.1.20": {DirectionSent: 0, DirectionReceived: 0},
+	} {
+		res, err := s.Query(Query{Host: host, From: now, To: now.Add(time.Minute), Step: 10 * time.Second, Flows: true})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		got := totals(res)
+		if len(got) != len(want) {
+			t.Errorf("%s: series %v, want %v", host, got, want)
+		}
+		for name, bytes := range want {
+			if got[name] != bytes {
+				t.Errorf("%s: %s moved %d bytes, want %d", host, name, got[name], bytes)
+			}
+		}
+		if n := len(res.Series[0].Points); n != 6 {
+			t.Errorf("%s: %d points, want one per step", host, n)
+		}
+	}
+
+	res, _ := s.Query(Query{Host: "192.168.1.10", From: now, To: now.Add(time.Minute), Step: 10 * time.Second})
+	if p := res.Series[0].Points; p[1].Bytes != 1000 || p[2].Bytes != 0 || p[3].Bytes != 500 {
+		t.Errorf("sent points = %+v, want 1000, 0 and 500 bytes from the second one", p)
+	}
+
+	// Only the local end has upload and download, and the total adds up
+	// every flow once.
+	directions := []string{DirectionSent, DirectionReceived, DirectionUpload, DirectionDownload}
+	for host, want := range map[string]map[string]uint64{
+		"192.168.1.10": {DirectionSent: 1500, DirectionReceived: 800, DirectionUpload: 1500, DirectionDownload: 800},
+		"1.1.1.1":      {DirectionSent: 800, DirectionReceived: 1500, DirectionUpload: 0, DirectionDownload: 0},
+		HostTotal:      {DirectionSent: 1500, DirectionReceived: 800, DirectionUpload: 1500, DirectionDownload: 800},
+	} {
+		res, err := s.Query(Query{Host: host, From: now, To: now.Add(time.Minute), Step: 10 * time.Second, Directions: directions})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		if got := totals(res); !maps.Equal(got, want) {
+			t.Errorf("%s moved %v, want %v", host, got, want)
+		}
+	}
+}
+
+// Queries are read from the coarsest resolution their step fits, or a
+// coarser one when the finer ones don't go back far enough.
+func TestQueryResolution(t *testing.T) {
+	s := newTestStore(t, testRetention)
+	now := time.Now()
+	day := startOfDay(now)
+	record(t, s, day.Add(-2*time.Hour), testFlow(0, 0))
+	record(t, s, day.Add(-90*time.Minute), testFlow(1000, 0))
+
+	tests := []struct {
+		from time.Time
+		step time.Duration
+		want string
+	}{
+		{now.Add(-time.Hour), 10 * time.Second, ResolutionRaw},
+		{now.Add(-time.Hour), 30 * time.Second, ResolutionRaw},
+		{now.Add(-6 * time.Hour), time.Minute, ResolutionMinute},
+		{now.Add(-24 * time.Hour), time.Hour, ResolutionHour},
+		{now.Add(-7 * 24 * time.Hour), 24 * time.Hour, ResolutionDay},
+		{now.Add(-48 * time.Hour), 10 * time.Minute, ResolutionMinute},
+		{now.Add(-10 * 24 * time.Hour), 10 * time.Minute, ResolutionHour},
+	}
+	for _, tt := range tests {
+		res, err := s.Query(Query{Host: "192.168.1.10", From: tt.from, To: now, Step: tt.step})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		if res.Resolution != tt.want {
+			t.Errorf("from %s in steps of %s read %s, want %s", now.Sub(tt.from), tt.step, res.Resolution, tt.want)
+		}
+		if sent := totals(res)[DirectionSent]; tt.from.Before(day.Add(-90*time.Minute)) && sent != 1000 {
+			t.Errorf("%s resolution has %d bytes sent, want 1000", res.Resolution, sent)
+		}
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	s := newTestStore(t, testRetention)
+	now := time.Now()
+	tests := []struct {
+		name string
+		q    Query
+	}{
+		{"no host", Query{From: now.Add(-time.Hour), To: now}},
+		{"empty range", Query{Host: "192.168.1.10", From: now, To: now}},
+		{"to before from", Query{Host: "192.168.1.10", From: now, To: now.Add(-time.Hour)}},
+	}
+	for _, tt := range tests {
+		if _, err := s.Query(tt.q); err == nil {
+			t.Errorf("%s: query accepted", tt.name)
+		}
+	}
+	for _, step := range []time.Duration{time.Second, time.Nanosecond} {
+		_, err := s.Query(Query{Host: "192.168.1.10", From: now.Add(-24 * time.Hour), To: now, Step: step})
+		if !errors.Is(err, ErrTooManyPoints) {
+			t.Errorf("a day in steps of %s returned %v, want ErrTooManyPoints", step, err)
+		}
+	}
+}
+
+// Steps, picked or given, are never under a second.
+func TestQueryStep(t *testing.T) {
+	s, err := Open(Options{Path: filepath.Join(t.TempDir(), "series.db"), Interval: 100 * time.Millisecond, Retention: testRetention}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	now := time.Now()
+	for _, step := range []time.Duration{0, time.Millisecond} {
+		res, err := s.Query(Query{Host: "192.168.1.10", From: now.Add(-time.Minute), To: now, Step: step})
+		if err != nil {
+			t.Fatalf("step %s: %v", step, err)
+		}
+		if res.Step != "1s" || len(res.Series[0].Points) > 61 {
+			t.Errorf("step %s queried in steps of %s with %d points, want 1s", step, res.Step, len(res.Series[0].Points))
+		}
+	}
+}
+
+// Points past their resolution's retention are deleted, and a flow leaves
+// the index once no resolution has it anymore.
+func TestPrune(t *testing.T) {
+	s := newTestStore(t, Retention{Raw: time.Hour, Minute: 2 * time.Hour, Hour: 4 * time.Hour, Day: 48 * time.Hour})
+	now := time.Now()
+	record(t, s, now.Add(-150*time.Minute), testFlow(0, 0))
+	record(t, s, now.Add(-150*time.Minute).Add(10*time.Second), testFlow(1000, 0))
+
+	count := func() map[string]int {
+		out := make(map[string]int)
+		s.db.View(func(tx *bolt.Tx) error {
+			for _, name := range []string{ResolutionRaw, ResolutionMinute, ResolutionHour, ResolutionDay, string(indexBucket)} {
+				tx.Bucket([]byte(name)).ForEachBucket(func(k []byte) error {
+					out[name]++
+					return nil
+				})
+			}
+			return nil
+		})
+		return out
+	}
+	// Sent and received of each end, sent, upload and their totals, and the
+	// flow.
+	if got := count(); got[ResolutionRaw] != 6 || got[string(indexBucket)] != 2 {
+		t.Fatalf("series before pruning = %v, want 6 per resolution and 2 hosts", got)
+	}
+
+	if err := s.prune(now); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got := count(); got[ResolutionRaw] != 0 || got[ResolutionMinute] != 0 || got[ResolutionHour] != 6 || got[ResolutionDay] != 6 {
+		t.Errorf("series after pruning = %v, want only the hour and day ones left", got)
+	}
+	if err := s.prune(now.Add(72 * time.Hour)); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got := count(); got[ResolutionHour] != 0 || got[ResolutionDay] != 0 {
+		t.Errorf("series after pruning everything = %v", got)
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		tx.Bucket(indexBucket).ForEachBucket(func(host []byte) error {
+			if k, _ := tx.Bucket(indexBucket).Bucket(host).Cursor().First(); k != nil {
+				t.Errorf("%s still indexes %s", host, k)
+			}
+			return nil
+		})
+		return nil
+	})
+	if s.isIndexed(flowSeries(testFlow(0, 0)[0])) {
+		t.Error("pruned flow is still marked as indexed")
+	}
+}
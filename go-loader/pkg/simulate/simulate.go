@@ -0,0 +1,192 @@
+package simulate
+
+import (
+	"context"
+	"math/rand"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+)
+
+const maxEntries = 10240
+
+var (
+	localHosts  = []string{"192.168.1.10", "192.168.1.11", "192.168.1.20", "192.168.1.42"}
+	remoteHosts = []string{"1.1.1.1", "8.8.8.8", "140.82.112.3", "151.101.1.140"}
+	localHosts6 = []string{"fd00::10", "fd00::11"}
+	remoteHost6 = []string{"2606:4700:4700::1111", "2001:4860:4860::8888"}
+)
+
+// Interfaces of the simulated router, registered with network so their
+// names resolve.
+var interfaces = []struct {
+	index uint32
+	name  string
+}{
+	{1001, "br-lan"},
+	{1002, "wan0"},
+	{1003, "wg0"},
+}
+
+func init() {
+	for _, iface := range interfaces {
+		network.RegisterInterface(iface.index, iface.name)
+	}
+}
+
+// service is what a local host talks to on a remote one. ICMP is an echo
+// request one way and a reply the other, with the type and code in place of
+// the ports.
+type service struct {
+	proto uint8
+	port  uint16
+}
+
+var services = []service{
+	{network.ProtoTCP, 443},
+	{network.ProtoTCP, 22},
+	{network.ProtoUDP, 53},
+	{network.ProtoUDP, 443},
+	{network.ProtoICMP, 0},
+}
+
+// Maps are in-memory stand-ins for the maps in xdp.bpf.c. The blocklist
+// tries are plain hash maps, rules.Match does the longest prefix lookup.
+type Maps struct {
+	Trackers  map[int]kernelmap.KernelMap
+	Blocklist map[int]kernelmap.KernelMap
+	Drops     kernelmap.KernelMap
+}
+
+// NewMaps returns empty in-memory maps shaped like the ones in xdp.bpf.c.
+func NewMaps() Maps {
+	return Maps{
+		Trackers: map[int]kernelmap.KernelMap{
+			network.IPV4: kernelmap.NewMemoryMap(network.IPv4KeySize, tracker.ConnectionStatsSize, maxEntries),
+			network.IPV6: kernelmap.NewMemoryMap(network.IPv6KeySize, tracker.ConnectionStatsSize, maxEntries),
+		},
+		Blocklist: map[int]kernelmap.KernelMap{
+			network.IPV4: kernelmap.NewMemoryMap(rules.IPv4KeySize, rules.ValueSize, 1024),
+			network.IPV6: kernelmap.NewMemoryMap(rules.IPv6KeySize, rules.ValueSize, 1024),
+		},
+		Drops: kernelmap.NewMemoryMap(4, rules.DropStatsSize, rules.MaxRules),
+	}
+}
+
+// Run stands in for the BPF programs: every interval it counts a few random
+// packets between a fixed set of local and remote hosts into maps, and sends
+// a new flow event on events when it creates an entry. Received packets
+// matching the blocklist are dropped.
+func Run(ctx context.Context, maps Maps, interval time.Duration, events chan<- []byte) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for {
+		select {
+		case <-ticker.C:
+			for i := 0; i < 8; i++ {
+				family, local, remote := network.IPV4, localHosts, remoteHosts
+				if r.Intn(4) == 0 {
+					family, local, remote = network.IPV6, localHosts6, remoteHost6
+				}
+				key := network.IPKey{
+					Saddr:   local[r.Intn(len(local))],
+					Daddr:   remote[r.Intn(len(remote))],
+					Ifindex: interfaces[r.Intn(len(interfaces))].index,
+					Type:    family,
+				}
+				svc := services[r.Intn(len(services))]
+				key.Proto, key.Sport, key.Dport = svc.proto, uint16(40000+r.Intn(4)), svc.port
+				if svc.proto == network.ProtoICMP {
+					key.Sport, key.Dport = network.ICMPEchoRequest, 0
+					if family == network.IPV6 {
+						key.Proto, key.Sport = network.ProtoICMPv6, network.ICMPv6EchoRequest
+					}
+				}
+				// Local hosts sending is what the TC egress hook sees, replies
+				// come in through XDP.
+				direction := tracker.DirectionTx
+				if r.Intn(2) == 0 {
+					direction = tracker.DirectionRx
+					key = key.Reverse()
+					switch key.Proto {
+					case network.ProtoICMP:
+						key.Sport = network.ICMPEchoReply
+					case network.ProtoICMPv6:
+						key.Sport = network.ICMPv6EchoReply
+					}
+				}
+				size := uint64(64 + r.Intn(1400))
+				if direction == tracker.DirectionRx {
+					if drop(maps, key, size) {
+						continue
+					}
+					// Received packets are counted in the entry of the
+					// packets sent back.
+					key = key.Reverse()
+				}
+				ip, err := network.GenericToIp(key)
+				if err != nil {
+					continue
+				}
+				count(maps.Trackers[family], family, direction, ip, size, events)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drop mirrors blocked in xdp.bpf.c.
+func drop(maps Maps, key network.IPKey, size uint64) bool {
+	saddr, _ := netip.ParseAddr(key.Saddr)
+	daddr, _ := netip.ParseAddr(key.Daddr)
+	id, ok := rules.Match(maps.Blocklist, saddr, daddr, key.Proto, key.Dport)
+	if !ok {
+		return false
+	}
+	var s rules.DropStats
+	if v, err := maps.Drops.GetValue(unsafe.Pointer(&id)); err == nil {
+		s = rules.ParseDropStats(v)
+	}
+	s.Packets++
+	s.Bytes += size
+	v := s.KernelValue()
+	maps.Drops.Update(unsafe.Pointer(&id), unsafe.Pointer(&v[0]))
+	return true
+}
+
+// count mirrors the lookup/update done by count_packet in xdp.bpf.c.
+func count(m kernelmap.KernelMap, family int, direction uint32, ip any, size uint64, events chan<- []byte) {
+	if m == nil {
+		return
+	}
+	k := network.IpToKernelKey(ip)
+	kPtr := unsafe.Pointer(&k[0])
+
+	s := tracker.ConnectionStats{}
+	v, err := m.GetValue(kPtr)
+	isNew := err != nil
+	if !isNew {
+		s, _ = tracker.ParseConnectionStats(v)
+	}
+	s.Add(direction, 1, size)
+	v = s.KernelValue()
+	if err := m.Update(kPtr, unsafe.Pointer(&v[0])); err != nil || !isNew || events == nil {
+		return
+	}
+
+	e := tracker.NewFlowEvent{Family: uint32(family), Payload: uint32(size), Direction: direction}
+	copy(e.Key[:], k[:m.KeySize()])
+	// Like a full ring buffer, drop the event rather than block.
+	select {
+	case events <- e.Bytes():
+	default:
+	}
+}
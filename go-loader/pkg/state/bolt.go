@@ -0,0 +1,323 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltVersion is bumped whenever the layout of the buckets changes.
+const boltVersion = 1
+
+// Buckets of a bolt state file. Connections are keyed by tracker.FlowID,
+// devices by address and rules by name, all as JSON. byAddr and byHost hold
+// a sub-bucket per address and per resolved name whose keys are the flow ids
+// of its connections.
+var (
+	metaBucket        = []byte("meta")
+	connectionsBucket = []byte("connections")
+	devicesBucket     = []byte("devices")
+	rulesBucket       = []byte("rules")
+	byAddrBucket      = []byte("by_addr")
+	byHostBucket      = []byte("by_host")
+	versionKey        = []byte("version")
+)
+
+// openTimeout is how long the file lock is waited for, another process only
+// holds it for a single load or save.
+const openTimeout = 5 * time.Second
+
+// Bolt keeps the state in a bbolt file with indexes by address and host
+// name. Save only touches the connections that changed. The file is opened
+// for every call, so it can be read while the daemon runs.
+type Bolt struct {
+	path string
+}
+
+func NewBolt(path string) *Bolt {
+	return &Bolt{path: path}
+}
+
+func (b *Bolt) String() string {
+	return b.path
+}
+
+// view runs fn in a read transaction, or not at all when there is no file
+// yet.
+func (b *Bolt) view(fn func(tx *bolt.Tx) error) error {
+	if _, err := os.Stat(b.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := bolt.Open(b.path, 0o600, &bolt.Options{Timeout: openTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if err := checkVersion(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (b *Bolt) update(fn func(tx *bolt.Tx) error) error {
+	db, err := bolt.Open(b.path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", b.path, err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, connectionsBucket, devicesBucket, rulesBucket, byAddrBucket, byHostBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if err := checkVersion(tx); err != nil {
+			return err
+		}
+		if err := tx.Bucket(metaBucket).Put(versionKey, []byte(strconv.Itoa(boltVersion))); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func checkVersion(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return nil
+	}
+	v := meta.Get(versionKey)
+	if v == nil {
+		return nil
+	}
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return fmt.Errorf("invalid state version %q", v)
+	}
+	if version > boltVersion {
+		return fmt.Errorf("state version %d is newer than supported version %d", version, boltVersion)
+	}
+	return nil
+}
+
+func (b *Bolt) Load() (tracker.State, error) {
+	var s tracker.State
+	err := b.view(func(tx *bolt.Tx) error {
+		if err := decodeAll(tx.Bucket(connectionsBucket), &s.Connections); err != nil {
+			return err
+		}
+		if err := decodeAll(tx.Bucket(devicesBucket), &s.Devices); err != nil {
+			return err
+		}
+		return decodeAll(tx.Bucket(rulesBucket), &s.Rules)
+	})
+	return s, err
+}
+
+// Read is Load, which never changes the file.
+func (b *Bolt) Read() (tracker.State, error) {
+	return b.Load()
+}
+
+func decodeAll[T any](b *bolt.Bucket, out *[]T) error {
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		var item T
+		if err := json.Unmarshal(v, &item); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", k, err)
+		}
+		*out = append(*out, item)
+		return nil
+	})
+}
+
+func (b *Bolt) Save(s tracker.State) error {
+	return b.update(func(tx *bolt.Tx) error {
+		conns := tx.Bucket(connectionsBucket)
+		keep := make(map[string]bool, len(s.Connections))
+		for _, c := range s.Connections {
+			id := []byte(tracker.FlowID(c))
+			keep[string(id)] = true
+			v, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			old := conns.Get(id)
+			if bytes.Equal(old, v) {
+				continue
+			}
+			if old != nil {
+				if err := unindex(tx, id, old); err != nil {
+					return err
+				}
+			}
+			if err := conns.Put(id, v); err != nil {
+				return err
+			}
+			if err := index(tx, id, c); err != nil {
+				return err
+			}
+		}
+
+		// Deleting while iterating would skip keys.
+		type gone struct{ id, v []byte }
+		var removed []gone
+		err := conns.ForEach(func(k, v []byte) error {
+			if !keep[string(k)] {
+				removed = append(removed, gone{bytes.Clone(k), bytes.Clone(v)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, g := range removed {
+			if err := unindex(tx, g.id, g.v); err != nil {
+				return err
+			}
+			if err := conns.Delete(g.id); err != nil {
+				return err
+			}
+		}
+
+		if err := replace(tx, devicesBucket, s.Devices, func(d tracker.Device) string { return d.Addr }); err != nil {
+			return err
+		}
+		return replace(tx, rulesBucket, s.Rules, func(r rules.Rule) string { return r.Name })
+	})
+}
+
+// replace swaps the content of the bucket name for items, keyed by key.
+func replace[T any](tx *bolt.Tx, name []byte, items []T, key func(T) string) error {
+	if err := tx.DeleteBucket(name); err != nil {
+		return err
+	}
+	b, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		v, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(key(item)), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKeys returns the sub-buckets of byAddr and byHost c is listed in.
+func indexKeys(c tracker.Connection) map[string][]string {
+	return map[string][]string{
+		string(byAddrBucket): {c.Saddr, c.Daddr},
+		string(byHostBucket): append(append([]string(nil), c.SHost...), c.DHost...),
+	}
+}
+
+func index(tx *bolt.Tx, id []byte, c tracker.Connection) error {
+	for bucket, names := range indexKeys(c) {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			sb, err := tx.Bucket([]byte(bucket)).CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err := sb.Put(id, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindex removes the flow id of the stored connection old from the
+// indexes, and the sub-buckets left empty.
+func unindex(tx *bolt.Tx, id, old []byte) error {
+	var c tracker.Connection
+	if err := json.Unmarshal(old, &c); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", id, err)
+	}
+	for bucket, names := range indexKeys(c) {
+		b := tx.Bucket([]byte(bucket))
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			sb := b.Bucket([]byte(name))
+			if sb == nil {
+				continue
+			}
+			if err := sb.Delete(id); err != nil {
+				return err
+			}
+			if k, _ := sb.Cursor().First(); k == nil {
+				if err := b.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) ByAddr(addr string) ([]tracker.Connection, error) {
+	return b.lookup(byAddrBucket, addr)
+}
+
+func (b *Bolt) ByHost(host string) ([]tracker.Connection, error) {
+	return b.lookup(byHostBucket, host)
+}
+
+func (b *Bolt) lookup(bucket []byte, name string) ([]tracker.Connection, error) {
+	var out []tracker.Connection
+	err := b.view(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(bucket).Bucket([]byte(name))
+		if sb == nil {
+			return nil
+		}
+		conns := tx.Bucket(connectionsBucket)
+		return sb.ForEach(func(id, _ []byte) error {
+			v := conns.Get(id)
+			if v == nil {
+				return nil
+			}
+			var c tracker.Connection
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", id, err)
+			}
+			out = append(out, c)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (b *Bolt) Device(addr string) (tracker.Device, bool, error) {
+	var d tracker.Device
+	var found bool
+	err := b.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(devicesBucket).Get([]byte(addr))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &d)
+	})
+	return d, found, err
+}
@@ -0,0 +1,29 @@
+// Package state holds the storages the tracker state can be kept in, see
+// tracker.Storage.
+package state
+
+import (
+	"fmt"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	"go.uber.org/zap"
+)
+
+// Backends of Open.
+const (
+	BackendJSON = "json"
+	BackendBolt = "bolt"
+)
+
+// Open returns the storage of backend at path. Nothing is read or created
+// until it is used.
+func Open(backend, path string, l *zap.Logger) (tracker.Storage, error) {
+	switch backend {
+	case BackendJSON:
+		return tracker.NewFileStorage(path, l), nil
+	case BackendBolt:
+		return NewBolt(path), nil
+	default:
+		return nil, fmt.Errorf("unknown state backend %q, expected json or bolt", backend)
+	}
+}
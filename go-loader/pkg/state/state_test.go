@@ -0,0 +1,173 @@
+package state
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/tracker"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+var (
+	dns = tracker.Connection{
+		Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 53, Proto: network.ProtoUDP, Type: network.IPV4,
+		SHost: []string{"laptop.lan."}, DHost: []string{"one.one.one.one."},
+		ConnectionStats: tracker.ConnectionStats{TxPackets: 1, TxBytes: 70, RxPackets: 1, RxBytes: 150},
+	}
+	web = tracker.Connection{
+		Saddr: "192.168.1.20", Daddr: "1.1.1.1", Sport: 40001, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4,
+		DHost:           []string{"one.one.one.one."},
+		ConnectionStats: tracker.ConnectionStats{TxPackets: 10, TxBytes: 1000, RxPackets: 20, RxBytes: 20000},
+	}
+	laptop = tracker.Device{Addr: "192.168.1.10", Names: []string{"laptop.lan."}, FirstSeen: time.Unix(1700000000, 0).UTC(), LastSeen: time.Unix(1700000600, 0).UTC()}
+)
+
+// saddrs returns the sources of conns, sorted.
+func saddrs(conns []tracker.Connection) []string {
+	var out []string
+	for _, c := range conns {
+		out = append(out, c.Saddr)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Both backends behave the same, only their layout on disk differs.
+func TestStorage(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			s, err := Open(backend, filepath.Join(t.TempDir(), "state"), zap.NewNop())
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if got, err := s.Load(); err != nil || len(got.Connections) != 0 {
+				t.Fatalf("empty storage loaded %+v, %v", got, err)
+			}
+			if _, found, err := s.Device(laptop.Addr); found || err != nil {
+				t.Fatalf("empty storage found a device, %v", err)
+			}
+
+			want := tracker.State{
+				Connections: []tracker.Connection{dns, web},
+				Devices:     []tracker.Device{laptop},
+				Rules:       []rules.Rule{{Name: "doc", CIDR: "192.0.2.0/24"}},
+			}
+			if err := s.Save(want); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			got, err := s.Load()
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !slices.Equal(saddrs(got.Connections), saddrs(want.Connections)) ||
+				!reflect.DeepEqual(got.Devices, want.Devices) || !reflect.DeepEqual(got.Rules, want.Rules) {
+				t.Errorf("loaded %+v, want %+v", got, want)
+			}
+
+			lookups := []struct {
+				name string
+				get  func() ([]tracker.Connection, error)
+				want []string
+			}{
+				{"addr of both", func() ([]tracker.Connection, error) { return s.ByAddr("1.1.1.1") }, []string{"192.168.1.10", "192.168.1.20"}},
+				{"addr of one", func() ([]tracker.Connection, error) { return s.ByAddr("192.168.1.20") }, []string{"192.168.1.20"}},
+				{"unknown addr", func() ([]tracker.Connection, error) { return s.ByAddr("192.168.1.30") }, nil},
+				{"host of one", func() ([]tracker.Connection, error) { return s.ByHost("laptop.lan.") }, []string{"192.168.1.10"}},
+				{"host of both", func() ([]tracker.Connection, error) { return s.ByHost("one.one.one.one.") }, []string{"192.168.1.10", "192.168.1.20"}},
+			}
+			for _, l := range lookups {
+				conns, err := l.get()
+				if err != nil {
+					t.Fatalf("%s: %v", l.name, err)
+				}
+				if got := saddrs(conns); !slices.Equal(got, l.want) {
+					t.Errorf("%s: found %v, want %v", l.name, got, l.want)
+				}
+			}
+			if d, found, err := s.Device(laptop.Addr); err != nil || !found || !reflect.DeepEqual(d, laptop) {
+				t.Errorf("Device = %+v, %v, %v, want %+v", d, found, err, laptop)
+			}
+
+			// Saving again replaces what was stored, indexes included.
+			renamed := dns
+			renamed.SHost = []string{"desktop.lan."}
+			if err := s.Save(tracker.State{Connections: []tracker.Connection{renamed}}); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			for name, want := range map[string][]string{"laptop.lan.": nil, "desktop.lan.": {"192.168.1.10"}} {
+				conns, err := s.ByHost(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := saddrs(conns); !slices.Equal(got, want) {
+					t.Errorf("after saving again %s found %v, want %v", name, got, want)
+				}
+			}
+			if conns, _ := s.ByAddr("192.168.1.20"); len(conns) != 0 {
+				t.Errorf("removed connection still found: %+v", conns)
+			}
+			if got, _ := s.Load(); len(got.Devices) != 0 || len(got.Rules) != 0 {
+				t.Errorf("devices and rules left after saving none: %+v", got)
+			}
+		})
+	}
+}
+
+func TestBoltNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucket(metaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(versionKey, []byte(strconv.Itoa(boltVersion+1)))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewBolt(path)
+	if _, err := s.Load(); err == nil {
+		t.Error("a newer state file was loaded")
+	}
+	if err := s.Save(tracker.State{}); err == nil {
+		t.Error("a newer state file was overwritten")
+	}
+}
+
+// Read leaves a corrupt state file alone and reports it, migrate relies on it.
+func TestReadCorrupt(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			garbage := bytes.Repeat([]byte("not a state file "), 512)
+			if err := os.WriteFile(path, garbage, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Open(backend, path, zap.NewNop())
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if got, err := s.Read(); err == nil {
+				t.Errorf("corrupt file read as %+v", got)
+			}
+			if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, garbage) {
+				t.Errorf("corrupt file changed by Read: %v", err)
+			}
+		})
+	}
+}
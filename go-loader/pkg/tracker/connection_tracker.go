@@ -4,14 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
 	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
-	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/resolver"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
 	"go.uber.org/zap"
 )
 
@@ -20,30 +26,114 @@ type UserSpaceMap struct {
 }
 
 type ConnectionTracker struct {
-	Data               UserSpaceMap
-	expirationDuration time.Duration
-	checkInterval      time.Duration
-	kernelMap          *bpf.BPFMap
-	l                  *zap.Logger
+	Data            UserSpaceMap
+	inactiveTimeout time.Duration
+	activeTimeout   time.Duration
+	checkInterval   time.Duration
+	kernelMaps      map[int]kernelmap.KernelMap
+	harvest         harvestState
+	harvestMu       sync.Mutex
+	resolver        *resolver.Resolver
+	blocklist       *rules.Blocklist
+	events          atomic.Pointer[EventHandler]
+	hooksMu         sync.Mutex
+	hooks           []ExpiryHook
+	// devices are the local addresses seen in a flow so far, as Device.
+	devices sync.Map
+	l       *zap.Logger
 }
 
+// EventHandler is told about what the tracker sees, see SetEventHandler. It
+// is called from the tracker's goroutines and must not block.
+type EventHandler interface {
+	NewFlow(c Connection)
+	// NewHost is called with the first flow a local address is seen in.
+	NewHost(addr string, c Connection)
+	FlowExpired(c Connection)
+}
+
+// ConnectionStats mirrors struct connection_stats. Rx is counted by the
+// ingress hook (XDP, or TC when XDP is not used) and tx by the TC egress
+// classifier. Tx are the packets Saddr sent to Daddr and rx the ones it got
+// back.
 type ConnectionStats struct {
-	Packets uint64 `json:"packets"`
-	Bytes   uint64 `json:"bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+}
+
+// Directions of a packet, in the order of struct connection_stats.
+const (
+	DirectionRx uint32 = iota
+	DirectionTx
+)
+
+func (s ConnectionStats) Packets() uint64 {
+	return s.RxPackets + s.TxPackets
+}
+
+func (s ConnectionStats) Bytes() uint64 {
+	return s.RxBytes + s.TxBytes
+}
+
+// Sent is the tx half of s, what Saddr sent.
+func (s ConnectionStats) Sent() ConnectionStats {
+	return ConnectionStats{TxPackets: s.TxPackets, TxBytes: s.TxBytes}
 }
 
+// Received is the rx half of s, what Daddr sent.
+func (s ConnectionStats) Received() ConnectionStats {
+	return ConnectionStats{RxPackets: s.RxPackets, RxBytes: s.RxBytes}
+}
+
+// Add counts packets seen in direction.
+func (s *ConnectionStats) Add(direction uint32, packets, bytes uint64) {
+	if direction == DirectionTx {
+		s.TxPackets += packets
+		s.TxBytes += bytes
+		return
+	}
+	s.RxPackets += packets
+	s.RxBytes += bytes
+}
+
+// Connection is both directions of a conversation, keyed like the packets
+// sent on the interface: Saddr is the end on this side of it.
 type Connection struct {
 	ConnectionStats
-	Saddr string   `json:"saddr"`
-	Daddr string   `json:"addr"`
-	SHost []string `json:"sHost"`
-	DHost []string `json:"dHost"`
-	Type  int      `json:"type"`
+	Saddr string `json:"saddr"`
+	Daddr string `json:"addr"`
+	Sport uint16 `json:"sport"`
+	Dport uint16 `json:"dport"`
+	Proto uint8  `json:"proto"`
+	// Ifindex and Interface are where the flow was counted. The name is
+	// kept so a snapshot survives interfaces being renumbered.
+	Ifindex   uint32   `json:"ifindex"`
+	Interface string   `json:"interface"`
+	SHost     []string `json:"sHost"`
+	DHost     []string `json:"dHost"`
+	Type      int      `json:"type"`
+	// Initiator is the end that opened the flow, guessed when it is first
+	// seen, see initiator.
+	Initiator string `json:"initiator"`
+	// Scope is network.Scope from the initiator, recomputed whenever the
+	// flow is stored as the local networks may have changed.
+	Scope string `json:"scope"`
+	// Rates are recomputed on every harvest, they start over after a
+	// restart.
+	Rates Rates `json:"rates"`
+	// FirstSeen is when the flow was first seen and LastSeen when its
+	// counters last moved, Duration is the seconds in between.
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Duration  float64   `json:"duration"`
 }
 
 type Entry struct {
 	Connection  Connection `json:"connection"`
 	LastUpdated int64      `json:"last_updated"`
+	rates       *rateRing
 }
 
 type ConnectionKey = [64]byte
@@ -62,6 +152,9 @@ func (m *UserSpaceMap) ToSilce() []Connection {
 	return conns
 }
 
+// Size of struct connection_stats in xdp.bpf.c.
+const ConnectionStatsSize = 32
+
 func ParseConnectionStats(stats []byte) (ConnectionStats, error) {
 	var d ConnectionStats
 	r := bytes.NewReader(stats)
@@ -69,55 +162,240 @@ func ParseConnectionStats(stats []byte) (ConnectionStats, error) {
 	return d, err
 }
 
+// KernelValue encodes s the way the kernel stores struct connection_stats.
+func (s ConnectionStats) KernelValue() []byte {
+	v := make([]byte, ConnectionStatsSize)
+	binary.NativeEndian.PutUint64(v[0:8], s.RxPackets)
+	binary.NativeEndian.PutUint64(v[8:16], s.RxBytes)
+	binary.NativeEndian.PutUint64(v[16:24], s.TxPackets)
+	binary.NativeEndian.PutUint64(v[24:32], s.TxBytes)
+	return v
+}
+
+// NewConnection builds a Connection out of a parsed IPv4 or IPv6 kernel key.
+func NewConnection(ip any, s ConnectionStats) Connection {
+	switch ip := ip.(type) {
+	case network.IPv4:
+		return Connection{
+			ConnectionStats: s,
+			Saddr:           network.IntToIPv4(ip.Saddr).String(),
+			Daddr:           network.IntToIPv4(ip.Daddr).String(),
+			Sport:           ip.Sport,
+			Dport:           ip.Dport,
+			Proto:           ip.Proto,
+			Ifindex:         ip.Ifindex,
+			Interface:       network.InterfaceName(ip.Ifindex),
+			Type:            network.IPV4,
+		}
+	case network.IPv6:
+		return Connection{
+			ConnectionStats: s,
+			Saddr:           net.IP(ip.Saddr.Addr[:]).String(),
+			Daddr:           net.IP(ip.Daddr.Addr[:]).String(),
+			Sport:           ip.Sport,
+			Dport:           ip.Dport,
+			Proto:           ip.Proto,
+			Ifindex:         ip.Ifindex,
+			Interface:       network.InterfaceName(ip.Ifindex),
+			Type:            network.IPV6,
+		}
+	default:
+		return Connection{ConnectionStats: s}
+	}
+}
+
+// NewConnectionTracker expects the kernel maps keyed by network.IPV4 and
+// network.IPV6. A nil resolver leaves the host names empty. Flows are
+// expired every checkInterval, see Monitor, an activeTimeout of 0 only
+// expires them once inactive.
 func NewConnectionTracker(ctx context.Context,
-	expirationDuration,
+	inactiveTimeout,
+	activeTimeout,
 	checkInterval time.Duration,
-	m *bpf.BPFMap,
+	kernelMaps map[int]kernelmap.KernelMap,
+	r *resolver.Resolver,
 	l *zap.Logger) *ConnectionTracker {
 	ct := &ConnectionTracker{
-		Data:               UserSpaceMap{},
-		expirationDuration: expirationDuration,
-		checkInterval:      checkInterval,
-		kernelMap:          m,
-		l:                  l,
+		Data:            UserSpaceMap{},
+		inactiveTimeout: inactiveTimeout,
+		activeTimeout:   activeTimeout,
+		checkInterval:   checkInterval,
+		kernelMaps:      kernelMaps,
+		harvest: harvestState{
+			stats:   make(map[int]HarvestStats),
+			noBatch: make(map[int]bool),
+		},
+		resolver: r,
+		l:        l,
 	}
 	go ct.Monitor(ctx)
 	return ct
 }
 
+// SetEventHandler starts reporting events to h. It is meant to be called
+// once the state is restored, so restored flows are not reported as new.
+func (m *ConnectionTracker) SetEventHandler(h EventHandler) {
+	m.events.Store(&h)
+}
+
+func (m *ConnectionTracker) eventHandler() EventHandler {
+	if h := m.events.Load(); h != nil {
+		return *h
+	}
+	return nil
+}
+
+// Store never waits on DNS, the host names come from the resolver cache and
+// are filled in by a later Store once the lookup is done.
 func (m *ConnectionTracker) Store(k ConnectionKey, v Connection) {
+	m.store(k, v, false)
+}
+
+// store keeps the devices' last seen time when restored is set, the
+// counters of a restored flow did not just move.
+func (m *ConnectionTracker) store(k ConnectionKey, v Connection, restored bool) {
+	var rates *rateRing
+	var prev ConnectionStats
+	now := time.Now()
 	if entry, ok := m.Data.Load(k); ok {
 		v.SHost = entry.(Entry).Connection.SHost
-		if v.SHost == nil {
-			v.SHost = []string{"nil"}
-		}
 		v.DHost = entry.(Entry).Connection.DHost
-		if v.DHost == nil {
-			v.DHost = []string{"nil"}
+		v.FirstSeen = entry.(Entry).Connection.FirstSeen
+		v.LastSeen = entry.(Entry).Connection.LastSeen
+		v.Initiator = entry.(Entry).Connection.Initiator
+		rates = entry.(Entry).rates
+		prev = entry.(Entry).Connection.ConnectionStats
+		if v.ConnectionStats != prev {
+			v.LastSeen = now
 		}
-
-		m.Data.Store(k, Entry{
-			Connection:  v,
-			LastUpdated: time.Now().UnixMilli(),
-		})
+	}
+	// Restored flows keep their times, older snapshots had none.
+	if v.FirstSeen.IsZero() {
+		v.FirstSeen = now
+	}
+	if v.LastSeen.IsZero() {
+		v.LastSeen = now
+	}
+	v.Duration = v.LastSeen.Sub(v.FirstSeen).Seconds()
+	v.SHost = m.hostnames(v.Saddr, v.SHost)
+	v.DHost = m.hostnames(v.Daddr, v.DHost)
+	// Restored flows keep theirs, older snapshots had none.
+	if v.Initiator == "" {
+		v.Initiator = initiator(v)
+	}
+	if v.Initiator == v.Saddr {
+		v.Scope = network.Scope(v.Saddr, v.Daddr)
 	} else {
-		var err error
-		v.SHost, err = net.LookupAddr(v.Saddr)
-		if err != nil {
-			m.l.Sugar().Debugf("lookup for saddr %s failed with: %s", v.Saddr, err)
-			v.SHost = []string{"nil"}
+		v.Scope = network.Scope(v.Daddr, v.Saddr)
+	}
+	if rates == nil {
+		rates = &rateRing{}
+	}
+	v.Rates = rates.add(now, v.ConnectionStats)
+
+	_, known := m.Data.Swap(k, Entry{
+		Connection:  v,
+		LastUpdated: now.UnixMilli(),
+		rates:       rates,
+	})
+	var newHosts []string
+	if !known || v.ConnectionStats != prev {
+		newHosts = m.seeDevices(now, v, restored)
+	}
+	if !known {
+		m.newFlow(v, newHosts)
+	}
+}
+
+// initiator guesses the end that opened c when it is first seen. With ports
+// it is the client, on the higher, ephemeral, port: the first harvest may
+// well only have seen the replies. Otherwise it is the end that sent, unless
+// that is an ICMP reply or error.
+func initiator(c Connection) string {
+	sender, receiver := c.Saddr, c.Daddr
+	if c.TxPackets == 0 && c.RxPackets > 0 {
+		sender, receiver = c.Daddr, c.Saddr
+	}
+	switch {
+	case network.IsICMP(c.Proto):
+		if !network.IsICMPRequest(c.Proto, c.Sport) {
+			return receiver
 		}
-		v.DHost, err = net.LookupAddr(v.Daddr)
-		if err != nil {
-			m.l.Sugar().Debugf("lookup for daddr %s failed with: %s", v.Daddr, err)
-			v.DHost = []string{"nil"}
+	case c.Sport > c.Dport:
+		return c.Saddr
+	case c.Sport < c.Dport:
+		return c.Daddr
+	}
+	return sender
+}
+
+// seeDevices updates the devices of the local ends of c and returns the
+// addresses seen for the first time.
+func (m *ConnectionTracker) seeDevices(now time.Time, c Connection, restored bool) []string {
+	var newHosts []string
+	for _, end := range []struct {
+		addr  string
+		names []string
+	}{{c.Saddr, c.SHost}, {c.Daddr, c.DHost}} {
+		if !network.IsLocal(end.addr) {
+			continue
 		}
+		d := Device{Addr: end.addr, FirstSeen: now, LastSeen: now}
+		if v, seen := m.devices.LoadOrStore(end.addr, d); seen {
+			if restored {
+				continue
+			}
+			d.FirstSeen = v.(Device).FirstSeen
+		} else {
+			newHosts = append(newHosts, end.addr)
+		}
+		d.Names, d.Interface = end.names, c.Interface
+		m.devices.Store(end.addr, d)
+	}
+	return newHosts
+}
 
-		m.Data.Store(k, Entry{
-			Connection:  v,
-			LastUpdated: time.Now().UnixMilli(),
-		})
+func (m *ConnectionTracker) newFlow(c Connection, newHosts []string) {
+	h := m.eventHandler()
+	if h == nil {
+		return
 	}
+	h.NewFlow(c)
+	for _, addr := range newHosts {
+		h.NewHost(addr, c)
+	}
+}
+
+// Devices returns the local addresses seen so far, sorted by address.
+func (m *ConnectionTracker) Devices() []Device {
+	var out []Device
+	m.devices.Range(func(_, v any) bool {
+		out = append(out, v.(Device))
+		return true
+	})
+	slices.SortFunc(out, func(a, b Device) int { return strings.Compare(a.Addr, b.Addr) })
+	return out
+}
+
+func (m *ConnectionTracker) restoreDevices(devices []Device) {
+	for _, d := range devices {
+		m.devices.Store(d.Addr, d)
+	}
+}
+
+// hostnames returns the resolved names of addr, or known until the resolver
+// has an answer.
+func (m *ConnectionTracker) hostnames(addr string, known []string) []string {
+	if m.resolver != nil {
+		if names, ok := m.resolver.Lookup(addr); ok {
+			return names
+		}
+	}
+	// Older snapshots stored failed lookups as "nil".
+	if len(known) == 1 && known[0] == "nil" {
+		return nil
+	}
+	return known
 }
 
 func (m *ConnectionTracker) Load(key ConnectionKey) (Connection, bool) {
@@ -146,71 +424,49 @@ func (m *ConnectionTracker) removeOldestEntry() {
 	m.l.Sugar().Info("Removed oldest entry with timestamp: ", oldestTimestamp)
 }
 
-func (m *ConnectionTracker) Monitor(ctx context.Context) {
-	ticker := time.NewTicker(m.checkInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			now := time.Now().UnixMilli()
-			m.Data.Range(func(key, value any) bool {
-				entry := value.(Entry)
-				if now >= entry.LastUpdated+m.expirationDuration.Milliseconds() {
-					m.OnExpire(key.(ConnectionKey))
-					m.Data.Delete(key)
-				}
-				return true
-			})
-		case <-ctx.Done():
-			return
-		}
-	}
+// SetBlocklist makes snapshots keep the rules added to b at runtime.
+func (m *ConnectionTracker) SetBlocklist(b *rules.Blocklist) {
+	m.blocklist = b
 }
 
-func (m *ConnectionTracker) OnExpire(key ConnectionKey) {
-	m.Data.Delete(key)
-	if m.kernelMap != nil {
-		k := key
-		kPtr := unsafe.Pointer(&k[0])
-		if err := m.kernelMap.DeleteKey(kPtr); err != nil {
-			m.l.Sugar().Errorf("Failed to delete %v due to %v", key, err)
-			panic("failed to delete")
+func (m *ConnectionTracker) restoreConnections(conns []Connection) {
+	for _, conn := range conns {
+		if ifindex, ok := network.InterfaceIndex(conn.Interface); conn.Interface != "" && ok {
+			conn.Ifindex = ifindex
 		}
-	} else {
-		m.l.Sugar().Fatalf("Kernel map not set")
-	}
-}
-
-func (m *ConnectionTracker) JsonFileToTrackerData(data []byte) {
-	var connections []Connection
-	if err := json.Unmarshal(data, &connections); err != nil {
-		m.l.Sugar().Errorf("Failed to unmarshal data %v", err)
-		panic("failed to unmarshal")
-	}
-
-	for _, conn := range connections {
-		ipKey := network.IPKey{Saddr: conn.Saddr, Daddr: conn.Daddr, Type: conn.Type}
-		x := network.GenericToIp(ipKey)
-		m.Store(network.IpToKernelKey(x), conn)
+		ipKey := network.IPKey{
+			Saddr: conn.Saddr, Daddr: conn.Daddr, Sport: conn.Sport, Dport: conn.Dport,
+			Proto: conn.Proto, Ifindex: conn.Ifindex, Type: conn.Type,
+		}
+		x, err := network.GenericToIp(ipKey)
+		if err != nil {
+			m.l.Sugar().Warnf("Skipping stored connection %s -> %s: %v", conn.Saddr, conn.Daddr, err)
+			continue
+		}
+		m.store(network.IpToKernelKey(x), conn, true)
 	}
 }
 
-func (m *ConnectionTracker) DataToKernelMap() {
+// DataToKernelMap pushes Data into the kernel maps. Every entry is attempted,
+// the returned error joins all the failures.
+func (m *ConnectionTracker) DataToKernelMap() error {
+	var errs []error
 	m.Data.Range(func(key, value any) bool {
 		entry := value.(Entry)
 		k := key.(ConnectionKey)
+		kernelMap := m.kernelMaps[network.KernelKeyFamily(k)]
+		if kernelMap == nil {
+			m.l.Sugar().Warnf("No kernel map for %v, skipping", entry.Connection)
+			return true
+		}
 		kPtr := unsafe.Pointer(&k[0])
-		v := entry.Connection.ConnectionStats
-		vBytes := make([]byte, 16)
-		binary.LittleEndian.PutUint64(vBytes[:8], v.Packets)
-		binary.LittleEndian.PutUint64(vBytes[8:], v.Bytes)
-		if err := m.kernelMap.Update(kPtr, unsafe.Pointer(&vBytes[0])); err != nil {
-			m.l.Sugar().Errorf("Failed to update %v due to %v", key, err)
-			panic("failed to update")
+		vBytes := entry.Connection.ConnectionStats.KernelValue()
+		if err := kernelMap.Update(kPtr, unsafe.Pointer(&vBytes[0])); err != nil {
+			errs = append(errs, fmt.Errorf("failed to update %s -> %s: %w", entry.Connection.Saddr, entry.Connection.Daddr, err))
 		}
 		return true
 	})
+	return errors.Join(errs...)
 }
 
 func (m *ConnectionTracker) LogData() {
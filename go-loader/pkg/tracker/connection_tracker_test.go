@@ -0,0 +1,203 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"go.uber.org/zap"
+)
+
+// newTestTracker returns a tracker over empty in-memory kernel maps. Its
+// Monitor never ticks during a test, expireFlows is called directly.
+func newTestTracker(t *testing.T, inactive, active time.Duration) (*ConnectionTracker, map[int]*kernelmap.MemoryMap) {
+	t.Helper()
+	maps := map[int]*kernelmap.MemoryMap{
+		network.IPV4: kernelmap.NewMemoryMap(network.IPv4KeySize, ConnectionStatsSize, 4096),
+		network.IPV6: kernelmap.NewMemoryMap(network.IPv6KeySize, ConnectionStatsSize, 4096),
+	}
+	kernelMaps := make(map[int]kernelmap.KernelMap, len(maps))
+	for family, m := range maps {
+		kernelMaps[family] = m
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return NewConnectionTracker(ctx, inactive, active, time.Hour, kernelMaps, nil, zap.NewNop()), maps
+}
+
+func kernelKey(t *testing.T, key network.IPKey) ConnectionKey {
+	t.Helper()
+	ip, err := network.GenericToIp(key)
+	if err != nil {
+		t.Fatalf("GenericToIp(%v): %v", key, err)
+	}
+	return network.IpToKernelKey(ip)
+}
+
+// putKernel sets the counters of key in m like the BPF program would.
+func putKernel(t *testing.T, m *kernelmap.MemoryMap, key network.IPKey, s ConnectionStats) ConnectionKey {
+	t.Helper()
+	k := kernelKey(t, key)
+	v := s.KernelValue()
+	if err := m.Update(unsafe.Pointer(&k[0]), unsafe.Pointer(&v[0])); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	return k
+}
+
+type recordedEvents struct {
+	mu      sync.Mutex
+	flows   []Connection
+	hosts   []string
+	expired []Connection
+}
+
+func (r *recordedEvents) NewFlow(c Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flows = append(r.flows, c)
+}
+
+func (r *recordedEvents) NewHost(addr string, c Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts = append(r.hosts, addr)
+}
+
+func (r *recordedEvents) FlowExpired(c Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expired = append(r.expired, c)
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name string
+		key  network.IPKey
+		// updates are stored in turn under key.
+		updates       []ConnectionStats
+		wantStats     ConnectionStats
+		wantInitiator string
+		wantScope     string
+		// moved is whether LastSeen moved with the last update.
+		moved bool
+	}{
+		{
+			name:          "new flow",
+			key:           network.IPKey{Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4},
+			updates:       []ConnectionStats{{TxPackets: 1, TxBytes: 60}},
+			wantStats:     ConnectionStats{TxPackets: 1, TxBytes: 60},
+			wantInitiator: "192.168.1.10",
+			wantScope:     network.ScopeOutbound,
+		},
+		{
+			name:          "counters moved",
+			key:           network.IPKey{Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4},
+			updates:       []ConnectionStats{{TxPackets: 1, TxBytes: 60}, {RxPackets: 2, RxBytes: 3000, TxPackets: 3, TxBytes: 180}},
+			wantStats:     ConnectionStats{RxPackets: 2, RxBytes: 3000, TxPackets: 3, TxBytes: 180},
+			wantInitiator: "192.168.1.10",
+			wantScope:     network.ScopeOutbound,
+			moved:         true,
+		},
+		{
+			name:          "counters unchanged",
+			key:           network.IPKey{Saddr: "fd00::10", Daddr: "2606:4700:4700::1111", Sport: 40000, Dport: 53, Proto: network.ProtoUDP, Type: network.IPV6},
+			updates:       []ConnectionStats{{TxPackets: 1, TxBytes: 60}, {TxPackets: 1, TxBytes: 60}},
+			wantStats:     ConnectionStats{TxPackets: 1, TxBytes: 60},
+			wantInitiator: "fd00::10",
+			wantScope:     network.ScopeOutbound,
+		},
+		{
+			name:          "lan flow",
+			key:           network.IPKey{Saddr: "192.168.1.10", Daddr: "192.168.1.20", Sport: 40000, Dport: 22, Proto: network.ProtoTCP, Type: network.IPV4},
+			updates:       []ConnectionStats{{RxPackets: 1, RxBytes: 60}},
+			wantStats:     ConnectionStats{RxPackets: 1, RxBytes: 60},
+			wantInitiator: "192.168.1.10",
+			wantScope:     network.ScopeLAN,
+		},
+		{
+			name:          "from the internet",
+			key:           network.IPKey{Saddr: "203.0.113.5", Daddr: "192.168.1.10", Sport: 50000, Dport: 22, Proto: network.ProtoTCP, Type: network.IPV4},
+			updates:       []ConnectionStats{{TxPackets: 1, TxBytes: 60}},
+			wantStats:     ConnectionStats{TxPackets: 1, TxBytes: 60},
+			wantInitiator: "203.0.113.5",
+			wantScope:     network.ScopeInbound,
+		},
+		{
+			name:          "port forward first seen as replies",
+			key:           network.IPKey{Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 22, Dport: 50000, Proto: network.ProtoTCP, Type: network.IPV4},
+			updates:       []ConnectionStats{{TxPackets: 1, TxBytes: 60}},
+			wantStats:     ConnectionStats{TxPackets: 1, TxBytes: 60},
+			wantInitiator: "1.1.1.1",
+			wantScope:     network.ScopeInbound,
+		},
+		{
+			name:          "echo reply received",
+			key:           network.IPKey{Saddr: "fd00::10", Daddr: "2606:4700:4700::1111", Sport: network.ICMPv6EchoReply, Proto: network.ProtoICMPv6, Type: network.IPV6},
+			updates:       []ConnectionStats{{RxPackets: 1, RxBytes: 64}},
+			wantStats:     ConnectionStats{RxPackets: 1, RxBytes: 64},
+			wantInitiator: "fd00::10",
+			wantScope:     network.ScopeOutbound,
+		},
+		{
+			name:          "echo request received",
+			key:           network.IPKey{Saddr: "192.168.1.10", Daddr: "192.168.1.20", Sport: network.ICMPEchoRequest, Proto: network.ProtoICMP, Type: network.IPV4},
+			updates:       []ConnectionStats{{RxPackets: 1, RxBytes: 64}},
+			wantStats:     ConnectionStats{RxPackets: 1, RxBytes: 64},
+			wantInitiator: "192.168.1.20",
+			wantScope:     network.ScopeLAN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, _ := newTestTracker(t, time.Hour, 0)
+			events := &recordedEvents{}
+			ct.SetEventHandler(events)
+			ip, err := network.GenericToIp(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k := network.IpToKernelKey(ip)
+
+			var first Connection
+			for i, s := range tt.updates {
+				if i > 0 {
+					time.Sleep(time.Millisecond)
+				}
+				ct.Store(k, NewConnection(ip, s))
+				if i == 0 {
+					first, _ = ct.Load(k)
+				}
+			}
+			c, ok := ct.Load(k)
+			if !ok {
+				t.Fatal("flow not stored")
+			}
+			if c.ConnectionStats != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", c.ConnectionStats, tt.wantStats)
+			}
+			if c.Initiator != tt.wantInitiator {
+				t.Errorf("initiator = %s, want %s", c.Initiator, tt.wantInitiator)
+			}
+			if c.Scope != tt.wantScope {
+				t.Errorf("scope = %s, want %s", c.Scope, tt.wantScope)
+			}
+			if !c.FirstSeen.Equal(first.FirstSeen) || first.FirstSeen.IsZero() {
+				t.Errorf("first seen %s changed from %s", c.FirstSeen, first.FirstSeen)
+			}
+			if moved := c.LastSeen.After(first.LastSeen); moved != tt.moved {
+				t.Errorf("last seen moved = %v, want %v", moved, tt.moved)
+			}
+			if len(events.flows) != 1 {
+				t.Errorf("%d new flow events, want 1", len(events.flows))
+			}
+			if got := len(ct.Data.ToSilce()); got != 1 {
+				t.Errorf("%d flows tracked, want 1", got)
+			}
+		})
+	}
+}
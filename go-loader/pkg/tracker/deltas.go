@@ -0,0 +1,48 @@
+package tracker
+
+import "fmt"
+
+// FlowID identifies a flow across harvests.
+func FlowID(c Connection) string {
+	return fmt.Sprintf("%d|%s|%d|%s|%d|%d", c.Proto, c.Saddr, c.Sport, c.Daddr, c.Dport, c.Ifindex)
+}
+
+// Delta is what a flow moved between two samples.
+type Delta struct {
+	Connection
+	Moved ConnectionStats
+}
+
+// Deltas turns successive samples of the flows, such as the ones taken on
+// every harvest, into what each flow moved in between. Flows not seen in the
+// previous sample moved all of their counters.
+type Deltas struct {
+	last map[string]ConnectionStats
+}
+
+func (d *Deltas) Next(conns []Connection) []Delta {
+	out := make([]Delta, 0, len(conns))
+	last := make(map[string]ConnectionStats, len(conns))
+	for _, c := range conns {
+		id := FlowID(c)
+		last[id] = c.ConnectionStats
+		prev := d.last[id]
+		out = append(out, Delta{Connection: c, Moved: ConnectionStats{
+			RxPackets: sub(c.RxPackets, prev.RxPackets),
+			RxBytes:   sub(c.RxBytes, prev.RxBytes),
+			TxPackets: sub(c.TxPackets, prev.TxPackets),
+			TxBytes:   sub(c.TxBytes, prev.TxBytes),
+		}})
+	}
+	d.last = last
+	return out
+}
+
+// sub is a - b, or a when the counter went backwards because the flow was
+// expired and came back.
+func sub(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return a - b
+}
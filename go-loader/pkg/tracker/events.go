@@ -0,0 +1,75 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+// NewFlowEvent mirrors struct new_flow_event, sent by the XDP program through
+// the new_flow_events ring buffer when it creates a map entry.
+type NewFlowEvent struct {
+	Family    uint32
+	Payload   uint32
+	Direction uint32
+	Key       ConnectionKey
+}
+
+func ParseNewFlowEvent(b []byte) (NewFlowEvent, error) {
+	var e NewFlowEvent
+	err := binary.Read(bytes.NewReader(b), binary.NativeEndian, &e)
+	return e, err
+}
+
+func (e NewFlowEvent) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.NativeEndian, e)
+	return buf.Bytes()
+}
+
+// HandleNewFlow stores the flow announced by a raw new flow event right away,
+// so it shows up before the next harvest. Flows already known are left to
+// the harvest, which has more recent counters. It holds off Harvest, which
+// could store the flow between the check and the Store and have its
+// counters replaced by the event's single packet.
+func (m *ConnectionTracker) HandleNewFlow(raw []byte) error {
+	e, err := ParseNewFlowEvent(raw)
+	if err != nil {
+		return err
+	}
+	kData, err := network.ParseKey(int(e.Family), e.Key[:])
+	if err != nil {
+		return err
+	}
+
+	k := network.IpToKernelKey(kData)
+	m.harvestMu.Lock()
+	defer m.harvestMu.Unlock()
+	if _, ok := m.Data.Load(k); ok {
+		return nil
+	}
+	var s ConnectionStats
+	s.Add(e.Direction, 1, uint64(e.Payload))
+	m.Store(k, NewConnection(kData, s))
+	return nil
+}
+
+// ListenToEvents feeds raw new flow events to HandleNewFlow until ctx is done
+// or events is closed.
+func (m *ConnectionTracker) ListenToEvents(ctx context.Context, events <-chan []byte) {
+	for {
+		select {
+		case raw, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := m.HandleNewFlow(raw); err != nil {
+				m.l.Sugar().Errorf("Failed to handle new flow event: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
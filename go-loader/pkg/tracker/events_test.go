@@ -0,0 +1,142 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"go.uber.org/zap"
+)
+
+func newFlowEvent(t *testing.T, key network.IPKey, direction, payload uint32) (ConnectionKey, []byte) {
+	t.Helper()
+	ip, err := network.GenericToIp(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := network.IpToKernelKey(ip)
+	return k, NewFlowEvent{Family: uint32(key.Type), Payload: payload, Direction: direction, Key: k}.Bytes()
+}
+
+func TestHandleNewFlow(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       network.IPKey
+		direction uint32
+		want      ConnectionStats
+	}{
+		{"sent ipv4", network.IPKey{Saddr: "127.0.0.1", Daddr: "127.0.0.2", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4}, DirectionTx, ConnectionStats{TxPackets: 1, TxBytes: 1400}},
+		{"received ipv4", network.IPKey{Saddr: "127.0.0.1", Daddr: "127.0.0.2", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4}, DirectionRx, ConnectionStats{RxPackets: 1, RxBytes: 1400}},
+		{"sent ipv6", network.IPKey{Saddr: "::1", Daddr: "::2", Sport: 40000, Dport: 53, Proto: network.ProtoUDP, Type: network.IPV6}, DirectionTx, ConnectionStats{TxPackets: 1, TxBytes: 1400}},
+		{"received ipv6", network.IPKey{Saddr: "::1", Daddr: "::2", Sport: 129, Proto: network.ProtoICMPv6, Type: network.IPV6}, DirectionRx, ConnectionStats{RxPackets: 1, RxBytes: 1400}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ct := NewConnectionTracker(ctx, time.Hour, 0, time.Hour, nil, nil, zap.NewNop())
+
+			k, raw := newFlowEvent(t, tt.key, tt.direction, 1400)
+			if err := ct.HandleNewFlow(raw); err != nil {
+				t.Fatalf("HandleNewFlow: %v", err)
+			}
+			c, ok := ct.Load(k)
+			if !ok {
+				t.Fatalf("%s -> %s not stored", tt.key.Saddr, tt.key.Daddr)
+			}
+			if c.Saddr != tt.key.Saddr || c.Daddr != tt.key.Daddr || c.Sport != tt.key.Sport || c.Dport != tt.key.Dport || c.Type != tt.key.Type {
+				t.Errorf("stored %s:%d -> %s:%d (ipv%d), want %s:%d -> %s:%d (ipv%d)",
+					c.Saddr, c.Sport, c.Daddr, c.Dport, c.Type, tt.key.Saddr, tt.key.Sport, tt.key.Daddr, tt.key.Dport, tt.key.Type)
+			}
+			if c.ConnectionStats != tt.want {
+				t.Errorf("stats = %+v, want %+v", c.ConnectionStats, tt.want)
+			}
+		})
+	}
+}
+
+// An event for a flow the harvest already stored leaves its counters alone.
+func TestHandleNewFlowKnown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := NewConnectionTracker(ctx, time.Hour, 0, time.Hour, nil, nil, zap.NewNop())
+
+	key := network.IPKey{Saddr: "127.0.0.1", Daddr: "127.0.0.2", Type: network.IPV4}
+	k, raw := newFlowEvent(t, key, DirectionRx, 60)
+	ip, _ := network.GenericToIp(key)
+	harvested := ConnectionStats{RxPackets: 10, RxBytes: 6000, TxPackets: 8, TxBytes: 480}
+	ct.Store(k, NewConnection(ip, harvested))
+
+	if err := ct.HandleNewFlow(raw); err != nil {
+		t.Fatalf("HandleNewFlow: %v", err)
+	}
+	if c, _ := ct.Load(k); c.ConnectionStats != harvested {
+		t.Errorf("stats = %+v, want the harvested %+v", c.ConnectionStats, harvested)
+	}
+}
+
+func TestHandleNewFlowInvalid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ct := NewConnectionTracker(ctx, time.Hour, 0, time.Hour, nil, nil, zap.NewNop())
+
+	_, raw := newFlowEvent(t, network.IPKey{Saddr: "127.0.0.1", Daddr: "127.0.0.2", Type: network.IPV4}, DirectionTx, 60)
+	unknown := NewFlowEvent{Family: 5}.Bytes()
+	for name, b := range map[string][]byte{"truncated": raw[:6], "unknown family": unknown} {
+		if err := ct.HandleNewFlow(b); err == nil {
+			t.Errorf("%s: event accepted", name)
+		}
+	}
+	if n := len(ct.Data.ToSilce()); n != 0 {
+		t.Errorf("%d flows stored from invalid events", n)
+	}
+}
+
+// Events racing a harvest of the same flows neither replace the harvested
+// counters nor report a flow twice. Run with -race.
+func TestHandleNewFlowDuringHarvest(t *testing.T) {
+	const flows = 500
+	for round := 0; round < 5; round++ {
+		ct, maps := newTestTracker(t, time.Hour, 0)
+		events := &recordedEvents{}
+		ct.SetEventHandler(events)
+
+		want := make(map[ConnectionKey]ConnectionStats, flows)
+		raws := make([][]byte, 0, flows)
+		for i := 0; i < flows; i++ {
+			key := harvestKey(network.IPV4, i)
+			s := ConnectionStats{TxPackets: 10, TxBytes: 6000, RxPackets: 20, RxBytes: 20000}
+			k := putKernel(t, maps[network.IPV4], key, s)
+			want[k] = s
+			_, raw := newFlowEvent(t, key, DirectionTx, 60)
+			raws = append(raws, raw)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ct.Harvest()
+		}()
+		go func() {
+			defer wg.Done()
+			for _, raw := range raws {
+				if err := ct.HandleNewFlow(raw); err != nil {
+					t.Errorf("HandleNewFlow: %v", err)
+				}
+			}
+		}()
+		wg.Wait()
+
+		for k, s := range want {
+			if c, _ := ct.Load(k); c.ConnectionStats != s {
+				t.Fatalf("round %d: %s:%d stats = %+v, want the harvested %+v", round, c.Daddr, c.Sport, c.ConnectionStats, s)
+			}
+		}
+		if len(events.flows) != flows {
+			t.Errorf("round %d: %d new flow events for %d flows", round, len(events.flows), flows)
+		}
+	}
+}
@@ -1,6 +0,0 @@
-package tracker
-
-type ExpiringMap interface {
-	// OnExpire is called when an entry expires.
-	OnExpire(key ConnectionKey)
-}
@@ -0,0 +1,143 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+// Reasons a flow is expired for, like the NetFlow timeouts. A flow expired
+// while traffic still flows starts over as a new flow.
+const (
+	// ExpiredInactive flows did not move for the inactive timeout.
+	ExpiredInactive = "inactive_timeout"
+	// ExpiredActive flows were tracked for the active timeout.
+	ExpiredActive = "active_timeout"
+)
+
+// ExpiredFlow is the final record of a flow, its totals from FirstSeen to
+// LastSeen.
+type ExpiredFlow struct {
+	Connection
+	Reason    string    `json:"reason"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+// ExpiryHook is given the final record of every flow the tracker expires,
+// see AddExpiryHook. It is called from the goroutine expiring the flows.
+type ExpiryHook interface {
+	OnExpire(f ExpiredFlow) error
+}
+
+// AddExpiryHook makes h see the flows expired from now on.
+func (m *ConnectionTracker) AddExpiryHook(h ExpiryHook) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+	m.hooks = append(m.hooks, h)
+}
+
+// Monitor expires the flows every check interval until ctx is done.
+func (m *ConnectionTracker) Monitor(ctx context.Context) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.expireFlows(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expireFlows expires the flows that did not move for the inactive timeout,
+// and those tracked for the active timeout when there is one.
+func (m *ConnectionTracker) expireFlows(now time.Time) {
+	m.Data.Range(func(key, value any) bool {
+		c := value.(Entry).Connection
+		var reason string
+		switch {
+		case now.Sub(c.LastSeen) >= m.inactiveTimeout:
+			reason = ExpiredInactive
+		case m.activeTimeout > 0 && now.Sub(c.FirstSeen) >= m.activeTimeout:
+			reason = ExpiredActive
+		default:
+			return true
+		}
+		if err := m.Expire(key.(ConnectionKey), reason); err != nil {
+			m.l.Sugar().Errorf("Failed to expire %s -> %s: %v", c.Saddr, c.Daddr, err)
+		}
+		return true
+	})
+}
+
+// Expire removes the flow of key from the kernel and from Data, and hands
+// its final record to the expiry hooks. The flow is kept when the kernel
+// entry can't be deleted, so it is expired again on the next check.
+func (m *ConnectionTracker) Expire(key ConnectionKey, reason string) error {
+	c, ok, err := m.remove(key)
+	if err != nil || !ok {
+		return err
+	}
+	if h := m.eventHandler(); h != nil {
+		h.FlowExpired(c)
+	}
+
+	m.hooksMu.Lock()
+	hooks := m.hooks
+	m.hooksMu.Unlock()
+	var errs []error
+	for _, h := range hooks {
+		if err := h.OnExpire(ExpiredFlow{Connection: c, Reason: reason, ExpiredAt: time.Now()}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// remove deletes the flow of key from the kernel and from Data and returns
+// it with what the kernel counted since the last harvest. It holds off
+// Harvest, which would store a flow it read before the delete back.
+func (m *ConnectionTracker) remove(key ConnectionKey) (Connection, bool, error) {
+	kernelMap := m.kernelMaps[network.KernelKeyFamily(key)]
+	if kernelMap == nil {
+		return Connection{}, false, fmt.Errorf("no kernel map for ip family %d", network.KernelKeyFamily(key))
+	}
+	m.harvestMu.Lock()
+	defer m.harvestMu.Unlock()
+
+	k := key
+	kPtr := unsafe.Pointer(&k[0])
+	// Packets counted between the lookup and the delete are lost, the
+	// window is a lot shorter than a harvest interval.
+	v, lookupErr := kernelMap.GetValue(kPtr)
+	if err := kernelMap.DeleteKey(kPtr); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return Connection{}, false, fmt.Errorf("failed to delete %v: %w", key, err)
+	}
+
+	entry, ok := m.Data.LoadAndDelete(key)
+	if !ok {
+		return Connection{}, false, nil
+	}
+	c := entry.(Entry).Connection
+	if lookupErr != nil {
+		return c, true, nil
+	}
+	s, err := ParseConnectionStats(v)
+	if err != nil {
+		m.l.Sugar().Errorf("Failed to parse the last counters of %s -> %s: %v", c.Saddr, c.Daddr, err)
+		return c, true, nil
+	}
+	if s != c.ConnectionStats {
+		c.ConnectionStats = s
+		c.LastSeen = time.Now()
+		c.Duration = c.LastSeen.Sub(c.FirstSeen).Seconds()
+	}
+	return c, true, nil
+}
@@ -0,0 +1,114 @@
+package tracker
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+type recordedExpiry struct {
+	mu    sync.Mutex
+	flows []ExpiredFlow
+}
+
+func (r *recordedExpiry) OnExpire(f ExpiredFlow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flows = append(r.flows, f)
+	return nil
+}
+
+func TestExpireFlows(t *testing.T) {
+	const inactive, active = time.Hour, 24 * time.Hour
+	now := time.Now()
+	tests := []struct {
+		name          string
+		activeTimeout time.Duration
+		firstSeen     time.Time
+		lastSeen      time.Time
+		wantReason    string
+	}{
+		{"recent", active, now.Add(-time.Minute), now.Add(-time.Second), ""},
+		{"inactive", active, now.Add(-2 * time.Hour), now.Add(-inactive), ExpiredInactive},
+		{"inactive beats active", active, now.Add(-48 * time.Hour), now.Add(-2 * inactive), ExpiredInactive},
+		{"active", active, now.Add(-active), now.Add(-time.Second), ExpiredActive},
+		{"no active timeout", 0, now.Add(-48 * time.Hour), now.Add(-time.Second), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, maps := newTestTracker(t, inactive, tt.activeTimeout)
+			events := &recordedEvents{}
+			ct.SetEventHandler(events)
+			hook := &recordedExpiry{}
+			ct.AddExpiryHook(hook)
+
+			key := network.IPKey{Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4}
+			stats := ConnectionStats{RxPackets: 2, RxBytes: 3000, TxPackets: 3, TxBytes: 180}
+			k := putKernel(t, maps[network.IPV4], key, stats)
+			ip, _ := network.GenericToIp(key)
+			c := NewConnection(ip, stats)
+			c.FirstSeen, c.LastSeen = tt.firstSeen, tt.lastSeen
+			ct.Store(k, c)
+
+			ct.expireFlows(now)
+
+			_, tracked := ct.Load(k)
+			_, err := maps[network.IPV4].GetValue(unsafe.Pointer(&k[0]))
+			inKernel := err == nil
+			if tt.wantReason == "" {
+				if !tracked || !inKernel || len(hook.flows) != 0 {
+					t.Fatalf("flow expired (tracked %v, in kernel %v, hooks %d)", tracked, inKernel, len(hook.flows))
+				}
+				return
+			}
+			if tracked || inKernel {
+				t.Errorf("flow not removed (tracked %v, in kernel %v)", tracked, inKernel)
+			}
+			if len(hook.flows) != 1 || len(events.expired) != 1 {
+				t.Fatalf("%d expiry hook calls and %d expired events, want 1", len(hook.flows), len(events.expired))
+			}
+			f := hook.flows[0]
+			if f.Reason != tt.wantReason {
+				t.Errorf("reason = %s, want %s", f.Reason, tt.wantReason)
+			}
+			if f.ConnectionStats != stats || !f.FirstSeen.Equal(tt.firstSeen) {
+				t.Errorf("expired %+v first seen %s, want %+v first seen %s", f.ConnectionStats, f.FirstSeen, stats, tt.firstSeen)
+			}
+		})
+	}
+}
+
+// The packets counted since the last harvest belong to the final record.
+func TestExpireReadsLastCounters(t *testing.T) {
+	ct, maps := newTestTracker(t, time.Hour, 0)
+	hook := &recordedExpiry{}
+	ct.AddExpiryHook(hook)
+
+	key := network.IPKey{Saddr: "fd00::10", Daddr: "2001:db8::1", Sport: 40000, Dport: 443, Proto: network.ProtoUDP, Type: network.IPV6}
+	k := putKernel(t, maps[network.IPV6], key, ConnectionStats{TxPackets: 1, TxBytes: 100})
+	ct.Harvest()
+	last := ConnectionStats{RxPackets: 4, RxBytes: 4000, TxPackets: 5, TxBytes: 500}
+	putKernel(t, maps[network.IPV6], key, last)
+
+	if err := ct.Expire(k, ExpiredInactive); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if len(hook.flows) != 1 {
+		t.Fatalf("%d expiry hook calls, want 1", len(hook.flows))
+	}
+	if got := hook.flows[0].ConnectionStats; got != last {
+		t.Errorf("expired with %+v, want the last kernel counters %+v", got, last)
+	}
+	if maps[network.IPV6].Len() != 0 {
+		t.Errorf("kernel entry left behind")
+	}
+
+	// Harvesting again doesn't bring it back.
+	ct.Harvest()
+	if _, ok := ct.Load(k); ok {
+		t.Errorf("expired flow harvested again")
+	}
+}
@@ -0,0 +1,162 @@
+package tracker
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+// Number of entries read per batch lookup syscall.
+const harvestBatchSize = 256
+
+// HarvestStats describes the last harvest of one kernel map.
+type HarvestStats struct {
+	Family   int           `json:"family"`
+	Entries  int           `json:"entries"`
+	Duration time.Duration `json:"duration"`
+	Batched  bool          `json:"batched"`
+	Errors   int           `json:"errors"`
+}
+
+type harvestState struct {
+	sync.Mutex
+	stats map[int]HarvestStats
+	// noBatch remembers the maps the kernel refused a batch lookup for.
+	noBatch map[int]bool
+}
+
+// Harvest copies the current counters of every kernel map into Data.
+func (m *ConnectionTracker) Harvest() {
+	m.harvestMu.Lock()
+	defer m.harvestMu.Unlock()
+	for family, km := range m.kernelMaps {
+		start := time.Now()
+		stats, err := m.harvestMap(family, km)
+		stats.Duration = time.Since(start)
+		if err != nil {
+			m.l.Sugar().Errorf("Failed to iterate ipv%d map: %v", family, err)
+		}
+		m.l.Sugar().Debugf("Harvested %d ipv%d entries in %s (batched: %t)", stats.Entries, family, stats.Duration, stats.Batched)
+
+		m.harvest.Lock()
+		m.harvest.stats[family] = stats
+		m.harvest.Unlock()
+	}
+}
+
+// HarvestStats returns the stats of the last harvest of each kernel map.
+func (m *ConnectionTracker) HarvestStats() []HarvestStats {
+	m.harvest.Lock()
+	defer m.harvest.Unlock()
+	out := make([]HarvestStats, 0, len(m.harvest.stats))
+	for _, s := range m.harvest.stats {
+		out = append(out, s)
+	}
+	return out
+}
+
+func (m *ConnectionTracker) harvestMap(family int, km kernelmap.KernelMap) (HarvestStats, error) {
+	m.harvest.Lock()
+	noBatch := m.harvest.noBatch[family]
+	m.harvest.Unlock()
+
+	if !noBatch {
+		stats, err := m.harvestBatch(family, km)
+		if err == nil {
+			return stats, nil
+		}
+		if stats.Entries == 0 {
+			// Batch lookups came with 5.6 and are not supported by every map
+			// type, don't try again for this map.
+			m.l.Sugar().Infof("Batch lookup not available for ipv%d map, iterating keys instead: %v", family, err)
+			m.harvest.Lock()
+			m.harvest.noBatch[family] = true
+			m.harvest.Unlock()
+		} else {
+			m.l.Sugar().Warnf("Batch lookup of ipv%d map failed midway, iterating keys instead: %v", family, err)
+		}
+	}
+	return m.harvestIterate(family, km)
+}
+
+// harvestBatch reads the map with batch lookups. For hash maps the batch
+// cursor is a bucket index, not a key, so it is kept in its own buffer. The
+// kernel fills a batch bucket by bucket and returns it short when the next
+// bucket doesn't fit, only ENOENT marks the end of the map.
+func (m *ConnectionTracker) harvestBatch(family int, km kernelmap.KernelMap) (HarvestStats, error) {
+	stats := HarvestStats{Family: family, Batched: true}
+	keySize := km.KeySize()
+	keys := make([]byte, harvestBatchSize*keySize)
+	cursorSize := max(keySize, 4)
+	cursorIn := make([]byte, cursorSize)
+	cursorOut := make([]byte, cursorSize)
+
+	var start unsafe.Pointer
+	for {
+		values, n, err := km.GetValueBatch(unsafe.Pointer(&keys[0]), start, unsafe.Pointer(&cursorOut[0]), harvestBatchSize)
+		if err != nil && !errors.Is(err, syscall.ENOENT) {
+			return stats, err
+		}
+
+		// The call reaching the end of the map can still carry entries.
+		for i := 0; i < int(n) && i < len(values); i++ {
+			if m.storeHarvested(family, keys[i*keySize:(i+1)*keySize], values[i]) {
+				stats.Entries++
+			} else {
+				stats.Errors++
+			}
+		}
+
+		if err != nil {
+			return stats, nil
+		}
+		copy(cursorIn, cursorOut)
+		start = unsafe.Pointer(&cursorIn[0])
+	}
+}
+
+// harvestIterate reads the map one key at a time, for kernels without batch
+// lookups.
+func (m *ConnectionTracker) harvestIterate(family int, km kernelmap.KernelMap) (HarvestStats, error) {
+	stats := HarvestStats{Family: family}
+	err := kernelmap.Iterate(km, func(k []byte) bool {
+		v, err := km.GetValue(unsafe.Pointer(&k[0]))
+		if err != nil {
+			// The entry can be expired between the two syscalls.
+			if !errors.Is(err, syscall.ENOENT) {
+				m.l.Sugar().Error("Error GetValue key ", err)
+				stats.Errors++
+			}
+			return true
+		}
+		if m.storeHarvested(family, k, v) {
+			stats.Entries++
+		} else {
+			stats.Errors++
+		}
+		return true
+	})
+	return stats, err
+}
+
+func (m *ConnectionTracker) storeHarvested(family int, k, v []byte) bool {
+	kData, err := network.ParseKey(family, k)
+	if err != nil {
+		m.l.Sugar().Info("Error parsing key ", err)
+		return false
+	}
+
+	s, err := ParseConnectionStats(v)
+	if err != nil {
+		m.l.Sugar().Error("Error parseConnectionStats key ", err)
+		return false
+	}
+
+	m.Store(network.IpToKernelKey(kData), NewConnection(kData, s))
+	return true
+}
@@ -0,0 +1,102 @@
+package tracker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+)
+
+func harvestKey(family, i int) network.IPKey {
+	key := network.IPKey{Sport: uint16(10000 + i), Dport: 443, Proto: network.ProtoTCP, Type: family}
+	if family == network.IPV6 {
+		key.Saddr, key.Daddr = "fd00::10", fmt.Sprintf("2001:db8::%x", i+1)
+	} else {
+		key.Saddr, key.Daddr = "192.168.1.10", fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+	}
+	return key
+}
+
+func TestHarvest(t *testing.T) {
+	tests := []struct {
+		name    string
+		family  int
+		entries int
+		// batchLimit makes the memory map return short batches.
+		batchLimit  int
+		noBatch     bool
+		wantBatched bool
+	}{
+		{"empty map", network.IPV4, 0, 0, false, true},
+		{"single batch", network.IPV4, 10, 0, false, true},
+		{"exactly one batch", network.IPV4, harvestBatchSize, 0, false, true},
+		{"several batches", network.IPV4, 2*harvestBatchSize + 3, 0, false, true},
+		{"several batches ipv6", network.IPV6, harvestBatchSize + 1, 0, false, true},
+		{"short batches", network.IPV4, 300, 7, false, true},
+		{"short batches ipv6", network.IPV6, 300, harvestBatchSize - 1, false, true},
+		{"iterate", network.IPV4, 300, 0, true, false},
+		{"iterate ipv6", network.IPV6, 40, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, maps := newTestTracker(t, 0, 0)
+			m := maps[tt.family]
+			m.BatchLimit = tt.batchLimit
+			ct.harvest.noBatch[tt.family] = tt.noBatch
+
+			want := make(map[ConnectionKey]ConnectionStats)
+			for i := 0; i < tt.entries; i++ {
+				s := ConnectionStats{RxPackets: uint64(i), RxBytes: uint64(100 * i), TxPackets: uint64(i + 1), TxBytes: uint64(60 * (i + 1))}
+				want[putKernel(t, m, harvestKey(tt.family, i), s)] = s
+			}
+			ct.Harvest()
+
+			var stats HarvestStats
+			for _, s := range ct.HarvestStats() {
+				if s.Family == tt.family {
+					stats = s
+				}
+			}
+			if stats.Entries != tt.entries || stats.Errors != 0 {
+				t.Errorf("harvested %d entries with %d errors, want %d without errors", stats.Entries, stats.Errors, tt.entries)
+			}
+			if stats.Batched != tt.wantBatched {
+				t.Errorf("batched = %v, want %v", stats.Batched, tt.wantBatched)
+			}
+			if got := len(ct.Data.ToSilce()); got != tt.entries {
+				t.Errorf("%d flows tracked, want %d", got, tt.entries)
+			}
+			for k, s := range want {
+				c, ok := ct.Load(k)
+				if !ok {
+					t.Fatalf("flow %v not harvested", k)
+				}
+				if c.ConnectionStats != s {
+					t.Fatalf("%s -> %s harvested %+v, want %+v", c.Saddr, c.Daddr, c.ConnectionStats, s)
+				}
+			}
+		})
+	}
+}
+
+func TestHarvestUpdates(t *testing.T) {
+	ct, maps := newTestTracker(t, 0, 0)
+	key := harvestKey(network.IPV4, 1)
+	k := putKernel(t, maps[network.IPV4], key, ConnectionStats{TxPackets: 1, TxBytes: 60})
+	ct.Harvest()
+
+	moved := ConnectionStats{RxPackets: 1, RxBytes: 1500, TxPackets: 2, TxBytes: 120}
+	putKernel(t, maps[network.IPV4], key, moved)
+	ct.Harvest()
+
+	c, ok := ct.Load(k)
+	if !ok {
+		t.Fatal("flow not harvested")
+	}
+	if c.ConnectionStats != moved {
+		t.Errorf("stats = %+v, want %+v", c.ConnectionStats, moved)
+	}
+	if got := len(ct.Data.ToSilce()); got != 1 {
+		t.Errorf("%d flows tracked, want 1", got)
+	}
+}
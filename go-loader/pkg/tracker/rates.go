@@ -0,0 +1,124 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// Rates are the recent throughput of a flow, derived from what its counters
+// moved between harvests. The windowed rates cover the flow's whole life
+// while it is younger than the window.
+type Rates struct {
+	// BytesPerSec and PacketsPerSec are over the last harvest.
+	BytesPerSec       float64 `json:"bytes_per_sec"`
+	PacketsPerSec     float64 `json:"packets_per_sec"`
+	BytesPerSec1m     float64 `json:"bytes_per_sec_1m"`
+	PacketsPerSec1m   float64 `json:"packets_per_sec_1m"`
+	BytesPerSec5m     float64 `json:"bytes_per_sec_5m"`
+	PacketsPerSec5m   float64 `json:"packets_per_sec_5m"`
+	PeakBytesPerSec   float64 `json:"peak_bytes_per_sec"`
+	PeakPacketsPerSec float64 `json:"peak_packets_per_sec"`
+	// TxBytesPerSec1m and RxBytesPerSec1m split BytesPerSec1m by
+	// direction.
+	TxBytesPerSec1m float64 `json:"tx_bytes_per_sec_1m"`
+	RxBytesPerSec1m float64 `json:"rx_bytes_per_sec_1m"`
+}
+
+const (
+	// rateWindow is the longest window rates are computed over.
+	rateWindow = 5 * time.Minute
+	// minRateTick keeps a Store right after another, such as a new flow
+	// event followed by a harvest, from making a sample of its own.
+	minRateTick = 500 * time.Millisecond
+)
+
+type rateSample struct {
+	at      time.Time
+	elapsed time.Duration
+	bytes   uint64
+	packets uint64
+	txBytes uint64
+}
+
+// rateRing holds the per-tick deltas of a flow over rateWindow. It is shared
+// by the successive entries of the flow.
+type rateRing struct {
+	mu      sync.Mutex
+	last    ConnectionStats
+	lastAt  time.Time
+	samples []rateSample
+	rates   Rates
+}
+
+// add records the counters s read at now and returns the rates.
+func (r *rateRing) add(now time.Time, s ConnectionStats) Rates {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lastAt.IsZero() || s.Bytes() < r.last.Bytes() || s.Packets() < r.last.Packets() || s.TxBytes < r.last.TxBytes {
+		// First time the flow is seen, or its counters were reset.
+		r.last, r.lastAt = s, now
+		return r.rates
+	}
+	elapsed := now.Sub(r.lastAt)
+	if elapsed < minRateTick {
+		return r.rates
+	}
+
+	sample := rateSample{
+		at:      now,
+		elapsed: elapsed,
+		bytes:   s.Bytes() - r.last.Bytes(),
+		packets: s.Packets() - r.last.Packets(),
+		txBytes: s.TxBytes - r.last.TxBytes,
+	}
+	r.last, r.lastAt = s, now
+	r.samples = append(r.samples, sample)
+	cutoff := now.Add(-rateWindow)
+	i := 0
+	for i < len(r.samples) && !r.samples[i].at.After(cutoff) {
+		i++
+	}
+	r.samples = r.samples[i:]
+
+	r.rates.BytesPerSec, r.rates.PacketsPerSec = perSecond(sample.bytes, sample.packets, sample.elapsed)
+	r.rates.BytesPerSec1m, r.rates.PacketsPerSec1m = r.over(now, time.Minute)
+	r.rates.BytesPerSec5m, r.rates.PacketsPerSec5m = r.over(now, rateWindow)
+	r.rates.TxBytesPerSec1m = r.txOver(now, time.Minute)
+	r.rates.RxBytesPerSec1m = max(r.rates.BytesPerSec1m-r.rates.TxBytesPerSec1m, 0)
+	r.rates.PeakBytesPerSec = max(r.rates.PeakBytesPerSec, r.rates.BytesPerSec)
+	r.rates.PeakPacketsPerSec = max(r.rates.PeakPacketsPerSec, r.rates.PacketsPerSec)
+	return r.rates
+}
+
+// over sums the samples of the last window.
+func (r *rateRing) over(now time.Time, window time.Duration) (float64, float64) {
+	cutoff := now.Add(-window)
+	var bytes, packets uint64
+	var elapsed time.Duration
+	for i := len(r.samples) - 1; i >= 0 && r.samples[i].at.After(cutoff); i-- {
+		bytes += r.samples[i].bytes
+		packets += r.samples[i].packets
+		elapsed += r.samples[i].elapsed
+	}
+	return perSecond(bytes, packets, elapsed)
+}
+
+func (r *rateRing) txOver(now time.Time, window time.Duration) float64 {
+	cutoff := now.Add(-window)
+	var bytes uint64
+	var elapsed time.Duration
+	for i := len(r.samples) - 1; i >= 0 && r.samples[i].at.After(cutoff); i-- {
+		bytes += r.samples[i].txBytes
+		elapsed += r.samples[i].elapsed
+	}
+	txBytes, _ := perSecond(bytes, 0, elapsed)
+	return txBytes
+}
+
+func perSecond(bytes, packets uint64, elapsed time.Duration) (float64, float64) {
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(bytes) / elapsed.Seconds(), float64(packets) / elapsed.Seconds()
+}
@@ -0,0 +1,43 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRates(t *testing.T) {
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration
+		stats ConnectionStats
+		want  Rates
+	}{
+		// The first counters are only a baseline.
+		{0, ConnectionStats{TxPackets: 1, TxBytes: 100}, Rates{}},
+		{10 * time.Second, ConnectionStats{TxPackets: 11, TxBytes: 5100, RxPackets: 10, RxBytes: 5000}, Rates{
+			BytesPerSec: 1000, PacketsPerSec: 2, BytesPerSec1m: 1000, PacketsPerSec1m: 2, BytesPerSec5m: 1000, PacketsPerSec5m: 2,
+			PeakBytesPerSec: 1000, PeakPacketsPerSec: 2, TxBytesPerSec1m: 500, RxBytesPerSec1m: 500,
+		}},
+		// Too close to the previous read to make a sample.
+		{10*time.Second + 100*time.Millisecond, ConnectionStats{TxPackets: 20, TxBytes: 9000, RxPackets: 10, RxBytes: 5000}, Rates{
+			BytesPerSec: 1000, PacketsPerSec: 2, BytesPerSec1m: 1000, PacketsPerSec1m: 2, BytesPerSec5m: 1000, PacketsPerSec5m: 2,
+			PeakBytesPerSec: 1000, PeakPacketsPerSec: 2, TxBytesPerSec1m: 500, RxBytesPerSec1m: 500,
+		}},
+		// The first sample left the 1m window, not the 5m one.
+		{70 * time.Second, ConnectionStats{TxPackets: 11, TxBytes: 5100, RxPackets: 10, RxBytes: 5000}, Rates{
+			BytesPerSec5m: 10000.0 / 70, PacketsPerSec5m: 20.0 / 70, PeakBytesPerSec: 1000, PeakPacketsPerSec: 2,
+		}},
+	}
+	var r rateRing
+	for i, s := range steps {
+		if got := r.add(start.Add(s.after), s.stats); got != s.want {
+			t.Errorf("step %d: rates =\n%+v\nwant\n%+v", i, got, s.want)
+		}
+	}
+
+	// Counters going backwards are a new baseline, the rates are kept.
+	before := r.rates
+	if got := r.add(start.Add(80*time.Second), ConnectionStats{TxPackets: 1, TxBytes: 60}); got != before {
+		t.Errorf("after a reset rates = %+v, want %+v", got, before)
+	}
+}
@@ -0,0 +1,126 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+)
+
+// SnapshotVersion is bumped whenever the on-disk layout changes. Files
+// written before versioning existed are a bare JSON array and load as
+// version 0.
+const SnapshotVersion = 1
+
+type Snapshot struct {
+	Version     int          `json:"version"`
+	Connections []Connection `json:"connections"`
+	Devices     []Device     `json:"devices,omitempty"`
+	Rules       []rules.Rule `json:"rules,omitempty"`
+}
+
+// legacyConnection reads the connections of version 0. Only the XDP ingress
+// hook existed then: the packets/bytes counters are rx and the connections
+// are keyed like the received packets.
+type legacyConnection struct {
+	Connection
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func decodeSnapshot(data []byte) (Snapshot, error) {
+	var s Snapshot
+	var raw struct {
+		Version     int               `json:"version"`
+		Connections []json.RawMessage `json:"connections"`
+		Devices     []Device          `json:"devices"`
+		Rules       []rules.Rule      `json:"rules"`
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw.Connections); err != nil {
+			return s, err
+		}
+	} else if err := json.Unmarshal(data, &raw); err != nil {
+		return s, err
+	}
+	if raw.Version > SnapshotVersion {
+		return s, fmt.Errorf("snapshot version %d is newer than supported version %d", raw.Version, SnapshotVersion)
+	}
+
+	s.Version = raw.Version
+	s.Devices = raw.Devices
+	s.Rules = raw.Rules
+	s.Connections = make([]Connection, 0, len(raw.Connections))
+	for _, r := range raw.Connections {
+		if raw.Version > 0 {
+			var c Connection
+			if err := json.Unmarshal(r, &c); err != nil {
+				return s, err
+			}
+			s.Connections = append(s.Connections, c)
+			continue
+		}
+		var c legacyConnection
+		if err := json.Unmarshal(r, &c); err != nil {
+			return s, err
+		}
+		conn := c.Connection
+		conn.Saddr, conn.Daddr = conn.Daddr, conn.Saddr
+		conn.SHost, conn.DHost = conn.DHost, conn.SHost
+		conn.RxPackets, conn.RxBytes = c.Packets, c.Bytes
+		s.Connections = append(s.Connections, conn)
+	}
+	return s, nil
+}
+
+// LoadState restores the state kept in s. Connections are only put back
+// into Data when connections is set, the blocklist rules and the devices
+// always are.
+func (m *ConnectionTracker) LoadState(s Storage, connections bool) error {
+	state, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	if m.blocklist != nil {
+		m.blocklist.Restore(state.Rules)
+	}
+	m.restoreDevices(state.Devices)
+	if connections {
+		m.restoreConnections(state.Connections)
+	}
+	return nil
+}
+
+// WriteSnapshot saves the current Data, devices and runtime rules to s.
+func (m *ConnectionTracker) WriteSnapshot(s Storage) error {
+	state := State{Connections: m.Data.ToSilce(), Devices: m.Devices()}
+	if m.blocklist != nil {
+		state.Rules = m.blocklist.Runtime()
+	}
+	if err := s.Save(state); err != nil {
+		return err
+	}
+	m.l.Sugar().Debugf("Wrote snapshot of %d connections to %s", len(state.Connections), s)
+	return nil
+}
+
+// RunSnapshots writes a snapshot to s every interval until ctx is done.
+func (m *ConnectionTracker) RunSnapshots(ctx context.Context, s Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.WriteSnapshot(s); err != nil {
+				m.l.Sugar().Errorf("Failed to write snapshot to %s: %v", s, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
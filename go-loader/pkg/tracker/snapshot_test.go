@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/kernelmap"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/network"
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"go.uber.org/zap"
+)
+
+func TestDecodeSnapshot(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		version int
+		want    []Connection
+	}{
+		{
+			// Only received packets were counted, keyed like the packets.
+			name:    "bare array",
+			data:    `[{"saddr":"1.1.1.1","addr":"192.168.1.10","sHost":["one.one.one.one."],"dHost":null,"type":4,"packets":3,"bytes":300}]`,
+			version: 0,
+			want: []Connection{{
+				Saddr: "192.168.1.10", Daddr: "1.1.1.1", DHost: []string{"one.one.one.one."}, Type: network.IPV4,
+				ConnectionStats: ConnectionStats{RxPackets: 3, RxBytes: 300},
+			}},
+		},
+		{
+			name:    "versioned",
+			data:    `{"version":1,"connections":[{"saddr":"fd00::10","addr":"2001:db8::1","sport":40000,"dport":53,"proto":17,"type":6,"rx_packets":1,"rx_bytes":150,"tx_packets":1,"tx_bytes":70}]}`,
+			version: 1,
+			want: []Connection{{
+				Saddr: "fd00::10", Daddr: "2001:db8::1", Sport: 40000, Dport: 53, Proto: network.ProtoUDP, Type: network.IPV6,
+				ConnectionStats: ConnectionStats{RxPackets: 1, RxBytes: 150, TxPackets: 1, TxBytes: 70},
+			}},
+		},
+		{
+			name:    "empty",
+			data:    `{"version":1,"connections":[]}`,
+			version: 1,
+			want:    []Connection{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := decodeSnapshot([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("decodeSnapshot: %v", err)
+			}
+			if s.Version != tt.version {
+				t.Errorf("version = %d, want %d", s.Version, tt.version)
+			}
+			if !reflect.DeepEqual(s.Connections, tt.want) {
+				t.Errorf("connections =\n%+v\nwant\n%+v", s.Connections, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotNewer(t *testing.T) {
+	if _, err := decodeSnapshot([]byte(`{"version":99,"connections":[]}`)); err == nil {
+		t.Error("a snapshot newer than SnapshotVersion was accepted")
+	}
+}
+
+// What WriteSnapshot writes decodes back to Data, and nothing is left next
+// to it.
+func TestWriteSnapshot(t *testing.T) {
+	ct := &ConnectionTracker{l: zap.NewNop()}
+	want := Connection{
+		Saddr: "192.168.1.10", Daddr: "1.1.1.1", Sport: 40000, Dport: 443, Proto: network.ProtoTCP, Type: network.IPV4,
+		SHost: []string{"laptop.lan."}, DHost: []string{"one.one.one.one."},
+		ConnectionStats: ConnectionStats{RxPackets: 3, RxBytes: 3000, TxPackets: 2, TxBytes: 120},
+	}
+	ct.Data.Store(ConnectionKey{1}, Entry{Connection: want})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	if err := ct.WriteSnapshot(NewFileStorage(path, zap.NewNop())); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatalf("decodeSnapshot: %v", err)
+	}
+	if s.Version != SnapshotVersion || !reflect.DeepEqual(s.Connections, []Connection{want}) {
+		t.Errorf("decoded version %d %+v, want version %d %+v", s.Version, s.Connections, SnapshotVersion, want)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in the state directory, want only the snapshot", len(files))
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		name string
+		// data is written to the state file, which is missing when nil.
+		data        *string
+		wantConns   int
+		wantCorrupt bool
+	}{
+		{"missing file", nil, 0, false},
+		{"corrupt file", ptr(`{"version":1,"connections":[{"saddr":`), 0, true},
+		{"wrong type", ptr(`{"version":"one"}`), 0, true},
+		{"newer version", ptr(`{"version":99,"connections":[]}`), 0, true},
+		{"bad records skipped", ptr(`[
+			{"saddr":"127.0.0.1","addr":"127.0.0.2","type":4,"packets":1,"bytes":60},
+			{"saddr":"not an address","addr":"127.0.0.2","type":4,"packets":1,"bytes":60},
+			{"saddr":"::1","addr":"::2","type":5,"packets":1,"bytes":60},
+			{"saddr":"::1","addr":"::2","type":6,"packets":2,"bytes":120}]`), 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := &ConnectionTracker{l: zap.NewNop()}
+			dir := t.TempDir()
+			path := filepath.Join(dir, "data.json")
+			if tt.data != nil {
+				if err := os.WriteFile(path, []byte(*tt.data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := ct.LoadState(NewFileStorage(path, zap.NewNop()), true); err != nil {
+				t.Fatalf("LoadState: %v", err)
+			}
+			if got := len(ct.Data.ToSilce()); got != tt.wantConns {
+				t.Errorf("%d connections loaded, want %d", got, tt.wantConns)
+			}
+			corrupt, _ := filepath.Glob(path + ".corrupt-*")
+			if got := len(corrupt) == 1; got != tt.wantCorrupt {
+				t.Errorf("moved aside = %v, want %v", got, tt.wantCorrupt)
+			}
+			if _, err := os.Stat(path); tt.wantCorrupt && err == nil {
+				t.Errorf("corrupt state file left in place")
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+// A flow is restored on the interface of the same name, whatever index the
+// snapshot recorded.
+func TestLoadStateInterface(t *testing.T) {
+	lo, ok := network.InterfaceIndex("lo")
+	if !ok {
+		t.Skip("no loopback interface")
+	}
+	ct := &ConnectionTracker{l: zap.NewNop()}
+	path := filepath.Join(t.TempDir(), "data.json")
+	data := `{"version":1,"connections":[{"saddr":"127.0.0.1","addr":"127.0.0.2","ifindex":9999,"interface":"lo","type":4,"rx_packets":1,"rx_bytes":60}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ct.LoadState(NewFileStorage(path, zap.NewNop()), true); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	conns := ct.Data.ToSilce()
+	if len(conns) != 1 || conns[0].Ifindex != lo || conns[0].Interface != "lo" {
+		t.Errorf("restored %+v, want one flow on lo (ifindex %d)", conns, lo)
+	}
+}
+
+// Runtime blocklist rules are kept in the snapshot and restored even when
+// the connections are not.
+func TestSnapshotRules(t *testing.T) {
+	newTracker := func() *ConnectionTracker {
+		ct := &ConnectionTracker{l: zap.NewNop()}
+		ct.SetBlocklist(rules.NewBlocklist(nil, kernelmap.NewMemoryMap(4, rules.DropStatsSize, rules.MaxRules), zap.NewNop()))
+		return ct
+	}
+	ct := newTracker()
+	ct.Data.Store(ConnectionKey{1}, Entry{Connection: Connection{Saddr: "127.0.0.1", Daddr: "127.0.0.2", Type: network.IPV4}})
+	want := []rules.Rule{{Name: "doc", CIDR: "192.0.2.0/24"}}
+	ct.blocklist.Restore(want)
+
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := ct.WriteSnapshot(NewFileStorage(path, zap.NewNop())); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	restored := newTracker()
+	if err := restored.LoadState(NewFileStorage(path, zap.NewNop()), false); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if got := restored.blocklist.Runtime(); !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %+v, want %+v", got, want)
+	}
+	if n := len(restored.Data.ToSilce()); n != 0 {
+		t.Errorf("%d connections restored, want none", n)
+	}
+}
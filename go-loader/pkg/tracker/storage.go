@@ -0,0 +1,205 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/akiasmaka/home-network-tracker/go-loader/pkg/rules"
+	"go.uber.org/zap"
+)
+
+// Device is a local address seen in a flow.
+type Device struct {
+	Addr string `json:"addr"`
+	// Names are the resolved names of Addr when it was last seen.
+	Names []string `json:"names,omitempty"`
+	// Interface is where it was last seen.
+	Interface string    `json:"interface,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	// LastSeen is when the counters of one of its flows last moved.
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// State is what the tracker keeps between runs.
+type State struct {
+	Connections []Connection
+	Devices     []Device
+	// Rules are the blocklist rules added at runtime.
+	Rules []rules.Rule
+}
+
+// Storage keeps the tracker state between runs. Save replaces what was
+// stored, a Storage holding nothing yet loads an empty State.
+type Storage interface {
+	// Load returns the stored state, it may repair a broken storage so the
+	// daemon can start.
+	Load() (State, error)
+	// Read returns the stored state without changing anything, a storage
+	// that can't be decoded is an error.
+	Read() (State, error)
+	Save(s State) error
+	// ByAddr returns the stored connections addr is an end of.
+	ByAddr(addr string) ([]Connection, error)
+	// ByHost returns the stored connections with an end resolved to host.
+	ByHost(host string) ([]Connection, error)
+	// Device returns the stored device of addr, if any.
+	Device(addr string) (Device, bool, error)
+	// String names the storage in logs.
+	String() string
+}
+
+// HasAddr reports whether addr is an end of c.
+func (c Connection) HasAddr(addr string) bool {
+	return c.Saddr == addr || c.Daddr == addr
+}
+
+// HasHost reports whether an end of c resolved to host.
+func (c Connection) HasHost(host string) bool {
+	return slices.Contains(c.SHost, host) || slices.Contains(c.DHost, host)
+}
+
+// FileStorage is the original storage, a JSON snapshot rewritten whole on
+// every Save. Lookups read the whole file.
+type FileStorage struct {
+	path string
+	l    *zap.Logger
+}
+
+func NewFileStorage(path string, l *zap.Logger) *FileStorage {
+	return &FileStorage{path: path, l: l}
+}
+
+func (f *FileStorage) String() string {
+	return f.path
+}
+
+// Load starts empty when there is no file. A file that can't be decoded is
+// moved aside with a timestamped name, so neither stops the daemon from
+// starting.
+func (f *FileStorage) Load() (State, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		f.l.Sugar().Infof("No state file at %s, starting empty", f.path)
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal data: %w", err)
+		corrupt := fmt.Sprintf("%s.corrupt-%s", f.path, time.Now().Format("20060102T150405"))
+		if renameErr := os.Rename(f.path, corrupt); renameErr != nil {
+			return State{}, fmt.Errorf("%w, and moving it aside failed: %v", err, renameErr)
+		}
+		f.l.Sugar().Warnf("State file %s is corrupt (%v), moved it to %s and starting empty", f.path, err, corrupt)
+		return State{}, nil
+	}
+	return State{Connections: snapshot.Connections, Devices: snapshot.Devices, Rules: snapshot.Rules}, nil
+}
+
+// Save writes the file next to the destination and renames it over it so a
+// crash never leaves a partial file.
+func (f *FileStorage) Save(s State) error {
+	conns := s.Connections
+	if conns == nil {
+		conns = []Connection{}
+	}
+	data, err := json.Marshal(Snapshot{Version: SnapshotVersion, Connections: conns, Devices: s.Devices, Rules: s.Rules})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Read is Load without moving a corrupt file aside, it fails instead.
+func (f *FileStorage) Read() (State, error) {
+	snapshot, err := f.read()
+	if err != nil {
+		return State{}, err
+	}
+	return State{Connections: snapshot.Connections, Devices: snapshot.Devices, Rules: snapshot.Rules}, nil
+}
+
+// read decodes the file without moving it aside, for lookups.
+func (f *FileStorage) read() (Snapshot, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, nil
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return decodeSnapshot(data)
+}
+
+func (f *FileStorage) ByAddr(addr string) ([]Connection, error) {
+	return f.filter(func(c Connection) bool { return c.HasAddr(addr) })
+}
+
+func (f *FileStorage) ByHost(host string) ([]Connection, error) {
+	return f.filter(func(c Connection) bool { return c.HasHost(host) })
+}
+
+func (f *FileStorage) filter(match func(c Connection) bool) ([]Connection, error) {
+	snapshot, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	var out []Connection
+	for _, c := range snapshot.Connections {
+		if match(c) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func (f *FileStorage) Device(addr string) (Device, bool, error) {
+	snapshot, err := f.read()
+	if err != nil {
+		return Device{}, false, err
+	}
+	for _, d := range snapshot.Devices {
+		if d.Addr == addr {
+			return d, true, nil
+		}
+	}
+	return Device{}, false, nil
+}
@@ -6,12 +6,24 @@
 #include <linux/if_ether.h>
 #include <linux/ip.h>
 #include <linux/ipv6.h>
+#include <linux/pkt_cls.h>
+#include <linux/tcp.h>
 #include <linux/types.h>
+#include <linux/udp.h>
 // clang-format on
 
+// rx is counted by the ingress hook (XDP, or TC when XDP is not attached) and
+// tx by the TC egress classifier.
+enum direction {
+    DIR_RX = 0,
+    DIR_TX = 1,
+};
+
 typedef struct connection_stats {
-    __u64 packets;
-    __u64 bytes;
+    __u64 rx_packets;
+    __u64 rx_bytes;
+    __u64 tx_packets;
+    __u64 tx_bytes;
 } connection_stats;
 
 struct {
@@ -21,9 +33,19 @@ struct {
     __type(value, connection_stats);
 } ipv4_connection_tracker SEC(".maps");
 
+// Everything is kept in network byte order, ifindex included. For ICMP the
+// type and code are stored in sport and dport, other protocols have them
+// zeroed. ifindex is the interface the packet was counted on. Both directions
+// of a conversation share an entry: keys are those of the sent packets,
+// received packets are keyed with their addresses, and ports, swapped.
 struct ipv4_key {
     unsigned int saddr;
     unsigned int daddr;
+    __u16 sport;
+    __u16 dport;
+    __u8 proto;
+    __u8 pad[3];
+    __u32 ifindex;
 };
 
 struct {
@@ -36,20 +58,263 @@ struct {
 struct ipv6_key {
     struct in6_addr saddr;
     struct in6_addr daddr;
+    __u16 sport;
+    __u16 dport;
+    __u8 proto;
+    __u8 pad[3];
+    __u32 ifindex;
 };
 
-SEC("xdp")
-int xdp_count_type(struct xdp_md *ctx) {
-    void *data_end = (void *)(long)ctx->data_end;
-    void *data = (void *)(long)ctx->data;
-    struct ethhdr *eth = data;
-    uint64_t eth_offset = sizeof(*eth);
+// Interfaces carrying bare IP packets with no ethernet header, like WireGuard
+// and tun devices, keyed by ifindex. Filled in by user space when attaching.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 64);
+    __type(key, __u32);
+    __type(value, __u8);
+} l3_interfaces SEC(".maps");
 
-    if (data + eth_offset > data_end) {
-        return XDP_DROP;
+// Sent once per flow, when the packet that creates its map entry is seen, so
+// user space can pick it up without waiting for the next map scan.
+#define FLOW_EVENT_KEY_SIZE 64
+
+struct new_flow_event {
+    __u32 family;
+    __u32 payload;
+    __u32 direction;
+    __u8 key[FLOW_EVENT_KEY_SIZE];
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} new_flow_events SEC(".maps");
+
+// Blocklist. Rules are keyed on the network they match, both the source and
+// the destination address of a packet are looked up. An LPM lookup only
+// returns the longest matching prefix, so user space stores with each prefix
+// the rules of the shorter prefixes covering it too.
+#define MAX_RULES_PER_PREFIX 8
+#define MAX_BLOCK_RULES 256
+
+struct block_rule {
+    __u32 id;   // index in block_rule_drops
+    __u16 port; // destination port in network byte order, 0 matches any
+    __u8 proto; // 0 matches any
+    __u8 pad;
+};
+
+struct block_rules {
+    __u32 count;
+    struct block_rule rules[MAX_RULES_PER_PREFIX];
+};
+
+struct ipv4_lpm_key {
+    __u32 prefixlen;
+    __u32 addr;
+};
+
+struct ipv6_lpm_key {
+    __u32 prefixlen;
+    struct in6_addr addr;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct ipv4_lpm_key);
+    __type(value, struct block_rules);
+} ipv4_blocklist SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 1024);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct ipv6_lpm_key);
+    __type(value, struct block_rules);
+} ipv6_blocklist SEC(".maps");
+
+struct drop_stats {
+    __u64 packets;
+    __u64 bytes;
+};
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, MAX_BLOCK_RULES);
+    __type(key, __u32);
+    __type(value, struct drop_stats);
+} block_rule_drops SEC(".maps");
+
+// match_rule returns the id of the first rule of r matching proto and dport,
+// or -1.
+static __always_inline long match_rule(struct block_rules *r, __u8 proto, __u16 dport) {
+    if (!r) {
+        return -1;
+    }
+    for (int i = 0; i < MAX_RULES_PER_PREFIX; i++) {
+        if (i >= r->count) {
+            break;
+        }
+        struct block_rule *rule = &r->rules[i];
+        if ((rule->proto == 0 || rule->proto == proto) && (rule->port == 0 || rule->port == dport)) {
+            return rule->id;
+        }
+    }
+    return -1;
+}
+
+// blocked looks up the source and then the destination key in map and counts
+// the drop against the matching rule. Returns 1 when the packet is to be
+// dropped.
+static __always_inline int blocked(void *map, const void *skey, const void *dkey, __u8 proto, __u16 dport, __u64 bytes) {
+    long id = match_rule(bpf_map_lookup_elem(map, skey), proto, dport);
+    if (id < 0) {
+        id = match_rule(bpf_map_lookup_elem(map, dkey), proto, dport);
+    }
+    if (id < 0) {
+        return 0;
+    }
+
+    __u32 idx = id;
+    struct drop_stats *drops = bpf_map_lookup_elem(&block_rule_drops, &idx);
+    if (drops) {
+        __sync_fetch_and_add(&drops->packets, 1);
+        __sync_fetch_and_add(&drops->bytes, bytes);
+    }
+    return 1;
+}
+
+static __always_inline void emit_new_flow(__u32 family, const void *key, __u32 payload, __u32 dir) {
+    struct new_flow_event *e = bpf_ringbuf_reserve(&new_flow_events, sizeof(*e), 0);
+    if (!e) {
+        return;
+    }
+
+    __builtin_memset(e->key, 0, sizeof(e->key));
+    e->family = family;
+    e->payload = payload;
+    e->direction = dir;
+    if (family == 4) {
+        __builtin_memcpy(e->key, key, sizeof(struct ipv4_key));
+    } else {
+        __builtin_memcpy(e->key, key, sizeof(struct ipv6_key));
+    }
+    bpf_ringbuf_submit(e, 0);
+}
+
+static __always_inline void parse_l4(void *l4, void *data_end, __u8 proto, __u16 *sport, __u16 *dport) {
+    switch (proto) {
+    case IPPROTO_TCP: {
+        struct tcphdr *tcph = l4;
+        if ((void *)&tcph[1] > data_end) {
+            return;
+        }
+        *sport = tcph->source;
+        *dport = tcph->dest;
+        return;
+    }
+    case IPPROTO_UDP: {
+        struct udphdr *udph = l4;
+        if ((void *)&udph[1] > data_end) {
+            return;
+        }
+        *sport = udph->source;
+        *dport = udph->dest;
+        return;
+    }
+    case IPPROTO_ICMP:
+    case IPPROTO_ICMPV6: {
+        // Type and code are the first two bytes of both ICMP headers.
+        __u8 *icmp = l4;
+        if ((void *)(icmp + 2) > data_end) {
+            return;
+        }
+        *sport = htons(icmp[0]);
+        *dport = htons(icmp[1]);
+        return;
+    }
+    }
+}
+
+static __always_inline int is_icmp(__u8 proto) {
+    return proto == IPPROTO_ICMP || proto == IPPROTO_ICMPV6;
+}
+
+static __always_inline void swap_ports(__u8 proto, __u16 *sport, __u16 *dport) {
+    // An ICMP type and code are not a source and a destination.
+    if (is_icmp(proto)) {
+        return;
+    }
+    __u16 port = *sport;
+    *sport = *dport;
+    *dport = port;
+}
+
+static __always_inline void add_stats(struct connection_stats *stats, __u64 bytes, __u32 dir) {
+    // XDP and TC run on different CPUs and can hit the same entry.
+    if (dir == DIR_TX) {
+        __sync_fetch_and_add(&stats->tx_packets, 1);
+        __sync_fetch_and_add(&stats->tx_bytes, bytes);
+    } else {
+        __sync_fetch_and_add(&stats->rx_packets, 1);
+        __sync_fetch_and_add(&stats->rx_bytes, bytes);
+    }
+}
+
+static __always_inline void count_flow(void *map, __u32 family, const void *key, __u64 payload_size, __u32 dir) {
+    struct connection_stats *stats = bpf_map_lookup_elem(map, key);
+    if (stats != NULL) {
+        add_stats(stats, payload_size, dir);
+        return;
+    }
+
+    struct connection_stats new_stats = {};
+    if (dir == DIR_TX) {
+        new_stats.tx_packets = 1;
+        new_stats.tx_bytes = payload_size;
+    } else {
+        new_stats.rx_packets = 1;
+        new_stats.rx_bytes = payload_size;
+    }
+    if (bpf_map_update_elem(map, key, &new_stats, BPF_NOEXIST) == 0) {
+        emit_new_flow(family, key, payload_size, dir);
+    } else if ((stats = bpf_map_lookup_elem(map, key)) != NULL) {
+        // Another CPU created the entry in between.
+        add_stats(stats, payload_size, dir);
+    }
+}
+
+// count_packet is shared by the XDP and TC programs, both hand it a packet
+// starting at the ethernet header, or at the IP header on the interfaces of
+// l3_interfaces. Returns -1 when the packet is shorter than its headers and 1
+// when it matches the blocklist, only received packets are checked. Dropped
+// packets are not counted in the flow maps.
+static __always_inline int count_packet(void *data, void *data_end, __u32 ifindex, __u32 dir) {
+    uint64_t eth_offset = 0;
+    uint16_t h_proto = 0;
+
+    if (bpf_map_lookup_elem(&l3_interfaces, &ifindex)) {
+        // No link layer header, the IP version tells the family.
+        __u8 *version = data;
+        if ((void *)(version + 1) > data_end) {
+            return -1;
+        }
+        if (*version >> 4 == 4) {
+            h_proto = htons(ETH_P_IP);
+        } else if (*version >> 4 == 6) {
+            h_proto = htons(ETH_P_IPV6);
+        }
+    } else {
+        struct ethhdr *eth = data;
+        eth_offset = sizeof(*eth);
+        if (data + eth_offset > data_end) {
+            return -1;
+        }
+        h_proto = eth->h_proto;
     }
 
-    uint16_t h_proto = eth->h_proto;
     if (h_proto == htons(ETH_P_IP)) {
         //  Packet data from: https://stackoverflow.com/questions/58255831/xdp-program-ipheader-data-nh-off-confusion
         //  | Ethernet     | IPv4               | IPv4 data (e.g. L4, data)       |
@@ -60,70 +325,94 @@ int xdp_count_type(struct xdp_md *ctx) {
         //                 &iph[0]              &iph[1]
         struct iphdr *iph = data + eth_offset;
         if ((void *)&iph[1] > data_end) {
-            return XDP_ABORTED;
+            return -1;
         }
 
         // maybe don't count packets that have ttl < 1?
 
-        struct ipv4_key new_connection = {iph->saddr, iph->daddr};
-        struct connection_stats *stats;
-
-        stats = bpf_map_lookup_elem(&ipv4_connection_tracker, &new_connection);
-        if (stats == NULL) {
-            uint64_t payload_size = ntohs(iph->tot_len) - sizeof(*iph);
-            struct connection_stats new_stats = {1, payload_size};
-
-            bpf_printk("Got packet to a new connection with source %pI4 and destination %pI4",
-                       &iph->saddr,
-                       &iph->daddr);
-            bpf_map_update_elem(&ipv4_connection_tracker, &new_connection, &new_stats, BPF_NOEXIST);
-        } else {
-            uint64_t payload_size = ntohs(iph->tot_len) - sizeof(*iph);
-            (*stats).bytes += payload_size;
-            (*stats).packets++;
-
-            bpf_printk("Got packet to existing connection with source %pI4 and destination %pI4 this is packet number: %lu with a total %lu of bytes transferred",
-                       &iph->saddr,
-                       &iph->daddr,
-                       (*stats).packets,
-                       (*stats).bytes);
-
-            bpf_map_update_elem(&ipv4_connection_tracker, &new_connection, stats, BPF_EXIST);
+        struct ipv4_key new_connection = {
+            .saddr = iph->saddr, .daddr = iph->daddr, .proto = iph->protocol, .ifindex = htonl(ifindex)};
+        // Only the first fragment carries the L4 header.
+        if (iph->ihl >= 5 && (iph->frag_off & htons(0x1FFF)) == 0) {
+            parse_l4((void *)iph + iph->ihl * 4, data_end, iph->protocol, &new_connection.sport, &new_connection.dport);
+        }
+
+        uint64_t payload_size = ntohs(iph->tot_len) - sizeof(*iph);
+        if (dir == DIR_RX) {
+            struct ipv4_lpm_key skey = {.prefixlen = 32, .addr = iph->saddr};
+            struct ipv4_lpm_key dkey = {.prefixlen = 32, .addr = iph->daddr};
+            if (blocked(&ipv4_blocklist, &skey, &dkey, new_connection.proto, new_connection.dport, payload_size)) {
+                return 1;
+            }
+            new_connection.saddr = iph->daddr;
+            new_connection.daddr = iph->saddr;
+            swap_ports(new_connection.proto, &new_connection.sport, &new_connection.dport);
         }
+        count_flow(&ipv4_connection_tracker, 4, &new_connection, payload_size, dir);
     } else if (h_proto == htons(ETH_P_IPV6)) {
         struct ipv6hdr *ip6h = data + eth_offset;
 
         if ((void *)&ip6h[1] > data_end) {
-            return XDP_ABORTED;
+            return -1;
         }
 
         // maybe don't count packets that have hop_limit < 1?
 
-        struct ipv6_key new_connection = {ip6h->saddr, ip6h->daddr};
-        struct connection_stats *stats;
-        stats = bpf_map_lookup_elem(&ipv6_connection_tracker, &new_connection);
-        if (stats == NULL) {
-            struct connection_stats new_stats = {1, ntohs(ip6h->payload_len)};
-
-            bpf_printk("Got packet to a new ipv6 connection with source %pI6 and destination %pI6",
-                       &ip6h->saddr,
-                       &ip6h->daddr);
-
-            bpf_map_update_elem(&ipv6_connection_tracker, &new_connection, &new_stats, BPF_NOEXIST);
-        } else {
-            (*stats).bytes += ntohs(ip6h->payload_len);
-            (*stats).packets++;
-
-            bpf_printk("Got packet to existing ipv6 connection with source %pI6 and destination %pI6 this is packet number: %lu with a total %lu of bytes transferred",
-                       &ip6h->saddr,
-                       &ip6h->daddr,
-                       (*stats).packets,
-                       (*stats).bytes);
-            bpf_map_update_elem(&ipv6_connection_tracker, &new_connection, stats, BPF_EXIST);
+        // Extension headers are not walked, such packets are keyed on the
+        // next header value with no ports.
+        struct ipv6_key new_connection = {
+            .saddr = ip6h->saddr, .daddr = ip6h->daddr, .proto = ip6h->nexthdr, .ifindex = htonl(ifindex)};
+        parse_l4(&ip6h[1], data_end, ip6h->nexthdr, &new_connection.sport, &new_connection.dport);
+
+        if (dir == DIR_RX) {
+            struct ipv6_lpm_key skey = {.prefixlen = 128, .addr = ip6h->saddr};
+            struct ipv6_lpm_key dkey = {.prefixlen = 128, .addr = ip6h->daddr};
+            if (blocked(&ipv6_blocklist, &skey, &dkey, new_connection.proto, new_connection.dport,
+                        ntohs(ip6h->payload_len))) {
+                return 1;
+            }
+            new_connection.saddr = ip6h->daddr;
+            new_connection.daddr = ip6h->saddr;
+            swap_ports(new_connection.proto, &new_connection.sport, &new_connection.dport);
         }
+        count_flow(&ipv6_connection_tracker, 6, &new_connection, ntohs(ip6h->payload_len), dir);
     }
 
+    return 0;
+}
+
+SEC("xdp")
+int xdp_count_type(struct xdp_md *ctx) {
+    void *data_end = (void *)(long)ctx->data_end;
+    void *data = (void *)(long)ctx->data;
+
+    if (data + sizeof(struct ethhdr) > data_end) {
+        return XDP_DROP;
+    }
+    switch (count_packet(data, data_end, ctx->ingress_ifindex, DIR_RX)) {
+    case -1:
+        return XDP_ABORTED;
+    case 1:
+        return XDP_DROP;
+    }
     return XDP_PASS;
 }
 
+// The egress classifier only counts, it always lets the packet through.
+SEC("tc")
+int tc_count_egress(struct __sk_buff *skb) {
+    count_packet((void *)(long)skb->data, (void *)(long)skb->data_end, skb->ifindex, DIR_TX);
+    return TC_ACT_OK;
+}
+
+// Counts ingress and enforces the blocklist when XDP can't be used, attach
+// one or the other.
+SEC("tc")
+int tc_count_ingress(struct __sk_buff *skb) {
+    if (count_packet((void *)(long)skb->data, (void *)(long)skb->data_end, skb->ifindex, DIR_RX) == 1) {
+        return TC_ACT_SHOT;
+    }
+    return TC_ACT_OK;
+}
+
 char _license[] SEC("license") = "GPL";